@@ -0,0 +1,98 @@
+package asset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressible are the extensions of text files worth compressing. Images and fonts like woff2
+// are compressed already.
+var compressible = map[string]bool{
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+	".txt":  true,
+	".html": true,
+	".xml":  true,
+	".ico":  true,
+	".eot":  true,
+	".ttf":  true,
+}
+
+// variant is a compressed representation of a static file.
+type variant struct {
+	encoding string // Content-Encoding
+	content  []byte
+}
+
+// compress returns the Brotli and gzip variants of a compressible file, with the best compression
+// since they are only compressed once. Variants that aren't at least 10% smaller are left out.
+func compress(name string, content []byte) ([]variant, error) {
+	if !compressible[strings.ToLower(path.Ext(name))] {
+		return nil, nil
+	}
+	encoders := []struct {
+		encoding  string
+		newWriter func(io.Writer) (io.WriteCloser, error)
+	}{
+		{"br", func(w io.Writer) (io.WriteCloser, error) {
+			return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+		}},
+		{"gzip", func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		}},
+	}
+	var variants []variant
+	for _, encoder := range encoders {
+		var buf bytes.Buffer
+		w, err := encoder.newWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len()*10 <= len(content)*9 {
+			variants = append(variants, variant{encoding: encoder.encoding, content: buf.Bytes()})
+		}
+	}
+	return variants, nil
+}
+
+// negotiate returns the first of the variants accepted by the Accept-Encoding header, if any.
+// Quality values only exclude encodings (q=0), the variants are already in order of preference.
+func negotiate(acceptEncoding string, variants []variant) (variant, bool) {
+	if acceptEncoding == "" || len(variants) == 0 {
+		return variant{}, false
+	}
+	accepted := make(map[string]bool)
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[name] = true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					accepted[name] = false
+				}
+			}
+		}
+	}
+	for _, v := range variants {
+		if ok, listed := accepted[v.encoding]; ok || (!listed && accepted["*"]) {
+			return v, true
+		}
+	}
+	return variant{}, false
+}
@@ -0,0 +1,169 @@
+// Package asset fingerprints static files, so that they can be cached forever by browsers,
+// and compresses them on startup instead of on every request.
+package asset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// immutable is the Cache-Control header of fingerprinted URLs, which change whenever the file does.
+const immutable = "public, max-age=31536000, immutable"
+
+// Asset is a fingerprinted static file.
+type Asset struct {
+	Name      string // the path of the file, e.g. "css/style.css"
+	URL       string // the path including the hash of the content, e.g. "/css/style.5d41402abc4b.css"
+	ETag      string
+	Integrity string // Subresource Integrity hash, e.g. "sha384-..."
+
+	variants []variant // precompressed, in order of preference
+}
+
+// Manifest maps the names of static files to fingerprinted URLs, built from their content on startup.
+// Text files are also compressed on startup, see Middleware.
+type Manifest struct {
+	fsys   fs.FS
+	assets map[string]*Asset // by name
+	urls   map[string]*Asset // by URL
+}
+
+// NewManifest fingerprints every file in fsys.
+func NewManifest(fsys fs.FS) (*Manifest, error) {
+	m := &Manifest{
+		fsys:   fsys,
+		assets: make(map[string]*Asset),
+		urls:   make(map[string]*Asset),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		asset, err := fingerprint(fsys, name)
+		if err != nil {
+			return err
+		}
+		m.assets[name] = asset
+		m.urls[asset.URL] = asset
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func fingerprint(fsys fs.FS, name string) (*Asset, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sha256Sum, sha384Sum := sha256.Sum256(content), sha512.Sum384(content)
+	hash := hex.EncodeToString(sha256Sum[:])[:12]
+	ext := path.Ext(name)
+	variants, err := compress(name, content)
+	if err != nil {
+		return nil, err
+	}
+	return &Asset{
+		Name:      name,
+		URL:       "/" + strings.TrimSuffix(name, ext) + "." + hash + ext,
+		ETag:      `"` + hash + `"`,
+		Integrity: "sha384-" + base64.StdEncoding.EncodeToString(sha384Sum[:]),
+		variants:  variants,
+	}, nil
+}
+
+// Len returns the number of static files.
+func (m *Manifest) Len() int {
+	return len(m.assets)
+}
+
+// Lookup returns the asset with the name, e.g. "css/style.css", if the file exists.
+func (m *Manifest) Lookup(name string) (*Asset, bool) {
+	asset, ok := m.assets[strings.TrimPrefix(name, "/")]
+	return asset, ok
+}
+
+// URL returns the fingerprinted URL of the named file, or its unversioned path if it doesn't exist.
+func (m *Manifest) URL(name string) string {
+	if asset, ok := m.Lookup(name); ok {
+		return asset.URL
+	}
+	return "/" + strings.TrimPrefix(name, "/")
+}
+
+// Integrity returns the Subresource Integrity hash of the named file, empty if it doesn't exist.
+func (m *Manifest) Integrity(name string) string {
+	if asset, ok := m.Lookup(name); ok {
+		return asset.Integrity
+	}
+	return ""
+}
+
+// Middleware serves the static files, both at their fingerprinted URLs, cached by browsers for a year,
+// and their unversioned paths, leaving the Cache-Control header to earlier middleware. Precompressed
+// variants are served to clients accepting them, so the responses should not be compressed again, see
+// Skipper. All other requests are passed on.
+func (m *Manifest) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return next(c)
+		}
+		header := c.Response().Header()
+		asset, ok := m.urls[req.URL.Path]
+		if ok {
+			header.Set(echo.HeaderCacheControl, immutable)
+		} else if asset, ok = m.Lookup(req.URL.Path); !ok {
+			return next(c)
+		}
+
+		var content io.ReadSeeker
+		etag := asset.ETag
+		if len(asset.variants) > 0 {
+			header.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		}
+		if v, ok := negotiate(req.Header.Get(echo.HeaderAcceptEncoding), asset.variants); ok {
+			header.Set(echo.HeaderContentEncoding, v.encoding)
+			// Each representation has its own ETag, or caches could mix them up.
+			etag = strings.TrimSuffix(etag, `"`) + "-" + v.encoding + `"`
+			content = bytes.NewReader(v.content)
+		} else {
+			f, err := m.fsys.Open(asset.Name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if content, ok = f.(io.ReadSeeker); !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError, "static file "+asset.Name+" cannot seek")
+			}
+		}
+		header.Set("ETag", etag)
+		// Sets the Content-Type from the extension of the name and handles conditional and range requests.
+		http.ServeContent(c.Response(), req, asset.Name, time.Time{}, content)
+		return nil
+	}
+}
+
+// Skipper returns whether the request is for a static file served by Middleware, which must not be
+// compressed again, e.g. as the Skipper of the Gzip middleware.
+func (m *Manifest) Skipper(c echo.Context) bool {
+	p := c.Request().URL.Path
+	if _, ok := m.urls[p]; ok {
+		return true
+	}
+	_, ok := m.Lookup(p)
+	return ok
+}
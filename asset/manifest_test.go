@@ -0,0 +1,193 @@
+package asset_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/asset"
+)
+
+func TestManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"css/style.css":    {Data: []byte("body { margin: 0; }")},
+		"images/crown.svg": {Data: []byte("<svg></svg>")},
+		"robots.txt":       {Data: []byte("User-agent: *")},
+	}
+	m, err := asset.NewManifest(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 3 {
+		t.Errorf("Expected 3 assets, got %d", m.Len())
+	}
+	url := m.URL("css/style.css")
+	if !regexp.MustCompile(`^/css/style\.[0-9a-f]{12}\.css$`).MatchString(url) {
+		t.Errorf("Unexpected fingerprinted URL %q", url)
+	}
+	if m.URL("/css/style.css") != url {
+		t.Error("Expected the same URL with a leading slash")
+	}
+	if url := m.URL("css/missing.css"); url != "/css/missing.css" {
+		t.Errorf("Expected the path of a missing file, got %q", url)
+	}
+	sum := sha512.Sum384([]byte("body { margin: 0; }"))
+	if integrity := m.Integrity("css/style.css"); integrity != "sha384-"+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected integrity %q", integrity)
+	}
+	if m.Integrity("css/missing.css") != "" {
+		t.Error("Expected no integrity for a missing file")
+	}
+
+	// A changed file has a different URL.
+	fsys["css/style.css"] = &fstest.MapFile{Data: []byte("body { margin: 1px; }")}
+	changed, err := asset.NewManifest(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.URL("css/style.css") == url || changed.URL("robots.txt") != m.URL("robots.txt") {
+		t.Error("Expected only the URL of the changed file to change")
+	}
+}
+
+func TestManifestMiddleware(t *testing.T) {
+	m, err := asset.NewManifest(fstest.MapFS{
+		"css/style.css": {Data: []byte("body { margin: 0; }")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(m.Middleware)
+	e.GET("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "next")
+	})
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	url := m.URL("css/style.css")
+	rec := serve(http.MethodGet, url, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "body { margin: 0; }" {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get(echo.HeaderCacheControl); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "text/css; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	etag := rec.Header().Get("ETag")
+	if rec := serve(http.MethodGet, url, http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodHead, url, nil); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected HEAD response %d %q", rec.Code, rec.Body.String())
+	}
+	// Unversioned paths are served without the Cache-Control header.
+	if rec := serve(http.MethodGet, "/css/style.css", nil); rec.Body.String() != "body { margin: 0; }" || rec.Header().Get(echo.HeaderCacheControl) != "" {
+		t.Errorf("Unexpected response for the unversioned path %d %v", rec.Code, rec.Header())
+	}
+	// Unknown files and other methods are passed on.
+	for _, path := range []string{"/css/style.000000000000.css", "/css/missing.css", "/"} {
+		if rec := serve(http.MethodGet, path, nil); rec.Body.String() != "next" || rec.Header().Get(echo.HeaderCacheControl) != "" {
+			t.Errorf("Expected %s to be passed on", path)
+		}
+	}
+	if rec := serve(http.MethodPost, url, nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be passed on, got %d", rec.Code)
+	}
+}
+
+func TestManifestCompression(t *testing.T) {
+	css := []byte(strings.Repeat("body { margin: 0; } ", 100))
+	m, err := asset.NewManifest(fstest.MapFS{
+		"css/style.css":  {Data: css},
+		"images/scp.jpg": {Data: bytes.Repeat([]byte{0xff}, 1000)},
+		"robots.txt":     {Data: []byte("User-agent: *")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(m.Middleware)
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set(echo.HeaderAcceptEncoding, acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0, gzip;q=0.5", "gzip"},
+		{"*", "br"},
+		{"*, br;q=0", "gzip"},
+		{"identity", ""},
+	}
+	etags := make(map[string]string)
+	for _, path := range []string{"/css/style.css", m.URL("css/style.css")} {
+		for _, test := range tests {
+			rec := serve(path, test.acceptEncoding)
+			if enc := rec.Header().Get(echo.HeaderContentEncoding); enc != test.encoding {
+				t.Errorf("%s with Accept-Encoding %q: expected encoding %q, got %q", path, test.acceptEncoding, test.encoding, enc)
+			}
+			if vary := rec.Header().Get(echo.HeaderVary); vary != echo.HeaderAcceptEncoding {
+				t.Errorf("%s: expected Vary: Accept-Encoding, got %q", path, vary)
+			}
+			if ct := rec.Header().Get(echo.HeaderContentType); ct != "text/css; charset=utf-8" {
+				t.Errorf("%s: unexpected Content-Type %q", path, ct)
+			}
+			var body io.Reader = rec.Body
+			switch test.encoding {
+			case "br":
+				body = brotli.NewReader(rec.Body)
+			case "gzip":
+				if body, err = gzip.NewReader(rec.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if decoded, err := ioutil.ReadAll(body); err != nil || !bytes.Equal(decoded, css) {
+				t.Errorf("%s with Accept-Encoding %q: unexpected content (%v)", path, test.acceptEncoding, err)
+			}
+			etags[test.encoding+" "+rec.Header().Get("ETag")] = test.encoding
+		}
+	}
+	if len(etags) != 3 {
+		t.Errorf("Expected a different ETag per encoding, got %v", etags)
+	}
+
+	// Images and small files aren't compressed, or worth compressing.
+	for _, path := range []string{"/images/scp.jpg", "/robots.txt"} {
+		rec := serve(path, "gzip, br")
+		if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentEncoding) != "" || rec.Header().Get(echo.HeaderVary) != "" {
+			t.Errorf("Expected %s to be served uncompressed, got %d %v", path, rec.Code, rec.Header())
+		}
+	}
+}
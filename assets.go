@@ -0,0 +1,49 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+
+	"github.com/cycraig/scpbattle/handler"
+	"github.com/cycraig/scpbattle/render"
+)
+
+// The templates and static files are embedded so that the binary runs from any directory.
+var (
+	//go:embed view
+	embeddedViews embed.FS
+	//go:embed static
+	embeddedStatic embed.FS
+)
+
+// newRenderer returns the template registry of views, failing if any template rendered by the
+// handlers is missing. Static files are referred to by their path if assets is nil.
+func newRenderer(views fs.FS, assets render.Assets, dev bool) (*render.Registry, error) {
+	renderer, err := render.New(views, render.Funcs(assets), dev)
+	if err != nil {
+		return nil, err
+	}
+	if err := renderer.Require(handler.Templates...); err != nil {
+		return nil, err
+	}
+	return renderer, nil
+}
+
+// assets returns the file systems of the templates (view/) and static files (static/), embedded in
+// the binary or, in development mode, read from the working directory so that edits take effect
+// without rebuilding.
+func assets(dev bool) (views fs.FS, static fs.FS) {
+	if dev {
+		return os.DirFS("view"), os.DirFS("static")
+	}
+	views, err := fs.Sub(embeddedViews, "view")
+	if err != nil {
+		panic(err) // only if the directive above is wrong
+	}
+	static, err = fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return views, static
+}
@@ -0,0 +1,127 @@
+// Package ballot signs the matchups shown to voters, so that votes can only be cast for a matchup
+// the server actually showed, once, instead of by scripting requests for arbitrary SCPs.
+package ballot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalid is returned by Redeem for a forged or malformed ballot, or a vote for other SCPs.
+	ErrInvalid = errors.New("invalid ballot")
+	// ErrExpired is returned by Redeem for a ballot older than the TTL; the voter should get a new matchup.
+	ErrExpired = errors.New("expired ballot")
+	// ErrUsed is returned by Redeem for a ballot that has already been cast.
+	ErrUsed = errors.New("ballot already cast")
+)
+
+// Signer issues and redeems ballots: tokens of the two SCPs of a matchup, when it expires and a random
+// nonce, so that matchups shown at the same time can each be voted on, signed with HMAC-SHA256.
+type Signer struct {
+	key []byte
+	ttl time.Duration
+
+	lock   sync.Mutex
+	used   map[string]time.Time // signatures of the redeemed ballots, until they expire
+	pruned time.Time            // when expired ballots were last removed from used
+}
+
+// NewSigner returns a Signer with the key, or a random key if it is empty, in which case ballots
+// issued before a restart or by other instances are invalid. Ballots expire after the ttl.
+func NewSigner(key string, ttl time.Duration) *Signer {
+	s := &Signer{key: []byte(key), ttl: ttl, used: make(map[string]time.Time), pruned: time.Now()}
+	if key == "" {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// Issue returns a ballot for a matchup between the two SCPs.
+func (s *Signer) Issue(leftID, rightID uint) string {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	payload := fmt.Sprintf("%d.%d.%d.%s", leftID, rightID, time.Now().Add(s.ttl).Unix(), base64.RawURLEncoding.EncodeToString(nonce))
+	return payload + "." + s.sign(payload)
+}
+
+// Redeem checks that the ballot was issued for a matchup between the winner and the loser, in either
+// order, and hasn't expired or been redeemed already. Ballots are only remembered by this Signer, so a
+// ballot can be cast once per instance.
+func (s *Signer) Redeem(token string, winnerID, loserID uint) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return ErrInvalid
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return ErrInvalid
+	}
+	fields := strings.Split(payload, ".")
+	if len(fields) != 4 {
+		return ErrInvalid
+	}
+	left, errLeft := strconv.ParseUint(fields[0], 10, 64)
+	right, errRight := strconv.ParseUint(fields[1], 10, 64)
+	expiry, errExpiry := strconv.ParseInt(fields[2], 10, 64)
+	if errLeft != nil || errRight != nil || errExpiry != nil {
+		return ErrInvalid
+	}
+	winner, loser := uint64(winnerID), uint64(loserID)
+	if !(winner == left && loser == right) && !(winner == right && loser == left) {
+		return ErrInvalid
+	}
+	now := time.Now()
+	expires := time.Unix(expiry, 0)
+	if !now.Before(expires) {
+		return ErrExpired
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.used[signature]; ok {
+		return ErrUsed
+	}
+	if now.Sub(s.pruned) > s.ttl {
+		// Expired ballots are rejected anyway.
+		for sig, exp := range s.used {
+			if !now.Before(exp) {
+				delete(s.used, sig)
+			}
+		}
+		s.pruned = now
+	}
+	s.used[signature] = expires
+	return nil
+}
+
+// Release forgets that a redeemed ballot was cast, so that it can be redeemed again, e.g. when the vote
+// could not be queued and the voter should retry with the same matchup.
+func (s *Signer) Release(token string) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.used, token[i+1:])
+}
+
+func (s *Signer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,57 @@
+package ballot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cycraig/scpbattle/ballot"
+)
+
+func TestSigner(t *testing.T) {
+	s := ballot.NewSigner("key", time.Hour)
+	token := s.Issue(1, 2)
+
+	forged := strings.Replace(token, "1.2.", "1.3.", 1)
+	if s.Issue(1, 2) == token {
+		t.Error("Expected every ballot to differ")
+	}
+	tests := []struct {
+		name            string
+		token           string
+		winner, loser   uint
+		expected, again error
+	}{
+		{"other SCPs", token, 1, 3, ballot.ErrInvalid, ballot.ErrInvalid},
+		{"forged", forged, 1, 3, ballot.ErrInvalid, ballot.ErrInvalid},
+		{"malformed", "1.2", 1, 2, ballot.ErrInvalid, ballot.ErrInvalid},
+		{"other key", ballot.NewSigner("other", time.Hour).Issue(1, 2), 1, 2, ballot.ErrInvalid, ballot.ErrInvalid},
+		{"expired", ballot.NewSigner("key", 0).Issue(1, 2), 1, 2, ballot.ErrExpired, ballot.ErrExpired},
+		{"valid", token, 2, 1, nil, ballot.ErrUsed},
+	}
+	for _, test := range tests {
+		if err := s.Redeem(test.token, test.winner, test.loser); err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+		if err := s.Redeem(test.token, test.winner, test.loser); err != test.again {
+			t.Errorf("%s: expected %v when redeemed again, got %v", test.name, test.again, err)
+		}
+	}
+
+	// Released ballots can be cast again, once.
+	s.Release(token)
+	if err := s.Redeem(token, 1, 2); err != nil {
+		t.Errorf("Expected a released ballot to be valid, got %v", err)
+	}
+	if err := s.Redeem(token, 1, 2); err != ballot.ErrUsed {
+		t.Errorf("Expected %v redeeming a released ballot twice, got %v", ballot.ErrUsed, err)
+	}
+
+	// Ballots are valid on other instances with the same key, and random keys differ.
+	if err := ballot.NewSigner("key", time.Hour).Redeem(s.Issue(1, 2), 1, 2); err != nil {
+		t.Errorf("Expected a ballot signed with the same key to be valid, got %v", err)
+	}
+	if err := ballot.NewSigner("", time.Hour).Redeem(ballot.NewSigner("", time.Hour).Issue(1, 2), 1, 2); err != ballot.ErrInvalid {
+		t.Errorf("Expected random keys to differ, got %v", err)
+	}
+}
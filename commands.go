@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/cycraig/scpbattle/asset"
+	"github.com/cycraig/scpbattle/config"
+	"github.com/cycraig/scpbattle/db"
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/store"
+)
+
+// Exit codes of every command.
+const (
+	exitOK    = 0 // success
+	exitError = 1 // the command failed, e.g. the database is unreachable or a check failed
+	exitUsage = 2 // invalid flags, arguments or configuration
+)
+
+// command is a subcommand of the binary. Every command shares the configuration, see config.Load.
+type command struct {
+	name    string
+	args    string // usage of the arguments after the command's flags
+	summary string
+	// setup registers the command's flags and returns the function running it with the remaining arguments.
+	setup func(fs *flag.FlagSet) func(cfg *config.Config, args []string) int
+}
+
+// commands are listed in this order by --help, the first is run if no command is given.
+var commands = []command{
+	{"serve", "", "Start the web server (the default command).", setupServe},
+	{"migrate", "up|down [steps]|status", "Apply, revert or list database schema migrations.", setupMigrate},
+	{"seed", "", "Add the example SCPs, or those in a JSON file, skipping existing names.", setupSeed},
+	{"export", "[scps|matchups]", "Write the SCPs or head-to-head records as JSON or CSV.", setupExport},
+	{"recompute", "", "Recompute ratings, wins and losses from the head-to-head records.", setupRecompute},
+	{"create-admin", "<username>", "Create an admin account, reading its password from stdin.", setupCreateAdmin},
+	{"check", "", "Check the configuration, templates, static files and database.", setupCheck},
+	{"config", "", "Print the configuration with secrets redacted, and where each setting came from.", setupConfig},
+}
+
+// run loads the configuration and runs the command in args, returning the exit code.
+func run(name string, args []string) int {
+	cfg, args, err := config.Load(name, args, os.Stderr)
+	if err == flag.ErrHelp {
+		usage(os.Stdout, name)
+		return exitOK
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", name)
+		return exitUsage
+	}
+
+	cmd := &commands[0]
+	if len(args) > 0 {
+		if args[0] == "help" {
+			usage(os.Stdout, name)
+			return exitOK
+		}
+		cmd = findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+			fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", name)
+			return exitUsage
+		}
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(name+" "+cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] %s [command flags] %s\n\n%s\n", name, cmd.name, cmd.args, cmd.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(fs.Output(), "\nCommand flags:")
+			fs.PrintDefaults()
+		}
+	}
+	runCommand := cmd.setup(fs)
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	if cmd.name != "config" {
+		// The config command prints the configuration even if it is invalid.
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	return runCommand(cfg, fs.Args())
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer, name string) {
+	fmt.Fprintf(w, "Usage: %s [flags] [command] [command flags] [args]\n\nCommands:\n", name)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> --help' for the flags of a command.\n", name)
+	fmt.Fprintln(w, "Settings are read from the config file, then the environment, then flags.")
+	fmt.Fprintf(w, "\nExit codes: %d success, %d failure, %d invalid usage or configuration.\n", exitOK, exitError, exitUsage)
+	fmt.Fprintln(w, "\nFlags:")
+	config.PrintFlags(w)
+}
+
+// usageError reports invalid arguments of a command and returns exitUsage.
+func usageError(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintln(os.Stderr, "Run the command with --help for usage.")
+	return exitUsage
+}
+
+// failed reports the error that made a command fail and returns exitError.
+func failed(err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return exitError
+}
+
+// noArgs wraps a command that takes no arguments.
+func noArgs(runCommand func(cfg *config.Config) int) func(cfg *config.Config, args []string) int {
+	return func(cfg *config.Config, args []string) int {
+		if len(args) > 0 {
+			return usageError("Unexpected arguments %q", args)
+		}
+		return runCommand(cfg)
+	}
+}
+
+// dbOptions returns the database options in the configuration.
+func dbOptions(cfg *config.Config) db.Options {
+	opts := db.DefaultOptions()
+	opts.Log = cfg.Database.Log
+	opts.MaxOpenConns = cfg.Database.MaxOpenConns
+	opts.MaxIdleConns = cfg.Database.MaxIdleConns
+	opts.ConnMaxLifetime = cfg.Database.ConnMaxLifetime
+	opts.ConnectAttempts = cfg.Database.ConnectAttempts
+	return opts
+}
+
+// openDatabase connects to the configured database and applies any pending migrations,
+// refusing a schema from a newer release (see db.CheckSchema).
+func openDatabase(cfg *config.Config) (*gorm.DB, error) {
+	if cfg.Database.Store != "database" {
+		return nil, fmt.Errorf("the %s store has no database, use --store=database", cfg.Database.Store)
+	}
+	dbType, dbURL := cfg.Database.DatabaseURL()
+	d, err := db.Connect(dbType, dbURL, dbOptions(cfg))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.MigrateUp(d); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// newNotifier returns the catalogue notifier for the configured database.
+func newNotifier(cfg *config.Config, d *gorm.DB) (store.CatalogueNotifier, error) {
+	dbType, dbURL := cfg.Database.DatabaseURL()
+	return store.NewCatalogueNotifier(d, dbType, dbURL, cfg.Cache.CataloguePollInterval)
+}
+
+func setupServe(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	return noArgs(serve)
+}
+
+func setupConfig(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	return noArgs(func(cfg *config.Config) int {
+		if err := cfg.Print(os.Stdout); err != nil {
+			return failed(err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		return exitOK
+	})
+}
+
+func setupMigrate(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	return migrate
+}
+
+// migrate runs the "migrate up|down [steps]|status" command against the database and returns the exit code.
+func migrate(cfg *config.Config, args []string) int {
+	// Checked before connecting, which creates a missing SQLite database.
+	switch {
+	case len(args) == 1 && (args[0] == "up" || args[0] == "down" || args[0] == "status"):
+	case len(args) == 2 && args[0] == "down":
+	default:
+		return usageError("Expected up, down [steps] or status")
+	}
+	steps := 1
+	if len(args) == 2 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 1 {
+			return usageError("Invalid number of steps %q", args[1])
+		}
+	}
+	if cfg.Database.Store != "database" {
+		return failed(fmt.Errorf("the %s store has no database, use --store=database", cfg.Database.Store))
+	}
+	dbType, dbURL := cfg.Database.DatabaseURL()
+	d, err := db.Connect(dbType, dbURL, dbOptions(cfg))
+	if err != nil {
+		return failed(err)
+	}
+	defer d.Close()
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(d)
+		fmt.Printf("Applied %d migrations\n", applied)
+		if err != nil {
+			return failed(err)
+		}
+	case "down":
+		reverted, err := db.MigrateDown(d, steps)
+		fmt.Printf("Reverted %d migrations\n", reverted)
+		if err != nil {
+			return failed(err)
+		}
+	case "status":
+		statuses, err := db.Status(d)
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, applied)
+		}
+		if err != nil {
+			return failed(err)
+		}
+	}
+	return exitOK
+}
+
+// seedSCP is an SCP in a seed file, which holds a JSON array of them.
+type seedSCP struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Image       string `json:"image"` // file name in the image directory
+	Link        string `json:"link"`
+}
+
+// exampleSCPs are seeded by default, and into an empty catalogue when the server starts.
+var exampleSCPs = []seedSCP{
+	{"SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"},
+	{"SCP-055", "Not a Sphere?", "scp_055.jpg", "http://www.scp-wiki.net/scp-055"},
+	{"SCP-087", "The Stairwell", "scp_087.jpg", "http://www.scp-wiki.net/scp-087"},
+	{"SCP-093", "Red Sea Object", "scp_093.jpg", "http://www.scp-wiki.net/scp-093"},
+	{"SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"},
+	{"SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106"},
+	{"SCP-173", "The Sculpture", "scp_173.jpg", "http://www.scp-wiki.net/scp-173"},
+	{"SCP-610", "The Flesh that Hates", "scp_610.jpg", "http://www.scp-wiki.net/scp-610"},
+	{"SCP-682", "The Hard-To-Destroy Reptile", "scp_682.jpg", "http://www.scp-wiki.net/scp-682"},
+	{"SCP-939", "With Many Voices", "scp_939.jpg", "http://www.scp-wiki.net/scp-939"},
+	{"●●|●●●●●|●●|●", "", "scp_2521.jpg", "http://www.scp-wiki.net/scp-2521"},
+	{"SCP-3000", "Anantashesha", "scp_3000.jpg", "http://www.scp-wiki.net/scp-3000"},
+	{"SCP-3001", "Red Reality", "scp_3001.jpg", "http://www.scp-wiki.net/scp-3001"},
+	{"SCP-____-J", "Procrastinati", "scp_j.jpg", "http://www.scp-wiki.net/scp-j"},
+}
+
+// seed creates the SCPs in order, stopping at the first error, and returns how many were created.
+func seed(create func(scp *model.SCP) error, scps []seedSCP) (int, error) {
+	for i, scp := range scps {
+		if err := create(model.NewSCP(scp.Name, scp.Description, scp.Image, scp.Link)); err != nil {
+			return i, fmt.Errorf("cannot create %s: %w", scp.Name, err)
+		}
+	}
+	return len(scps), nil
+}
+
+func setupSeed(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	file := fs.String("file", "", `JSON array of SCPs to add, e.g. [{"name": "SCP-999", "description": "The Tickle Monster", "image": "scp_999.jpg", "link": "http://www.scp-wiki.net/scp-999"}], instead of the examples`)
+	return noArgs(func(cfg *config.Config) int {
+		scps := exampleSCPs
+		if *file != "" {
+			contents, err := ioutil.ReadFile(*file)
+			if err != nil {
+				return failed(err)
+			}
+			scps = nil
+			if err := json.Unmarshal(contents, &scps); err != nil {
+				return failed(fmt.Errorf("invalid seed file %s: %w", *file, err))
+			}
+			for _, scp := range scps {
+				if scp.Name == "" {
+					return failed(fmt.Errorf("invalid seed file %s: every SCP needs a name", *file))
+				}
+			}
+		}
+
+		d, err := openDatabase(cfg)
+		if err != nil {
+			return failed(err)
+		}
+		defer d.Close()
+		scpStore := store.NewSCPStore(d)
+		existing, err := scpStore.GetAllSCPs()
+		if err != nil {
+			return failed(err)
+		}
+		names := make(map[string]bool, len(existing))
+		for _, scp := range existing {
+			names[scp.Name] = true
+		}
+		var missing []seedSCP
+		for _, scp := range scps {
+			if !names[scp.Name] {
+				missing = append(missing, scp)
+				names[scp.Name] = true
+			}
+		}
+		created, err := seed(scpStore.Create, missing)
+		fmt.Printf("Created %d SCPs, skipped %d that already exist\n", created, len(scps)-len(missing))
+		if created > 0 {
+			// Let running servers know about the new SCPs.
+			if notifyErr := notifyCatalogue(cfg, d); notifyErr != nil {
+				fmt.Fprintln(os.Stderr, "Warning: running servers will only see the new SCPs on their next refresh:", notifyErr)
+			}
+		}
+		if err != nil {
+			return failed(err)
+		}
+		return exitOK
+	})
+}
+
+// notifyCatalogue tells the servers sharing the database to refresh their whole catalogue.
+func notifyCatalogue(cfg *config.Config, d *gorm.DB) error {
+	notifier, err := newNotifier(cfg, d)
+	if err != nil {
+		return err
+	}
+	defer notifier.Close()
+	return notifier.Notify(store.AllSCPs)
+}
+
+func setupExport(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	format := fs.String("format", "json", `output format, "json" or "csv"`)
+	output := fs.String("output", "", "file to write, instead of stdout")
+	return func(cfg *config.Config, args []string) int {
+		what := "scps"
+		if len(args) == 1 {
+			what = args[0]
+		} else if len(args) > 1 {
+			return usageError("Unexpected arguments %q", args[1:])
+		}
+		if what != "scps" && what != "matchups" {
+			return usageError("Cannot export %q, expected scps or matchups", what)
+		}
+		if *format != "json" && *format != "csv" {
+			return usageError("Unknown format %q, expected json or csv", *format)
+		}
+
+		d, err := openDatabase(cfg)
+		if err != nil {
+			return failed(err)
+		}
+		defer d.Close()
+		scpStore := store.NewSCPStore(d)
+		var header []string
+		var rows []map[string]interface{}
+		if what == "scps" {
+			scps, err := scpStore.GetAllSCPs()
+			if err != nil {
+				return failed(err)
+			}
+			header = []string{"id", "name", "description", "image", "link", "rating", "wins", "losses"}
+			for _, scp := range scps {
+				rows = append(rows, map[string]interface{}{
+					"id": scp.ID, "name": scp.Name, "description": scp.Description, "image": scp.Image,
+					"link": scp.Link, "rating": scp.Rating, "wins": scp.Wins, "losses": scp.Losses,
+				})
+			}
+		} else {
+			matchups, err := scpStore.GetAllMatchups()
+			if err != nil {
+				return failed(err)
+			}
+			header = []string{"first_id", "second_id", "first_wins", "second_wins"}
+			for _, matchup := range matchups {
+				rows = append(rows, map[string]interface{}{
+					"first_id": matchup.FirstID, "second_id": matchup.SecondID,
+					"first_wins": matchup.FirstWins, "second_wins": matchup.SecondWins,
+				})
+			}
+		}
+
+		w := io.Writer(os.Stdout)
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return failed(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if *format == "json" {
+			if rows == nil {
+				rows = []map[string]interface{}{}
+			}
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(rows)
+		} else {
+			err = writeCSV(w, header, rows)
+		}
+		if err != nil {
+			return failed(err)
+		}
+		return exitOK
+	}
+}
+
+func writeCSV(w io.Writer, header []string, rows []map[string]interface{}) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	record := make([]string, len(header))
+	for _, row := range rows {
+		for i, column := range header {
+			record[i] = fmt.Sprint(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func setupRecompute(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	apply := fs.Bool("apply", false, "write the recomputed values, instead of only listing the changes")
+	return noArgs(func(cfg *config.Config) int {
+		d, err := openDatabase(cfg)
+		if err != nil {
+			return failed(err)
+		}
+		defer d.Close()
+		scpStore := store.NewSCPStore(d)
+		scps, err := scpStore.GetAllSCPs()
+		if err != nil {
+			return failed(err)
+		}
+		matchups, err := scpStore.GetAllMatchups()
+		if err != nil {
+			return failed(err)
+		}
+		deltas := store.Recompute(scps, matchups, cfg.Votes.EloK)
+
+		byID := make(map[uint]*model.SCP, len(scps))
+		for _, scp := range scps {
+			byID[scp.ID] = scp
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SCP\tRATING\tWINS\tLOSSES")
+		for _, delta := range deltas {
+			scp := byID[delta.ID]
+			fmt.Fprintf(tw, "%s\t%.1f -> %.1f\t%d -> %d\t%d -> %d\n", scp.Name,
+				scp.Rating, scp.Rating+delta.Rating,
+				scp.Wins, int64(scp.Wins)+delta.Wins,
+				scp.Losses, int64(scp.Losses)+delta.Losses)
+		}
+		tw.Flush()
+		if !*apply || len(deltas) == 0 {
+			fmt.Printf("%d of %d SCPs would change with K=%g, run with --apply to write them\n", len(deltas), len(scps), cfg.Votes.EloK)
+			return exitOK
+		}
+		// Deltas are added to the stored values, so votes flushed meanwhile by running servers are kept.
+		missing, err := scpStore.ApplyDeltas(deltas, nil, nil, nil)
+		if err != nil {
+			return failed(err)
+		}
+		fmt.Printf("Recomputed %d of %d SCPs with K=%g\n", len(deltas)-len(missing), len(scps), cfg.Votes.EloK)
+		return exitOK
+	})
+}
+
+// minAdminPasswordLength is the shortest password accepted by create-admin.
+const minAdminPasswordLength = 12
+
+func setupCreateAdmin(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	reset := fs.Bool("reset", false, "change the password of an existing admin instead")
+	return func(cfg *config.Config, args []string) int {
+		if len(args) != 1 || args[0] == "" {
+			return usageError("Expected a username")
+		}
+		username := args[0]
+		// The password is never taken from the arguments, which are visible to other users in the process list.
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return failed(err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if len(password) < minAdminPasswordLength {
+			return usageError("The password read from stdin must be at least %d characters", minAdminPasswordLength)
+		}
+
+		d, err := openDatabase(cfg)
+		if err != nil {
+			return failed(err)
+		}
+		defer d.Close()
+		admins := store.NewAdminStore(d)
+		existing, err := admins.GetByUsername(username)
+		if err != nil {
+			return failed(err)
+		}
+		if (existing != nil) != *reset {
+			if *reset {
+				return failed(fmt.Errorf("no admin named %q", username))
+			}
+			return failed(fmt.Errorf("admin %q already exists, use --reset to change the password", username))
+		}
+		admin, err := model.NewAdmin(username, password)
+		if err != nil {
+			return failed(err)
+		}
+		if *reset {
+			existing.PasswordHash = admin.PasswordHash
+			err = admins.UpdatePassword(existing)
+		} else {
+			err = admins.Create(admin)
+		}
+		if err != nil {
+			return failed(err)
+		}
+		fmt.Printf("Saved admin %q\n", username)
+		return exitOK
+	}
+}
+
+func setupCheck(fs *flag.FlagSet) func(cfg *config.Config, args []string) int {
+	return noArgs(check)
+}
+
+// check runs the "check" command, verifying what the server needs to start, and returns the exit code.
+// The configuration has already been validated.
+func check(cfg *config.Config) int {
+	code := exitOK
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			code = exitError
+		} else {
+			fmt.Printf("ok    %s: %s\n", name, detail)
+		}
+	}
+	report("config", nil, "valid")
+
+	views, static := assets(cfg.Server.Dev)
+	manifest, err := asset.NewManifest(static)
+	if err != nil {
+		report("static files", err, "")
+		return code
+	}
+	renderer, err := newRenderer(views, manifest, false)
+	loaded := ""
+	if err == nil {
+		loaded = fmt.Sprintf("%d loaded", len(renderer.Templates()))
+	}
+	report("templates", err, loaded)
+
+	imageDir := path.Join(".", cfg.Server.ImageDir)
+	if info, err := fs.Stat(static, imageDir); err != nil {
+		report("static files", err, "")
+	} else if !info.IsDir() {
+		report("static files", fmt.Errorf("%s is not a directory", imageDir), "")
+	} else {
+		report("static files", nil, fmt.Sprintf("%s, %d fingerprinted", path.Join("static", imageDir), manifest.Len()))
+	}
+
+	if cfg.Database.Store != "database" {
+		report("database", nil, "skipped for the "+cfg.Database.Store+" store")
+		return code
+	}
+	dbType, dbURL := cfg.Database.DatabaseURL()
+	opts := dbOptions(cfg)
+	opts.ConnectAttempts = 1
+	d, err := db.Connect(dbType, dbURL, opts)
+	if err != nil {
+		report("database", err, "")
+		return code
+	}
+	defer d.Close()
+	version, err := db.SchemaVersion(d)
+	if err == nil {
+		err = db.CheckSchema(d)
+	}
+	detail := fmt.Sprintf("%s schema version %d", dbType, version)
+	if version < db.LatestVersion() {
+		detail += fmt.Sprintf(", %d will be applied on startup", db.LatestVersion())
+	}
+	report("database", err, detail)
+	if err != nil || version == 0 {
+		return code
+	}
+
+	scps, err := store.NewSCPStore(d).GetAllSCPs()
+	if err != nil {
+		report("images", err, "")
+		return code
+	}
+	var missing []string
+	for _, scp := range scps {
+		if _, err := fs.Stat(static, path.Join(imageDir, scp.Image)); err != nil {
+			missing = append(missing, scp.Image)
+		}
+	}
+	if len(missing) > 0 {
+		err = errors.New("missing " + strings.Join(missing, ", "))
+	}
+	report("images", err, fmt.Sprintf("all %d SCPs have images", len(scps)))
+	return code
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runOutput runs the command line like main, returning its exit code and what it wrote to stdout and stderr.
+func runOutput(t *testing.T, args ...string) (code int, stdout string, stderr string) {
+	t.Helper()
+	capture := func(f **os.File) (restore func() string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := *f
+		*f = w
+		out := make(chan string)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			out <- string(b)
+		}()
+		return func() string {
+			*f = original
+			w.Close()
+			return <-out
+		}
+	}
+	restoreStdout := capture(&os.Stdout)
+	restoreStderr := capture(&os.Stderr)
+	code = run("scpbattle", args)
+	return code, restoreStdout(), restoreStderr()
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	sqlitePath := "--sqlite-path=" + filepath.Join(dir, "test.db")
+	tests := []struct {
+		args   []string
+		code   int
+		stdout string // expected in stdout
+		stderr string // expected in stderr
+	}{
+		{[]string{"--help"}, exitOK, "Exit codes: 0 success, 1 failure, 2 invalid usage or configuration.", ""},
+		{[]string{"help"}, exitOK, "Usage: scpbattle [flags] [command]", ""},
+		{[]string{"migrate", "--help"}, exitOK, "", "Usage: scpbattle [flags] migrate [command flags] up|down [steps]|status"},
+		{[]string{"dance"}, exitUsage, "", `Unknown command "dance"`},
+		{[]string{"--no-such-flag"}, exitUsage, "", "Run 'scpbattle --help' for usage."},
+		{[]string{"export", "--no-such-flag"}, exitUsage, "", "flag provided but not defined: -no-such-flag"},
+		{[]string{"--sqlite-path=" + filepath.Join(dir, "unused.db"), "migrate", "sideways"}, exitUsage, "", "Expected up, down [steps] or status"},
+		{[]string{"--port=0", "check"}, exitUsage, "", "server.port"},
+		{[]string{"--store=memory", "migrate", "up"}, exitError, "", "Error: the memory store has no database"},
+		{[]string{sqlitePath, "seed", "--file=missing.json"}, exitError, "", "Error:"},
+		{[]string{sqlitePath, "migrate", "up"}, exitOK, "Applied", ""},
+		{[]string{sqlitePath, "export", "--format=csv"}, exitOK, "name", ""},
+	}
+	for _, test := range tests {
+		code, stdout, stderr := runOutput(t, test.args...)
+		if code != test.code || !strings.Contains(stdout, test.stdout) || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%v: expected exit code %d with %q and %q, got %d with\n%s\n%s", test.args, test.code, test.stdout, test.stderr, code, stdout, stderr)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unused.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected invalid usage not to create the database, got %v", err)
+	}
+}
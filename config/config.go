@@ -0,0 +1,424 @@
+// Package config loads the server configuration from a JSON file, environment variables and
+// command-line flags, in increasing order of precedence.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+)
+
+// Sources of a setting's value, see Config.Print.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// redacted replaces secrets when printing the configuration.
+const redacted = "REDACTED"
+
+// Config is the configuration of the server.
+type Config struct {
+	Server   ServerConfig
+	Database DatabaseConfig
+	Cache    CacheConfig
+	Votes    VotesConfig
+	Metrics  MetricsConfig
+
+	file     string    // the config file loaded, if any
+	settings []setting // bound to the fields above, see bind
+}
+
+// ServerConfig configures the HTTP server.
+type ServerConfig struct {
+	Port               int
+	Debug              bool   // Echo debug mode, e.g. showing internal error messages
+	Dev                bool   // serve templates and static files from the working directory instead of the binary
+	LogLevel           string // "debug", "info", "warn", "error" or "off"
+	LogIPHashKey       string // key of the hashed client IP addresses in logs, random if empty
+	BodyLimit          string // maximum request body size, e.g. "1M"
+	GzipLevel          int    // -1 (default compression) to 9 (best compression)
+	ImageDir           string // directory of the SCP images under static/, ending with a slash
+	ShortCacheMaxAge   time.Duration
+	LongCacheMaxAge    time.Duration
+	HSTSMaxAge         time.Duration // Strict-Transport-Security max-age over HTTPS, 0 to disable
+	SecureCookies      bool          // only send cookies over HTTPS
+	SessionKey         string        // key signing the session cookies of voters, random if empty
+	SessionMaxAge      time.Duration // how long a voter's session and its votes are kept after their first vote
+	ShutdownDrainDelay time.Duration
+	ShutdownTimeout    time.Duration
+}
+
+// DatabaseConfig configures where SCPs are stored.
+type DatabaseConfig struct {
+	Store           string // "database" or "memory"
+	URL             string // Postgres connection URL, SQLite is used if empty
+	SQLitePath      string
+	Log             bool // log every SQL statement
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectAttempts int
+}
+
+// CacheConfig configures the SCP cache.
+type CacheConfig struct {
+	UpdateTTL             time.Duration
+	RankingTTL            time.Duration
+	FlushInterval         time.Duration
+	CataloguePollInterval time.Duration
+}
+
+// VotesConfig configures the vote queue and how votes change ratings.
+type VotesConfig struct {
+	QueueDir      string // write-ahead log directory, empty to disable it
+	QueueCapacity int
+	QueueWorkers  int
+	EloK          float64 // maximum rating change of a single vote
+	BallotKey     string  // key signing the matchups shown to voters, random if empty
+	BallotTTL     time.Duration
+}
+
+// MetricsConfig configures access to the metrics endpoint.
+type MetricsConfig struct {
+	AllowedNetworks string // comma-separated CIDR networks
+	Token           string // bearer token allowed from any network, disabled if empty
+}
+
+// Default returns the default configuration, suitable for local development.
+func Default() *Config {
+	cfg := &Config{
+		Server: ServerConfig{
+			Port:               1323,
+			LogLevel:           "info",
+			BodyLimit:          "1M",
+			GzipLevel:          5,
+			ImageDir:           "images/",
+			ShortCacheMaxAge:   24 * time.Hour,
+			LongCacheMaxAge:    365 * 24 * time.Hour,
+			HSTSMaxAge:         365 * 24 * time.Hour,
+			SessionMaxAge:      365 * 24 * time.Hour,
+			ShutdownDrainDelay: 5 * time.Second,
+			ShutdownTimeout:    20 * time.Second, // Heroku kills the process 30 seconds after sending SIGTERM
+		},
+		Database: DatabaseConfig{
+			Store:           "database",
+			SQLitePath:      "data.db",
+			MaxOpenConns:    10,
+			MaxIdleConns:    3,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnectAttempts: 10,
+		},
+		Cache: CacheConfig{
+			UpdateTTL:             10 * time.Second,
+			RankingTTL:            5 * time.Second,
+			FlushInterval:         10 * time.Second,
+			CataloguePollInterval: 5 * time.Second,
+		},
+		Votes: VotesConfig{
+			QueueDir:      "wal",
+			QueueCapacity: 1000,
+			QueueWorkers:  4,
+			EloK:          20,
+			BallotTTL:     time.Hour,
+		},
+		Metrics: MetricsConfig{
+			AllowedNetworks: "127.0.0.0/8,::1/128",
+		},
+	}
+	cfg.bind()
+	return cfg
+}
+
+// bind lists every setting, bound to its field in the Config.
+func (cfg *Config) bind() {
+	s, d, c, v, m := &cfg.Server, &cfg.Database, &cfg.Cache, &cfg.Votes, &cfg.Metrics
+	cfg.settings = []setting{
+		{key: "server.port", env: "PORT", flag: "port", usage: "HTTP port to listen on", value: (*intValue)(&s.Port)},
+		{key: "server.debug", env: "DEBUG", flag: "debug", usage: "enable debug mode, showing internal errors to clients", value: (*boolValue)(&s.Debug)},
+		{key: "server.dev", env: "DEV", flag: "dev", usage: "serve templates and static files from view/ and static/ in the working directory instead of the binary, for live editing", value: (*boolValue)(&s.Dev)},
+		{key: "server.logLevel", env: "LOG_LEVEL", flag: "log-level", usage: `log level: "debug", "info", "warn", "error" or "off"`, value: (*stringValue)(&s.LogLevel)},
+		{key: "server.logIPHashKey", env: "LOG_IP_HASH_KEY", flag: "log-ip-hash-key", usage: "key of the hashed client IP addresses in logs, random (differing between restarts and instances) if empty", value: (*stringValue)(&s.LogIPHashKey), redact: redactAll},
+		{key: "server.bodyLimit", env: "BODY_LIMIT", flag: "body-limit", usage: "maximum request body size, e.g. 1M", value: (*stringValue)(&s.BodyLimit)},
+		{key: "server.gzipLevel", env: "GZIP_LEVEL", flag: "gzip-level", usage: "gzip compression level, -1 (default) to 9 (best)", value: (*intValue)(&s.GzipLevel)},
+		{key: "server.imageDir", env: "IMAGE_DIR", flag: "image-dir", usage: "directory of the SCP images in static/, with a trailing slash", value: (*stringValue)(&s.ImageDir)},
+		{key: "server.shortCacheMaxAge", env: "SHORT_CACHE_MAX_AGE", flag: "short-cache-max-age", usage: "Cache-Control max-age of images and stylesheets, 0 to disable", value: (*durationValue)(&s.ShortCacheMaxAge)},
+		{key: "server.longCacheMaxAge", env: "LONG_CACHE_MAX_AGE", flag: "long-cache-max-age", usage: "Cache-Control max-age of fonts, 0 to disable", value: (*durationValue)(&s.LongCacheMaxAge)},
+		{key: "server.hstsMaxAge", env: "HSTS_MAX_AGE", flag: "hsts-max-age", usage: "Strict-Transport-Security max-age of HTTPS responses, 0 to disable", value: (*durationValue)(&s.HSTSMaxAge)},
+		{key: "server.secureCookies", env: "SECURE_COOKIES", flag: "secure-cookies", usage: "only send cookies over HTTPS, enable when the site is served with HTTPS", value: (*boolValue)(&s.SecureCookies)},
+		{key: "server.sessionKey", env: "SESSION_KEY", flag: "session-key", usage: "key signing the session cookies of voters, random (sessions end on restart and are per instance) if empty", value: (*stringValue)(&s.SessionKey), redact: redactAll},
+		{key: "server.sessionMaxAge", env: "SESSION_MAX_AGE", flag: "session-max-age", usage: "how long a voter's session and its votes are kept after their first vote", value: (*durationValue)(&s.SessionMaxAge)},
+		{key: "server.shutdownDrainDelay", env: "SHUTDOWN_DRAIN_DELAY", flag: "shutdown-drain-delay", usage: "how long to fail readiness checks before shutting down", value: (*durationValue)(&s.ShutdownDrainDelay)},
+		{key: "server.shutdownTimeout", env: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "how long to wait for requests and votes to finish when shutting down", value: (*durationValue)(&s.ShutdownTimeout)},
+
+		{key: "database.store", env: "STORE", flag: "store", usage: `where SCPs are stored: "database" or "memory" (nothing is persisted)`, value: (*stringValue)(&d.Store)},
+		{key: "database.url", env: "DATABASE_URL", flag: "database-url", usage: "Postgres connection URL, SQLite is used if empty", value: (*stringValue)(&d.URL), redact: redactURL},
+		{key: "database.sqlitePath", env: "SQLITE_PATH", flag: "sqlite-path", usage: "SQLite database file, if no database URL is set", value: (*stringValue)(&d.SQLitePath)},
+		{key: "database.log", env: "DATABASE_LOG", flag: "database-log", usage: "log every SQL statement", value: (*boolValue)(&d.Log)},
+		{key: "database.maxOpenConns", env: "DB_MAX_OPEN_CONNS", flag: "db-max-open-conns", usage: "maximum open database connections, 0 for unlimited", value: (*intValue)(&d.MaxOpenConns)},
+		{key: "database.maxIdleConns", env: "DB_MAX_IDLE_CONNS", flag: "db-max-idle-conns", usage: "idle database connections kept in the pool", value: (*intValue)(&d.MaxIdleConns)},
+		{key: "database.connMaxLifetime", env: "DB_CONN_MAX_LIFETIME", flag: "db-conn-max-lifetime", usage: "database connections are closed after this long, 0 to reuse forever", value: (*durationValue)(&d.ConnMaxLifetime)},
+		{key: "database.connectAttempts", env: "DB_CONNECT_ATTEMPTS", flag: "db-connect-attempts", usage: "attempts to connect to the database on startup", value: (*intValue)(&d.ConnectAttempts)},
+
+		{key: "cache.updateTTL", env: "CACHE_UPDATE_TTL", flag: "cache-update-ttl", usage: "how long the cached SCPs are served before being synchronised with the store", value: (*durationValue)(&c.UpdateTTL)},
+		{key: "cache.rankingTTL", env: "CACHE_RANKING_TTL", flag: "cache-ranking-ttl", usage: "how long the rankings are served before being sorted again", value: (*durationValue)(&c.RankingTTL)},
+		{key: "cache.flushInterval", env: "FLUSH_INTERVAL", flag: "flush-interval", usage: "how often cached votes are written back to the store", value: (*durationValue)(&c.FlushInterval)},
+		{key: "cache.cataloguePollInterval", env: "CATALOGUE_POLL_INTERVAL", flag: "catalogue-poll-interval", usage: "how often SQLite is polled for catalogue changes by other instances", value: (*durationValue)(&c.CataloguePollInterval)},
+
+		{key: "votes.queueDir", env: "VOTE_QUEUE_DIR", flag: "vote-queue-dir", usage: "write-ahead log directory of the vote queue, empty to disable it", value: (*stringValue)(&v.QueueDir)},
+		{key: "votes.queueCapacity", env: "VOTE_QUEUE_CAPACITY", flag: "vote-queue-capacity", usage: "votes waiting to be processed before new votes are rejected", value: (*intValue)(&v.QueueCapacity)},
+		{key: "votes.queueWorkers", env: "VOTE_QUEUE_WORKERS", flag: "vote-queue-workers", usage: "goroutines processing votes", value: (*intValue)(&v.QueueWorkers)},
+		{key: "votes.eloK", env: "ELO_K", flag: "elo-k", usage: "Elo K-factor, the maximum rating change of a single vote", value: (*floatValue)(&v.EloK)},
+		{key: "votes.ballotKey", env: "BALLOT_KEY", flag: "ballot-key", usage: "key signing the matchups shown to voters, random (votes for matchups shown before a restart or by other instances are rejected) if empty", value: (*stringValue)(&v.BallotKey), redact: redactAll},
+		{key: "votes.ballotTTL", env: "BALLOT_TTL", flag: "ballot-ttl", usage: "how long voters have to vote for a matchup", value: (*durationValue)(&v.BallotTTL)},
+
+		{key: "metrics.allowedNetworks", env: "METRICS_ALLOWED_NETWORKS", flag: "metrics-allowed-networks", usage: "comma-separated CIDR networks allowed to scrape /metrics", value: (*stringValue)(&m.AllowedNetworks)},
+		{key: "metrics.token", env: "METRICS_TOKEN", flag: "metrics-token", usage: "bearer token allowed to scrape /metrics from any network", value: (*stringValue)(&m.Token), redact: redactAll},
+	}
+	for i := range cfg.settings {
+		cfg.settings[i].source = sourceDefault
+	}
+}
+
+// setting is a single configuration value, set from the config file by its key,
+// from the environment variable env or the command-line flag.
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	value  flag.Value                // bound to a Config field
+	redact func(value string) string // hides secrets when printing, nil if the value is not secret
+	source string                    // where the value came from
+}
+
+// Load returns the default configuration overridden by the config file (given by the --config flag
+// or CONFIG_FILE environment variable), then the environment, then the command-line flags in args.
+// Returns the arguments remaining after the flags, e.g. a subcommand, and flag.ErrHelp if help was requested.
+// Flag errors are also written to output. The configuration is not validated, see Validate.
+func Load(name string, args []string, output io.Writer) (*Config, []string, error) {
+	cfg := Default()
+
+	// Flags are parsed first to find the config file, but applied last.
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	file := fs.String("config", "", "JSON config file (env CONFIG_FILE)")
+	flags := make(map[string]*flagValue, len(cfg.settings))
+	for _, s := range cfg.settings {
+		_, isBool := s.value.(*boolValue)
+		flags[s.flag] = &flagValue{isBool: isBool}
+		fs.Var(flags[s.flag], s.flag, s.usage)
+	}
+	fs.Usage = func() {} // see PrintFlags
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *file == "" {
+		*file = os.Getenv("CONFIG_FILE")
+	}
+	if *file != "" {
+		if err := cfg.loadFile(*file); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range cfg.settings {
+		s := &cfg.settings[i]
+		if env, ok := os.LookupEnv(s.env); ok {
+			if err := s.value.Set(env); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %w", s.env, env, err)
+			}
+			s.source = sourceEnv
+		}
+	}
+	for i := range cfg.settings {
+		s := &cfg.settings[i]
+		if f := flags[s.flag]; f.set {
+			if err := s.value.Set(f.value); err != nil {
+				return nil, nil, fmt.Errorf("invalid --%s %q: %w", s.flag, f.value, err)
+			}
+			s.source = sourceFlag
+		}
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile sets the values in the JSON config file, an object of sections such as
+// {"server": {"port": 8080}}. Durations are strings, e.g. "10s".
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var sections map[string]map[string]interface{}
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&sections); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	values := make(map[string]interface{})
+	for section, fields := range sections {
+		for field, value := range fields {
+			values[section+"."+field] = value
+		}
+	}
+	for i := range cfg.settings {
+		s := &cfg.settings[i]
+		value, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		delete(values, s.key)
+		if err := s.value.Set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid %s %v in config file %s: %w", s.key, value, path, err)
+		}
+		s.source = sourceFile
+	}
+	if len(values) > 0 {
+		unknown := make([]string, 0, len(values))
+		for key := range values {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+	cfg.file = path
+	return nil
+}
+
+// Validate checks every setting, reporting all the invalid ones at once.
+func (cfg *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	s, d, c, v := cfg.Server, cfg.Database, cfg.Cache, cfg.Votes
+	check(s.Port > 0 && s.Port <= 65535, "server.port %d is not between 1 and 65535", s.Port)
+	switch s.LogLevel {
+	case "debug", "info", "warn", "error", "off":
+	default:
+		check(false, `server.logLevel %q is not "debug", "info", "warn", "error" or "off"`, s.LogLevel)
+	}
+	limit, err := bytes.Parse(s.BodyLimit)
+	check(err == nil && limit > 0, "server.bodyLimit %q is not a size such as 1M", s.BodyLimit)
+	check(s.GzipLevel >= -1 && s.GzipLevel <= 9, "server.gzipLevel %d is not between -1 and 9", s.GzipLevel)
+	check(strings.HasSuffix(s.ImageDir, "/"), "server.imageDir %q must end with a slash", s.ImageDir)
+	check(s.ShortCacheMaxAge >= 0, "server.shortCacheMaxAge must not be negative")
+	check(s.LongCacheMaxAge >= 0, "server.longCacheMaxAge must not be negative")
+	check(s.HSTSMaxAge >= 0, "server.hstsMaxAge must not be negative")
+	check(s.SessionMaxAge > 0, "server.sessionMaxAge must be positive")
+	check(s.ShutdownDrainDelay >= 0, "server.shutdownDrainDelay must not be negative")
+	check(s.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	check(d.Store == "database" || d.Store == "memory", `database.store %q is not "database" or "memory"`, d.Store)
+	check(d.URL != "" || d.SQLitePath != "", "database.sqlitePath must be set if database.url is empty")
+	check(d.MaxOpenConns >= 0, "database.maxOpenConns must not be negative")
+	check(d.MaxIdleConns >= 0, "database.maxIdleConns must not be negative")
+	check(d.ConnMaxLifetime >= 0, "database.connMaxLifetime must not be negative")
+	check(d.ConnectAttempts > 0, "database.connectAttempts must be positive")
+
+	check(c.UpdateTTL > 0, "cache.updateTTL must be positive")
+	check(c.RankingTTL > 0, "cache.rankingTTL must be positive")
+	check(c.FlushInterval > 0, "cache.flushInterval must be positive")
+	check(c.CataloguePollInterval > 0, "cache.cataloguePollInterval must be positive")
+
+	check(v.QueueCapacity > 0, "votes.queueCapacity must be positive")
+	check(v.QueueWorkers > 0, "votes.queueWorkers must be positive")
+	check(v.EloK > 0, "votes.eloK must be positive")
+	check(v.BallotTTL > 0, "votes.ballotTTL must be positive")
+
+	for _, cidr := range strings.Split(cfg.Metrics.AllowedNetworks, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			_, _, err := net.ParseCIDR(cidr)
+			check(err == nil, "metrics.allowedNetworks %q is not a CIDR network", cidr)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// DatabaseURL returns the database type and connection URL: Postgres if a URL is set, otherwise SQLite.
+func (d DatabaseConfig) DatabaseURL() (dbType string, dbURL string) {
+	if d.URL == "" {
+		return "sqlite3", d.SQLitePath
+	}
+	return "postgres", d.URL
+}
+
+// Print writes every setting with where its value came from, redacting secrets.
+func (cfg *Config) Print(w io.Writer) error {
+	if cfg.file != "" {
+		if _, err := fmt.Fprintf(w, "# config file %s\n", cfg.file); err != nil {
+			return err
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, s := range cfg.settings {
+		value := s.value.String()
+		if s.redact != nil && value != "" {
+			value = s.redact(value)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t# %s\n", s.key, value, s.source)
+	}
+	return tw.Flush()
+}
+
+// PrintFlags writes the flag of every setting, with its environment variable and default.
+func PrintFlags(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  --config\tJSON config file (env CONFIG_FILE)\n")
+	for _, s := range Default().settings {
+		fmt.Fprintf(tw, "  --%s\t%s (env %s, default %q)\n", s.flag, s.usage, s.env, s.value.String())
+	}
+	tw.Flush()
+}
+
+func redactAll(string) string {
+	return redacted
+}
+
+// redactURL hides the password in a connection URL, or the whole value if it cannot be parsed.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// flagValue records a flag until the file and environment have been applied.
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string   { return f.value }
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
@@ -2,26 +2,124 @@ package db
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/cycraig/scpbattle/model"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres" // postgres driver static import
 	_ "github.com/jinzhu/gorm/dialects/sqlite"   // sqlite driver static import
 )
 
-// NewDB instantiates a new GORM database.
+// Options configures the database connection pool and how connecting is retried.
+type Options struct {
+	Log             bool          // log every SQL statement
+	MaxOpenConns    int           // 0 for unlimited
+	MaxIdleConns    int           // idle connections kept in the pool
+	ConnMaxLifetime time.Duration // connections are closed after this long, 0 to reuse forever
+	ConnectAttempts int           // attempts to connect on startup before giving up
+	InitialBackoff  time.Duration // delay before the second attempt, doubling on every subsequent attempt
+	MaxBackoff      time.Duration // cap on the delay between attempts
+	BusyTimeout     time.Duration // SQLite only, how long to wait for a locked database before failing
+}
+
+// DefaultOptions returns the default Options, retrying for about a minute on startup.
+func DefaultOptions() Options {
+	return Options{
+		MaxOpenConns:    10,
+		MaxIdleConns:    3,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnectAttempts: 10,
+		InitialBackoff:  500 * time.Millisecond,
+		MaxBackoff:      10 * time.Second,
+		BusyTimeout:     5 * time.Second,
+	}
+}
+
+// NewDB instantiates a new GORM database with the default options, applying any pending migrations.
+// Panics if the database schema is newer than this build understands, see CheckSchema.
 func NewDB(dbType string, dbURL string, doLog bool) *gorm.DB {
+	opts := DefaultOptions()
+	opts.Log = doLog
+	return NewDBWithOptions(dbType, dbURL, opts)
+}
+
+// NewDBWithOptions instantiates a new GORM database with the specified options, applying any pending migrations.
+// Panics if connecting fails after all attempts or the database schema is newer than this build understands.
+func NewDBWithOptions(dbType string, dbURL string, opts Options) *gorm.DB {
+	db, err := Connect(dbType, dbURL, opts)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := MigrateUp(db); err != nil {
+		db.Close()
+		panic(err)
+	}
+	return db
+}
+
+// Open connects to the database with the default options without migrating it, e.g. for the migrate command.
+func Open(dbType string, dbURL string, doLog bool) (*gorm.DB, error) {
+	opts := DefaultOptions()
+	opts.Log = doLog
+	return Connect(dbType, dbURL, opts)
+}
+
+// Connect connects to the database without migrating it, retrying with exponential backoff.
+// SQLite databases use write-ahead logging, a busy timeout and enforce foreign keys.
+func Connect(dbType string, dbURL string, opts Options) (*gorm.DB, error) {
 	if dbType != "sqlite3" && dbType != "postgres" {
-		panic(errors.New("unkown/unsupported database type: " + dbType))
+		return nil, errors.New("unkown/unsupported database type: " + dbType)
 	} else if dbURL == "" {
-		panic(errors.New("empty database connection string"))
+		return nil, errors.New("empty database connection string")
+	}
+	if dbType == "sqlite3" {
+		dbURL = sqliteDSN(dbURL, opts.BusyTimeout)
+	}
+	var db *gorm.DB
+	var err error
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		// Opening pings the database, so this fails while it is unreachable.
+		db, err = gorm.Open(dbType, dbURL)
+		if err == nil || attempt >= opts.ConnectAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
 	}
-	db, err := gorm.Open(dbType, dbURL)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	db.AutoMigrate(&model.SCP{})
-	db.DB().SetMaxIdleConns(3)
-	db.LogMode(doLog)
-	return db
+	db.DB().SetMaxOpenConns(opts.MaxOpenConns)
+	db.DB().SetMaxIdleConns(opts.MaxIdleConns)
+	db.DB().SetConnMaxLifetime(opts.ConnMaxLifetime)
+	db.LogMode(opts.Log)
+	return db, nil
+}
+
+// sqliteDSN adds the pragmas to the SQLite connection string, unless it already sets them.
+// They are set through the connection string so that every connection in the pool uses them.
+func sqliteDSN(dbURL string, busyTimeout time.Duration) string {
+	params := []string{
+		"_journal_mode=WAL",
+		"_busy_timeout=" + strconv.FormatInt(busyTimeout.Milliseconds(), 10),
+		"_foreign_keys=1",
+	}
+	separator := "?"
+	if strings.Contains(dbURL, "?") {
+		separator = "&"
+	}
+	for _, param := range params {
+		key := param[:strings.Index(param, "=")+1]
+		if strings.Contains(dbURL, key) {
+			continue
+		}
+		dbURL += separator + param
+		separator = "&"
+	}
+	return dbURL
 }
@@ -0,0 +1,52 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cycraig/scpbattle/db"
+)
+
+func TestConnect(t *testing.T) {
+	fdb := "TestConnect.db"
+	os.Remove(fdb)
+	defer os.Remove(fdb)
+	opts := db.DefaultOptions()
+	opts.MaxOpenConns = 2
+	d, err := db.Connect("sqlite3", fdb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Every pooled connection uses the pragmas.
+	for pragma, expected := range map[string]string{
+		"journal_mode": "wal",
+		"busy_timeout": "5000",
+		"foreign_keys": "1",
+	} {
+		var value string
+		if err := d.DB().QueryRow("PRAGMA " + pragma).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		if value != expected {
+			t.Errorf("Expected PRAGMA %s = %s, got %s", pragma, expected, value)
+		}
+	}
+	if stats := d.DB().Stats(); stats.MaxOpenConnections != 2 {
+		t.Errorf("Expected at most 2 open connections, got %d", stats.MaxOpenConnections)
+	}
+
+	// Connecting is retried with capped exponential backoff before giving up.
+	opts.ConnectAttempts = 4
+	opts.InitialBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 15 * time.Millisecond
+	start := time.Now()
+	if _, err := db.Connect("sqlite3", "does/not/exist.db", opts); err == nil {
+		t.Fatal("Expected connecting to a missing directory to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected backoff of 10+15+15ms between attempts, took %s", elapsed)
+	}
+}
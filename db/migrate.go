@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrUnknownSchemaVersion is returned when the database has migrations applied that this build does not
+// know about, e.g. after rolling back to an older release. Run the newer release's "migrate down" first.
+var ErrUnknownSchemaVersion = errors.New("unknown schema version")
+
+// Migration is a single, versioned change to the schema, with SQL for each supported dialect.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      map[string]string // by dialect, "sqlite3" or "postgres"
+	Down    map[string]string // by dialect, reverts Up
+}
+
+// MigrationStatus describes whether a known migration has been applied to the database.
+type MigrationStatus struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time // nil if not applied
+}
+
+// schemaMigration is a row of the schema_migrations table, recording an applied migration.
+type schemaMigration struct {
+	Version   uint `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var createMigrationsTable = map[string]string{
+	"sqlite3":  `CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer,"name" varchar(255) NOT NULL,"applied_at" datetime NOT NULL, PRIMARY KEY ("version"));`,
+	"postgres": `CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer,"name" varchar(255) NOT NULL,"applied_at" timestamp with time zone NOT NULL, PRIMARY KEY ("version"));`,
+}
+
+var createLockTable = map[string]string{
+	"sqlite3": `CREATE TABLE IF NOT EXISTS "schema_lock" ("id" integer,"locked_at" datetime NOT NULL, PRIMARY KEY ("id"));`,
+}
+
+const (
+	// migrationLockKey identifies the Postgres advisory lock held while migrating.
+	migrationLockKey = 0x5c9ba771e
+	// staleMigrationLock is how long until the SQLite lock of a process that died while migrating is taken over.
+	staleMigrationLock = time.Minute
+	// migrationLockPoll is how often a locked SQLite database is checked while waiting for the lock.
+	migrationLockPoll = 100 * time.Millisecond
+)
+
+// lockMigrations waits until no other process is migrating the database and prevents others from doing so
+// until unlock is called, so that instances starting at the same time do not apply the same migration twice.
+// Postgres uses a session advisory lock, released if the process dies. SQLite uses a row of the
+// schema_lock table, which is taken over once it is older than staleMigrationLock.
+func lockMigrations(db *gorm.DB) (unlock func() error, err error) {
+	switch dialect := db.Dialect().GetName(); dialect {
+	case "postgres":
+		// The lock belongs to the connection, so it is taken and released on the same one.
+		ctx := context.Background()
+		conn, err := db.DB().Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return func() error {
+			_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+			if closeErr := conn.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}, nil
+	case "sqlite3":
+		if err := db.Exec(createLockTable[dialect]).Error; err != nil {
+			return nil, err
+		}
+		for {
+			now := time.Now().UTC()
+			if err := db.Exec(`DELETE FROM schema_lock WHERE locked_at < ?`, now.Add(-staleMigrationLock)).Error; err != nil {
+				return nil, err
+			}
+			result := db.Exec(`INSERT INTO schema_lock (id, locked_at) VALUES (1, ?) ON CONFLICT DO NOTHING`, now)
+			if result.Error != nil {
+				return nil, result.Error
+			}
+			if result.RowsAffected == 1 {
+				break
+			}
+			time.Sleep(migrationLockPoll)
+		}
+		return func() error {
+			return db.Exec(`DELETE FROM schema_lock WHERE id = 1`).Error
+		}, nil
+	default:
+		return nil, errors.New("unkown/unsupported database type: " + dialect)
+	}
+}
+
+// LatestVersion returns the schema version after applying every known migration.
+func LatestVersion() uint {
+	return migrations[len(migrations)-1].Version
+}
+
+func appliedMigrations(db *gorm.DB) (map[uint]schemaMigration, error) {
+	dialect := db.Dialect().GetName()
+	sql, ok := createMigrationsTable[dialect]
+	if !ok {
+		return nil, errors.New("unkown/unsupported database type: " + dialect)
+	}
+	if err := db.Exec(sql).Error; err != nil {
+		return nil, err
+	}
+	var rows []schemaMigration
+	if err := db.Order("version asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[uint]schemaMigration)
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// SchemaVersion returns the version of the latest migration applied to the database, 0 if none.
+func SchemaVersion(db *gorm.DB) (uint, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	var version uint
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// CheckSchema returns ErrUnknownSchemaVersion if the database has migrations applied that are not known.
+func CheckSchema(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	return checkApplied(applied)
+}
+
+func checkApplied(applied map[uint]schemaMigration) error {
+	known := make(map[uint]bool)
+	for _, migration := range migrations {
+		known[migration.Version] = true
+	}
+	for version, row := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d (%s) applied, latest known is %d: %w", version, row.Name, LatestVersion(), ErrUnknownSchemaVersion)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies all pending migrations in order, each in its own transaction, and returns how many were applied.
+// It refuses to run against a database with unknown migrations applied, see CheckSchema.
+// Other processes migrating the same database wait until it is done, see lockMigrations.
+func MigrateUp(db *gorm.DB) (count int, err error) {
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkApplied(applied); err != nil {
+		return 0, err
+	}
+	dialect := db.Dialect().GetName()
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(migration.Up[dialect]).Error; err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("applying migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// MigrateDown reverts up to the given number of the latest applied migrations, newest first, and returns how many were reverted.
+func MigrateDown(db *gorm.DB, steps int) (count int, err error) {
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkApplied(applied); err != nil {
+		return 0, err
+	}
+	dialect := db.Dialect().GetName()
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(migration.Down[dialect]).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{Version: migration.Version}).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("reverting migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Status returns every known migration in order, with when it was applied to the database.
+// Fails with ErrUnknownSchemaVersion if the database has unknown migrations applied.
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+		}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			statuses[i].AppliedAt = &appliedAt
+		}
+	}
+	return statuses, checkApplied(applied)
+}
@@ -0,0 +1,121 @@
+package db_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/cycraig/scpbattle/db"
+	"github.com/cycraig/scpbattle/model"
+)
+
+func TestMigrations(t *testing.T) {
+	fdb := "TestMigrations.db"
+	os.Remove(fdb)
+	defer os.Remove(fdb)
+	d, err := db.Open("sqlite3", fdb, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// A database created by AutoMigrate, before versioned migrations, is adopted as it is.
+	d.AutoMigrate(&model.SCP{})
+	if err := d.Create(model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")).Error; err != nil {
+		t.Fatal(err)
+	}
+	applied, err := db.MigrateUp(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(mustStatus(t, d)) {
+		t.Errorf("Expected all migrations to be applied, got %d", applied)
+	}
+	if version, err := db.SchemaVersion(d); err != nil || version != db.LatestVersion() {
+		t.Errorf("Expected schema version %d, got %d (%v)", db.LatestVersion(), version, err)
+	}
+	var count int
+	if err := d.Model(&model.SCP{}).Count(&count).Error; err != nil || count != 1 {
+		t.Errorf("Expected the existing SCP to be kept, got %d (%v)", count, err)
+	}
+	if applied, err := db.MigrateUp(d); err != nil || applied != 0 {
+		t.Errorf("Expected no pending migrations, got %d (%v)", applied, err)
+	}
+
+	// Reverting drops the latest tables.
+	if reverted, err := db.MigrateDown(d, 1); err != nil || reverted != 1 {
+		t.Fatalf("Expected 1 reverted migration, got %d (%v)", reverted, err)
+	}
+	if d.HasTable(&model.AppliedVote{}) || !d.HasTable(&model.VoteLog{}) {
+		t.Error("Expected only the applied_votes table to be dropped")
+	}
+	statuses := mustStatus(t, d)
+	if statuses[len(statuses)-1].AppliedAt != nil || statuses[0].AppliedAt == nil {
+		t.Errorf("Unexpected status after reverting %+v", statuses)
+	}
+	if _, err := db.MigrateUp(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// A schema from a newer release is refused.
+	if err := d.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, CURRENT_TIMESTAMP)`, db.LatestVersion()+1, "from_the_future").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckSchema(d); !errors.Is(err, db.ErrUnknownSchemaVersion) {
+		t.Errorf("Expected %v, got %v", db.ErrUnknownSchemaVersion, err)
+	}
+	if _, err := db.MigrateUp(d); !errors.Is(err, db.ErrUnknownSchemaVersion) {
+		t.Errorf("Expected %v, got %v", db.ErrUnknownSchemaVersion, err)
+	}
+	if _, err := db.Status(d); !errors.Is(err, db.ErrUnknownSchemaVersion) {
+		t.Errorf("Expected %v, got %v", db.ErrUnknownSchemaVersion, err)
+	}
+}
+
+func mustStatus(t *testing.T, d *gorm.DB) []db.MigrationStatus {
+	t.Helper()
+	statuses, err := db.Status(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestMigrationsConcurrently(t *testing.T) {
+	fdb := "TestMigrationsConcurrently.db"
+	os.Remove(fdb)
+	defer os.Remove(fdb)
+
+	// Instances starting at the same time apply each migration once, the others wait for them.
+	const instances = 4
+	applied := make(chan int, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		d, err := db.Open("sqlite3", fdb, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count, err := db.MigrateUp(d)
+			if err != nil {
+				t.Error(err)
+			}
+			applied <- count
+		}()
+	}
+	wg.Wait()
+	close(applied)
+	total := 0
+	for count := range applied {
+		total += count
+	}
+	if total != int(db.LatestVersion()) {
+		t.Errorf("Expected %d migrations to be applied once, got %d", db.LatestVersion(), total)
+	}
+}
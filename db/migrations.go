@@ -0,0 +1,100 @@
+package db
+
+// migrations is the ordered schema history, see Migrate. Never edit a released migration, add a new one.
+//
+// The first migrations use IF NOT EXISTS so that databases created by GORM's AutoMigrate, before
+// versioned migrations were introduced, are adopted as they are.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_scps",
+		Up: map[string]string{
+			"sqlite3": `
+CREATE TABLE IF NOT EXISTS "scps" ("id" integer primary key autoincrement,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"name" varchar(255) NOT NULL,"description" varchar(255),"image" varchar(255),"link" varchar(255),"rating" real,"wins" bigint,"losses" bigint);
+CREATE INDEX IF NOT EXISTS idx_scps_deleted_at ON "scps"(deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_scps_name ON "scps"("name");`,
+			"postgres": `
+CREATE TABLE IF NOT EXISTS "scps" ("id" serial,"created_at" timestamp with time zone,"updated_at" timestamp with time zone,"deleted_at" timestamp with time zone,"name" varchar(255) NOT NULL,"description" varchar(255),"image" varchar(255),"link" varchar(255),"rating" numeric,"wins" bigint,"losses" bigint, PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS idx_scps_deleted_at ON "scps"(deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_scps_name ON "scps"("name");`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "scps";`,
+			"postgres": `DROP TABLE "scps";`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create_matchups",
+		Up: map[string]string{
+			"sqlite3":  `CREATE TABLE IF NOT EXISTS "matchups" ("first_id" integer,"second_id" integer,"first_wins" bigint,"second_wins" bigint, PRIMARY KEY ("first_id","second_id"));`,
+			"postgres": `CREATE TABLE IF NOT EXISTS "matchups" ("first_id" integer,"second_id" integer,"first_wins" bigint,"second_wins" bigint, PRIMARY KEY ("first_id","second_id"));`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "matchups";`,
+			"postgres": `DROP TABLE "matchups";`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_catalogue_versions",
+		Up: map[string]string{
+			"sqlite3":  `CREATE TABLE IF NOT EXISTS "catalogue_versions" ("id" integer,"version" bigint, PRIMARY KEY ("id"));`,
+			"postgres": `CREATE TABLE IF NOT EXISTS "catalogue_versions" ("id" integer,"version" bigint, PRIMARY KEY ("id"));`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "catalogue_versions";`,
+			"postgres": `DROP TABLE "catalogue_versions";`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_admins",
+		Up: map[string]string{
+			"sqlite3": `
+CREATE TABLE "admins" ("id" integer primary key autoincrement,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"username" varchar(255) NOT NULL,"password_hash" varchar(255) NOT NULL);
+CREATE INDEX idx_admins_deleted_at ON "admins"(deleted_at);
+CREATE UNIQUE INDEX uix_admins_username ON "admins"("username");`,
+			"postgres": `
+CREATE TABLE "admins" ("id" serial,"created_at" timestamp with time zone,"updated_at" timestamp with time zone,"deleted_at" timestamp with time zone,"username" varchar(255) NOT NULL,"password_hash" varchar(255) NOT NULL, PRIMARY KEY ("id"));
+CREATE INDEX idx_admins_deleted_at ON "admins"(deleted_at);
+CREATE UNIQUE INDEX uix_admins_username ON "admins"("username");`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "admins";`,
+			"postgres": `DROP TABLE "admins";`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_sessions_and_vote_logs",
+		Up: map[string]string{
+			"sqlite3": `
+CREATE TABLE "sessions" ("id" varchar(64),"created_at" datetime NOT NULL,"revoked_at" datetime, PRIMARY KEY ("id"));
+CREATE TABLE "vote_logs" ("id" integer primary key autoincrement,"session_id" varchar(64) NOT NULL,"winner_id" integer NOT NULL,"loser_id" integer NOT NULL,"created_at" datetime NOT NULL,"wal" varchar(64),"seq" bigint NOT NULL);
+CREATE INDEX idx_vote_logs_session_id ON "vote_logs"("session_id");
+CREATE UNIQUE INDEX uix_vote_logs_wal_seq ON "vote_logs"("wal","seq");`,
+			"postgres": `
+CREATE TABLE "sessions" ("id" varchar(64),"created_at" timestamp with time zone NOT NULL,"revoked_at" timestamp with time zone, PRIMARY KEY ("id"));
+CREATE TABLE "vote_logs" ("id" serial,"session_id" varchar(64) NOT NULL,"winner_id" integer NOT NULL,"loser_id" integer NOT NULL,"created_at" timestamp with time zone NOT NULL,"wal" varchar(64),"seq" bigint NOT NULL, PRIMARY KEY ("id"));
+CREATE INDEX idx_vote_logs_session_id ON "vote_logs"("session_id");
+CREATE UNIQUE INDEX uix_vote_logs_wal_seq ON "vote_logs"("wal","seq");`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "vote_logs"; DROP TABLE "sessions";`,
+			"postgres": `DROP TABLE "vote_logs"; DROP TABLE "sessions";`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create_applied_votes",
+		Up: map[string]string{
+			"sqlite3":  `CREATE TABLE "applied_votes" ("wal" varchar(64) NOT NULL,"seq" bigint NOT NULL, PRIMARY KEY ("wal","seq"));`,
+			"postgres": `CREATE TABLE "applied_votes" ("wal" varchar(64) NOT NULL,"seq" bigint NOT NULL, PRIMARY KEY ("wal","seq"));`,
+		},
+		Down: map[string]string{
+			"sqlite3":  `DROP TABLE "applied_votes";`,
+			"postgres": `DROP TABLE "applied_votes";`,
+		},
+	},
+}
@@ -1,13 +1,16 @@
 module github.com/cycraig/scpbattle
 
-go 1.13
+go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/jinzhu/gorm v1.9.16
 	github.com/jinzhu/now v1.1.2 // indirect
 	github.com/jpillora/ipfilter v1.2.1
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/labstack/echo/v4 v4.9.0
 	github.com/labstack/gommon v0.3.1
+	github.com/lib/pq v1.1.1
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
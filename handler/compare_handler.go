@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/cycraig/scpbattle/model"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Contender summarises a single SCP in a head-to-head comparison.
+type Contender struct {
+	ID     uint    `json:"id"`
+	Name   string  `json:"name"`
+	Desc   string  `json:"description"`
+	Image  string  `json:"image"`
+	Link   string  `json:"link"`
+	Rating float64 `json:"rating"`
+	Wins   uint64  `json:"wins"`
+	Losses uint64  `json:"losses"`
+}
+
+// CommonOpponent holds the records of both compared SCPs against an SCP they have each faced.
+type CommonOpponent struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	AWins   uint64 `json:"aWins"`
+	ALosses uint64 `json:"aLosses"`
+	BWins   uint64 `json:"bWins"`
+	BLosses uint64 `json:"bLosses"`
+}
+
+// HeadToHead is the direct-matchup record between two SCPs, A and B.
+// Win rates and probabilities are from the perspective of A.
+type HeadToHead struct {
+	A                   Contender        `json:"a"`
+	B                   Contender        `json:"b"`
+	AWins               uint64           `json:"aWins"`
+	BWins               uint64           `json:"bWins"`
+	Matches             uint64           `json:"matches"`
+	ObservedWinRate     *float64         `json:"observedWinRate"` // nil if they have never been matched
+	ExpectedProbability float64          `json:"expectedProbability"`
+	CommonOpponents     []CommonOpponent `json:"commonOpponents"`
+}
+
+// ComparePageHandler renders the compare.html template.
+// Without the "a" and "b" query parameters only the SCP selection form is shown,
+// otherwise the compared SCPs are selected in it.
+func (h *Handler) ComparePageHandler(c echo.Context) error {
+	rankedSCPs, err := h.scpCache.GetRankedSCPs()
+	if err != nil {
+		msg := "Error retrieving ranked SCPs"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	data := echo.Map{
+		"title": "Compare",
+		"scps":  rankedSCPs,
+		"a":     uint(0),
+		"b":     uint(0),
+	}
+	if c.QueryParam("a") != "" || c.QueryParam("b") != "" {
+		headToHead, err := h.headToHead(c)
+		if err != nil {
+			return err
+		}
+		data["h2h"] = headToHead
+		data["a"], data["b"] = headToHead.A.ID, headToHead.B.ID
+	}
+	return c.Render(http.StatusOK, "compare.html", data)
+}
+
+// CompareAPIHandler returns the head-to-head record between two SCPs as JSON.
+func (h *Handler) CompareAPIHandler(c echo.Context) error {
+	headToHead, err := h.headToHead(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, headToHead)
+}
+
+func (h *Handler) headToHead(c echo.Context) (*HeadToHead, error) {
+	idA, err := strconv.ParseUint(c.QueryParam("a"), 10, 0)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Please provide a valid ID for a.")
+	}
+	idB, err := strconv.ParseUint(c.QueryParam("b"), 10, 0)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Please provide a valid ID for b.")
+	}
+	if idA == idB {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Please provide two different SCPs.")
+	}
+	a, err := h.getContender(c, uint(idA))
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.getContender(c, uint(idB))
+	if err != nil {
+		return nil, err
+	}
+
+	matchup, err := h.scpCache.GetMatchup(a.ID, b.ID)
+	if err != nil {
+		msg := "Error retrieving matchup"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	aWins, bWins := matchup.RecordFor(a.ID)
+	headToHead := &HeadToHead{
+		A:                   *a,
+		B:                   *b,
+		AWins:               aWins,
+		BWins:               bWins,
+		Matches:             aWins + bWins,
+		ExpectedProbability: model.EloExpectedProbability(a.Rating, b.Rating),
+	}
+	if headToHead.Matches > 0 {
+		winRate := float64(aWins) / float64(headToHead.Matches)
+		headToHead.ObservedWinRate = &winRate
+	}
+
+	headToHead.CommonOpponents, err = h.commonOpponents(a.ID, b.ID)
+	if err != nil {
+		msg := "Error retrieving common opponents"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	return headToHead, nil
+}
+
+func (h *Handler) getContender(c echo.Context, id uint) (*Contender, error) {
+	scp, err := h.scpCache.GetSnapshotByID(id)
+	if err != nil {
+		msg := fmt.Sprintf("Error finding SCP id: %d", id)
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	if scp == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Could not find SCP id: %d", id))
+	}
+	return h.newContender(scp), nil
+}
+
+func (h *Handler) newContender(scp *model.SCP) *Contender {
+	return &Contender{
+		ID:     scp.ID,
+		Name:   scp.Name,
+		Desc:   scp.Description,
+		Image:  h.imageURL(scp.Image),
+		Link:   scp.Link,
+		Rating: scp.Rating,
+		Wins:   scp.Wins,
+		Losses: scp.Losses,
+	}
+}
+
+func (h *Handler) commonOpponents(idA uint, idB uint) ([]CommonOpponent, error) {
+	opponentsA, err := h.scpCache.GetOpponents(idA)
+	if err != nil {
+		return nil, err
+	}
+	opponentsB, err := h.scpCache.GetOpponents(idB)
+	if err != nil {
+		return nil, err
+	}
+	common := make([]CommonOpponent, 0)
+	for opponentID, matchupA := range opponentsA {
+		matchupB, ok := opponentsB[opponentID]
+		if !ok || opponentID == idB {
+			continue
+		}
+		opponent, err := h.scpCache.GetSnapshotByID(opponentID)
+		if err != nil {
+			return nil, err
+		}
+		if opponent == nil {
+			// Matchup against an SCP that no longer exists.
+			continue
+		}
+		aWins, aLosses := matchupA.RecordFor(idA)
+		bWins, bLosses := matchupB.RecordFor(idB)
+		common = append(common, CommonOpponent{
+			ID:      opponentID,
+			Name:    opponent.Name,
+			AWins:   aWins,
+			ALosses: aLosses,
+			BWins:   bWins,
+			BLosses: bLosses,
+		})
+	}
+	// Map iteration order is random, keep the output stable.
+	sort.Slice(common, func(i, j int) bool {
+		return common[i].ID < common[j].ID
+	})
+	return common, nil
+}
+
+// ExpectedPercent formats the Elo-predicted win probability of A for templates.
+func (h2h *HeadToHead) ExpectedPercent() string {
+	return fmt.Sprintf("%.1f%%", 100.0*h2h.ExpectedProbability)
+}
+
+// ObservedPercent formats the observed win rate of A for templates.
+func (h2h *HeadToHead) ObservedPercent() string {
+	if h2h.ObservedWinRate == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100.0*(*h2h.ObservedWinRate))
+}
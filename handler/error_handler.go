@@ -1,29 +1,153 @@
 package handler
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
-// HTTPErrorHandler renders the error.html template when an error occurs.
+// problemContentType is the media type of error responses to API clients (RFC 7807).
+const problemContentType = "application/problem+json"
+
+// internalErrorDetail replaces the message of internal errors outside of debug mode.
+const internalErrorDetail = "Something went wrong on our side. Please try again later, quoting the error ID if it keeps happening."
+
+// ErrBlockedIP is returned for requests from blocked IP addresses, which are refused without
+// rendering a page.
+var ErrBlockedIP = echo.NewHTTPError(http.StatusForbidden, "Blocked IP address")
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	ErrorID  string `json:"errorID"` // logged with the error, for finding it from a report
+}
+
+// HTTPErrorHandler responds to errors with their status code, as an application/problem+json
+// Problem to API clients (see wantsJSON) and by rendering the error.html template otherwise.
+// Every error is logged with the ID in the response, the messages of internal errors are only
+// shown in debug mode.
 func HTTPErrorHandler(err error, c echo.Context) {
 	code := http.StatusInternalServerError
+	detail := ""
 	if he, ok := err.(*echo.HTTPError); ok {
 		code = he.Code
+		detail = fmt.Sprint(he.Message)
+	}
+	if code >= http.StatusInternalServerError && !c.Echo().Debug {
+		// The messages of internal errors may reveal how the server works, e.g. SQL errors.
+		detail = internalErrorDetail
+	} else if detail == "" || c.Echo().Debug {
+		detail = err.Error()
+	}
+	if detail == http.StatusText(code) {
+		// e.g. echo.ErrNotFound
+		detail = ""
+	}
+	problem := Problem{
+		Type:     "about:blank", // the status code is the only type of problem
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   detail,
+		Instance: c.Request().URL.Path,
+		ErrorID:  newErrorID(),
 	}
 
-	c.Logger().Error(err)
+	// Every request is logged with its status by logging.Middleware, this adds the error ID.
+	j := log.JSON{"message": "Error response", "status": code, "error_id": problem.ErrorID, "error": err}
+	if code >= http.StatusInternalServerError {
+		c.Logger().Errorj(j)
+	} else {
+		c.Logger().Infoj(j)
+	}
 
-	if code == http.StatusForbidden {
+	if c.Response().Committed {
+		// Too late to respond with the error.
+		return
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else if wantsJSON(c.Request()) {
+		c.Response().Header().Set(echo.HeaderContentType, problemContentType)
+		c.Response().WriteHeader(code)
+		err = json.NewEncoder(c.Response()).Encode(problem)
+	} else if err == ErrBlockedIP {
 		// Don't bother rendering anything for blocked IP addresses,
 		// the css files etc. get blocked anyway.
-		c.HTML(code, fmt.Sprintf("%d", code))
+		err = c.String(code, strconv.Itoa(code)+" "+problem.Title)
 	} else {
-		c.Render(http.StatusOK, "error.html", echo.Map{
-			"title": "Error",
-			"error": fmt.Sprintf("%d", code),
+		err = c.Render(code, "error.html", echo.Map{
+			"title":   problem.Title,
+			"problem": problem,
 		})
 	}
+	if err != nil {
+		c.Logger().Errorj(log.JSON{"message": "Error responding with error", "error_id": problem.ErrorID, "error": err})
+		if !c.Response().Committed {
+			c.String(code, strconv.Itoa(code)+" "+problem.Title)
+		}
+	}
+}
+
+// wantsJSON returns whether an error response to the request should be JSON: for the API,
+// when application/json (or any +json type) is preferred over text/html, or when JSON was
+// posted without a preference, e.g. votes from vote.html.
+func wantsJSON(req *http.Request) bool {
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		return true
+	}
+	htmlQ, jsonQ := 0.0, 0.0
+	for _, mediaRange := range strings.Split(req.Header.Get(echo.HeaderAccept), ",") {
+		mediaType, q := parseMediaRange(mediaRange)
+		switch {
+		case mediaType == echo.MIMETextHTML || mediaType == "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case mediaType == echo.MIMEApplicationJSON || strings.HasSuffix(mediaType, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	if jsonQ == 0 && htmlQ == 0 {
+		return strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+	}
+	return jsonQ > htmlQ
+}
+
+// parseMediaRange returns the lower case media type and quality of an Accept header element.
+func parseMediaRange(mediaRange string) (string, float64) {
+	params := strings.Split(mediaRange, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+	q := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return mediaType, q
+}
+
+// newErrorID returns a random ID identifying an error response in the logs.
+func newErrorID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
 }
@@ -0,0 +1,144 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/cycraig/scpbattle/handler"
+	"github.com/cycraig/scpbattle/logging"
+)
+
+// problemRenderer renders every template as the problem passed to it.
+type problemRenderer struct{}
+
+func (problemRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	problem := data.(echo.Map)["problem"].(handler.Problem)
+	_, err := fmt.Fprintf(w, "%s: %d %s: %s (%s)", name, problem.Status, problem.Title, problem.Detail, problem.ErrorID)
+	return err
+}
+
+func newErrorEcho(logs *bytes.Buffer) *echo.Echo {
+	e := echo.New()
+	e.Renderer = problemRenderer{}
+	e.HTTPErrorHandler = handler.HTTPErrorHandler
+	e.Pre(logging.Middleware(logging.New("test", log.INFO, logs), logging.NewIPHasher("key")))
+	e.GET("/missing", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, "Could not find SCP id: 5")
+	})
+	e.GET("/broken", func(c echo.Context) error {
+		return errors.New("pq: relation \"scps\" does not exist")
+	})
+	e.GET("/api/broken", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error retrieving ranked SCPs")
+	})
+	e.GET("/forbidden", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid or missing CSRF token")
+	})
+	e.GET("/blocked", func(c echo.Context) error {
+		return handler.ErrBlockedIP
+	})
+	return e
+}
+
+func TestHTTPErrorHandler(t *testing.T) {
+	tests := []struct {
+		path        string
+		accept      string
+		debug       bool
+		status      int
+		contentType string
+		detail      string
+	}{
+		{"/missing", "text/html,application/xhtml+xml,*/*;q=0.8", false, 404, echo.MIMETextHTMLCharsetUTF8, "Could not find SCP id: 5"},
+		{"/missing", "application/json", false, 404, "application/problem+json", "Could not find SCP id: 5"},
+		{"/missing", "text/html;q=0.5, application/json", false, 404, "application/problem+json", "Could not find SCP id: 5"},
+		{"/missing", "application/json;q=0.5, text/html", false, 404, echo.MIMETextHTMLCharsetUTF8, "Could not find SCP id: 5"},
+		{"/nothing", "", false, 404, echo.MIMETextHTMLCharsetUTF8, ""},
+		{"/forbidden", "", false, 403, echo.MIMETextHTMLCharsetUTF8, "invalid or missing CSRF token"},
+		{"/forbidden", "application/json", false, 403, "application/problem+json", "invalid or missing CSRF token"},
+		{"/broken", "", false, 500, echo.MIMETextHTMLCharsetUTF8, "Something went wrong"},
+		{"/broken", "", true, 500, echo.MIMETextHTMLCharsetUTF8, "pq: relation"},
+		{"/api/broken", "", false, 500, "application/problem+json", "Something went wrong"},
+		{"/api/broken", "", true, 500, "application/problem+json", "Error retrieving ranked SCPs"},
+	}
+	for _, test := range tests {
+		var logs bytes.Buffer
+		e := newErrorEcho(&logs)
+		e.Debug = test.debug
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.accept != "" {
+			req.Header.Set(echo.HeaderAccept, test.accept)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		name := fmt.Sprintf("%s (Accept %q, debug %v)", test.path, test.accept, test.debug)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", name, test.status, rec.Code)
+		}
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != test.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", name, test.contentType, ct)
+		}
+		body := rec.Body.String()
+		var errorID string
+		if test.contentType == "application/problem+json" {
+			var problem handler.Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("%s: invalid problem %q: %v", name, body, err)
+			}
+			if problem.Status != test.status || problem.Title != http.StatusText(test.status) || problem.Instance != test.path || problem.Type != "about:blank" {
+				t.Errorf("%s: unexpected problem %+v", name, problem)
+			}
+			errorID = problem.ErrorID
+		} else {
+			if !strings.HasPrefix(body, fmt.Sprintf("error.html: %d %s", test.status, http.StatusText(test.status))) {
+				t.Errorf("%s: unexpected page %q", name, body)
+			}
+			errorID = body[strings.LastIndex(body, "(")+1 : len(body)-1]
+		}
+		if test.detail != "" && !strings.Contains(body, test.detail) {
+			t.Errorf("%s: expected detail %q in %q", name, test.detail, body)
+		}
+		if !test.debug && strings.Contains(body, "pq:") {
+			t.Errorf("%s: internal error leaked: %q", name, body)
+		}
+		if len(errorID) != 16 || !strings.Contains(logs.String(), `"error_id":"`+errorID+`"`) {
+			t.Errorf("%s: error ID %q not logged: %s", name, errorID, logs.String())
+		}
+	}
+}
+
+func TestHTTPErrorHandlerBlockedIP(t *testing.T) {
+	// Blocked IP addresses aren't shown a page, their requests for its css files etc. are blocked too.
+	e := newErrorEcho(&bytes.Buffer{})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blocked", nil))
+	if rec.Code != http.StatusForbidden || rec.Header().Get(echo.HeaderContentType) != echo.MIMETextPlainCharsetUTF8 || rec.Body.String() != "403 Forbidden" {
+		t.Errorf("Unexpected response %d %q: %s", rec.Code, rec.Header().Get(echo.HeaderContentType), rec.Body.String())
+	}
+}
+
+func TestHTTPErrorHandlerVote(t *testing.T) {
+	// Votes are posted as JSON by vote.html without preferring a response type.
+	e := newErrorEcho(&bytes.Buffer{})
+	e.POST("/vote", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many votes, please try again.")
+	})
+	req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(`{"winnerID":1,"loserID":2}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderContentType) != "application/problem+json" {
+		t.Errorf("Unexpected response %d %q: %s", rec.Code, rec.Header().Get(echo.HeaderContentType), rec.Body.String())
+	}
+}
@@ -1,24 +1,45 @@
 package handler
 
 import (
-	"sync"
-
+	"github.com/cycraig/scpbattle/ballot"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/cycraig/scpbattle/render"
+	"github.com/cycraig/scpbattle/session"
 	"github.com/cycraig/scpbattle/store"
 )
 
 // Handler is a simple encapsulating class so http handlers can access the SCP database on requests.
 type Handler struct {
 	scpCache *store.SCPCache
-	scpLock  map[uint]*sync.Mutex // lock per SCP to prevent lost votes
+	votes    *queue.VoteQueue
+	ballots  *ballot.Signer
+	sessions *session.Manager
 	imageDir string
+	assets   render.Assets // nil to refer to images by their path, see imageURL
+	eloK     float64 // Elo K-factor, see updateEloRatings
+	draining int32   // accessed atomically, 1 once shutting down, see SetDraining
 }
 
-// NewHandler instantiates a Handler with the given SCPCache.
-// The imageDir field must end with a trailing slash, e.g. "images/".
-func NewHandler(scpCache *store.SCPCache, imageDir string) *Handler {
+// NewHandler instantiates a Handler with the given SCPCache and VoteQueue, the Signer of the ballots
+// of the vote page and the Manager of the voters' sessions. The imageDir field must end with a trailing slash, e.g. "images/", and the
+// URLs of the images are resolved with assets, e.g. asset.Manifest, or refer to their path if nil. eloK is the maximum
+// rating change of a single vote. Start the queue with ProcessVote to apply the votes accepted by VoteHandler.
+func NewHandler(scpCache *store.SCPCache, votes *queue.VoteQueue, ballots *ballot.Signer, sessions *session.Manager, imageDir string, assets render.Assets, eloK float64) *Handler {
 	return &Handler{
 		scpCache: scpCache,
-		scpLock:  make(map[uint]*sync.Mutex),
+		votes:    votes,
+		ballots:  ballots,
+		sessions: sessions,
 		imageDir: imageDir,
+		assets:   assets,
+		eloK:     eloK,
+	}
+}
+
+// imageURL returns the absolute URL of an SCP's image, fingerprinted if the assets know it.
+func (h *Handler) imageURL(image string) string {
+	if h.assets == nil {
+		return "/" + h.imageDir + image
 	}
+	return h.assets.URL(h.imageDir + image)
 }
@@ -1,23 +1,214 @@
 package handler
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
-// HealthCheck is a simple JSON-encoded response to API health-checks.
+// Health check statuses, see https://tools.ietf.org/html/draft-inadarei-api-health-check-04#section-3.1
+const (
+	healthPass = "pass"
+	healthWarn = "warn"
+	healthFail = "fail"
+)
+
+// healthContentType is the media type of health check responses.
+const healthContentType = "application/health+json"
+
+// Templates are the templates rendered by the handlers, which must have been loaded.
+var Templates = []string{"vote.html", "rankings.html", "compare.html", "about.html", "me.html", "error.html"}
+
+// TemplateLister is implemented by renderers that can report which templates they have loaded.
+type TemplateLister interface {
+	Templates() []string
+}
+
+// HealthCheck is a JSON-encoded response to API health checks, in the format of
+// https://tools.ietf.org/html/draft-inadarei-api-health-check-04
 type HealthCheck struct {
-	Status string `json:"status"`
+	Status      string                      `json:"status"` // "pass", "warn" (healthy with concerns) or "fail"
+	Version     string                      `json:"version,omitempty"`
+	ServiceID   string                      `json:"serviceId"`
+	Description string                      `json:"description"`
+	Notes       []string                    `json:"notes,omitempty"`
+	Checks      map[string][]ComponentCheck `json:"checks,omitempty"`
+}
+
+// ComponentCheck is the result of checking a single component for a HealthCheck.
+type ComponentCheck struct {
+	ComponentType string      `json:"componentType"`
+	ObservedValue interface{} `json:"observedValue"`
+	ObservedUnit  string      `json:"observedUnit,omitempty"`
+	Status        string      `json:"status"`
+	Time          time.Time   `json:"time"`
+	Output        string      `json:"output,omitempty"` // why the check did not pass
+}
+
+// SetDraining marks the instance as shutting down, so ReadinessHandler tells load balancers to
+// stop routing requests to it while in-flight requests finish.
+func (h *Handler) SetDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// LivenessHandler responds as long as the server can handle requests at all, e.g. for restarting hung instances.
+func (h *Handler) LivenessHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
 }
 
-// HealthCheckHandler processes health-check GET requests.
+// ReadinessHandler responds with 503 Service Unavailable while the instance should not receive traffic:
+// while shutting down, or if the SCPs cannot be served. A degraded database does not make it unready,
+// since votes are still accepted and served from the cache.
+func (h *Handler) ReadinessHandler(c echo.Context) error {
+	if atomic.LoadInt32(&h.draining) == 1 {
+		return c.String(http.StatusServiceUnavailable, "shutting down")
+	}
+	if _, err := h.scpCache.GetRandomSCPs(2); err != nil {
+		return c.String(http.StatusServiceUnavailable, "SCPs unavailable")
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+// HealthCheckHandler processes health-check GET requests, checking the database, cache, vote queue
+// and templates. Responds with 503 Service Unavailable if any check fails.
 func (h *Handler) HealthCheckHandler(c echo.Context) error {
-	// Heath check RFC:
-	// https://tools.ietf.org/html/draft-inadarei-api-health-check-04#section-3
+	now := time.Now()
+	resp := &HealthCheck{
+		Version:     "1",
+		ServiceID:   "scpbattle",
+		Description: "Health of the SCP Battle server",
+		Checks:      make(map[string][]ComponentCheck),
+	}
+	resp.Checks["database:responseTime"] = []ComponentCheck{h.checkDatabase(now)}
+	resp.Checks["cache:lastFlush"], resp.Checks["cache:dirty"] = h.checkCache(now)
+	resp.Checks["votes:queueDepth"] = []ComponentCheck{h.checkVotes(now)}
+	resp.Checks["templates:loaded"] = []ComponentCheck{checkTemplates(c, now)}
+	if atomic.LoadInt32(&h.draining) == 1 {
+		resp.Notes = append(resp.Notes, "shutting down")
+	}
+
+	resp.Status = healthPass
+	for _, checks := range resp.Checks {
+		for _, check := range checks {
+			resp.Status = worseStatus(resp.Status, check.Status)
+		}
+	}
+	status := http.StatusOK
+	if resp.Status == healthFail {
+		status = http.StatusServiceUnavailable
+	}
+	c.Response().Header().Set(echo.HeaderContentType, healthContentType)
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	c.Response().WriteHeader(status)
+	return json.NewEncoder(c.Response()).Encode(resp)
+}
+
+func worseStatus(a string, b string) string {
+	severity := map[string]int{healthPass: 0, healthWarn: 1, healthFail: 2}
+	if severity[b] > severity[a] {
+		return b
+	}
+	return a
+}
+
+func (h *Handler) checkDatabase(now time.Time) ComponentCheck {
+	start := time.Now()
+	err := h.scpCache.Ping()
+	latency := time.Since(start)
+	check := ComponentCheck{
+		ComponentType: "datastore",
+		ObservedValue: float64(latency.Microseconds()) / 1000.0,
+		ObservedUnit:  "ms",
+		Status:        healthPass,
+		Time:          now,
+	}
+	if err != nil {
+		// Votes are still served from the cache, see store.SCPCache.Degraded.
+		check.Status = healthWarn
+		check.Output = err.Error()
+	} else if latency > time.Second {
+		check.Status = healthWarn
+		check.Output = "slow response"
+	}
+	return check
+}
+
+func (h *Handler) checkCache(now time.Time) (lastFlush []ComponentCheck, dirty []ComponentCheck) {
+	stats := h.scpCache.Stats()
+	flush := ComponentCheck{
+		ComponentType: "component",
+		ObservedUnit:  "s",
+		Status:        healthPass,
+		Time:          now,
+	}
+	if !stats.LastFlush.IsZero() {
+		flush.ObservedValue = now.Sub(stats.LastFlush).Seconds()
+	}
+	if stats.Degraded {
+		flush.Status = healthWarn
+		flush.Output = fmt.Sprintf("degraded since %s: %s", stats.DegradedSince.Format(time.RFC3339), stats.LastError)
+	} else if stats.FlushInterval > 0 && (stats.LastFlush.IsZero() || now.Sub(stats.LastFlush) > 3*stats.FlushInterval) {
+		flush.Status = healthWarn
+		flush.Output = fmt.Sprintf("not flushed within 3 intervals of %s", stats.FlushInterval)
+	}
+	dirtyCheck := ComponentCheck{
+		ComponentType: "component",
+		ObservedValue: stats.DirtySCPs + stats.DirtyMatchups,
+		ObservedUnit:  "entries",
+		Status:        healthPass,
+		Time:          now,
+	}
+	return []ComponentCheck{flush}, []ComponentCheck{dirtyCheck}
+}
+
+func (h *Handler) checkVotes(now time.Time) ComponentCheck {
+	stats := h.votes.Stats()
+	check := ComponentCheck{
+		ComponentType: "component",
+		ObservedValue: stats.Depth,
+		ObservedUnit:  "votes",
+		Status:        healthPass,
+		Time:          now,
+	}
+	if stats.Depth*5 >= stats.Capacity*4 {
+		// New votes are rejected once the queue is full.
+		check.Status = healthWarn
+		check.Output = fmt.Sprintf("queue over 80%% of its capacity of %d", stats.Capacity)
+	}
+	return check
+}
 
-	// TODO: db.Ping() the database to check if the connection is still healthy
-	resp := new(HealthCheck)
-	resp.Status = "ok"
-	return c.JSON(http.StatusOK, resp)
+func checkTemplates(c echo.Context, now time.Time) ComponentCheck {
+	check := ComponentCheck{
+		ComponentType: "component",
+		Status:        healthPass,
+		Time:          now,
+	}
+	lister, ok := c.Echo().Renderer.(TemplateLister)
+	if !ok {
+		check.Status = healthFail
+		check.Output = "no template renderer"
+		return check
+	}
+	loaded := make(map[string]bool)
+	for _, name := range lister.Templates() {
+		loaded[name] = true
+	}
+	check.ObservedValue = len(loaded)
+	var missing []string
+	for _, name := range Templates {
+		if !loaded[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		check.Status = healthFail
+		check.Output = "missing templates: " + strings.Join(missing, ", ")
+	}
+	return check
 }
@@ -0,0 +1,166 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/ballot"
+	"github.com/cycraig/scpbattle/handler"
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/cycraig/scpbattle/session"
+	"github.com/cycraig/scpbattle/store"
+)
+
+// templateLister renders nothing but reports the templates as loaded.
+type templateLister []string
+
+func (templateLister) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	return nil
+}
+
+func (l templateLister) Templates() []string {
+	return l
+}
+
+// unreachableStore simulates a database that is down.
+type unreachableStore struct {
+	*store.MemorySCPStore
+	down bool
+}
+
+func (s *unreachableStore) Ping() error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// newSCPStore returns a MemorySCPStore with SCP-049 and SCP-173.
+func newSCPStore(t *testing.T) *store.MemorySCPStore {
+	scpStore := store.NewMemorySCPStore()
+	for _, name := range []string{"SCP-049", "SCP-173"} {
+		if err := scpStore.Create(model.NewSCP(name, "", "", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scpStore
+}
+
+// newHealthHandler returns the health check routes of a Handler, and its queue with room for 5 votes, not started.
+func newHealthHandler(t *testing.T, repo store.SCPRepository, templates []string) (*echo.Echo, *handler.Handler, *queue.VoteQueue) {
+	scpCache := store.NewSCPCache(repo)
+	opts := queue.DefaultOptions()
+	opts.Dir = ""
+	opts.Capacity = 5
+	votes, err := queue.NewVoteQueue(opts, echo.New().Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := session.NewManager(store.NewMemorySessionStore(), session.Config{Key: "key", MaxAge: time.Hour})
+	h := handler.NewHandler(scpCache, votes, ballot.NewSigner("key", time.Hour), sessions, "images/", nil, 20)
+
+	e := echo.New()
+	e.Renderer = templateLister(templates)
+	e.GET("/healthz", h.HealthCheckHandler)
+	e.GET("/livez", h.LivenessHandler)
+	e.GET("/readyz", h.ReadinessHandler)
+	return e, h, votes
+}
+
+func getHealth(t *testing.T, e *echo.Echo) (int, *handler.HealthCheck) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "application/health+json" {
+		t.Errorf("Expected application/health+json, got %q", ct)
+	}
+	if cc := rec.Header().Get(echo.HeaderCacheControl); cc != "no-store" {
+		t.Errorf("Expected no-store, got %q", cc)
+	}
+	health := new(handler.HealthCheck)
+	if err := json.Unmarshal(rec.Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, health
+}
+
+func TestHealthCheckHandler(t *testing.T) {
+	repo := &unreachableStore{MemorySCPStore: newSCPStore(t)}
+	e, _, votes := newHealthHandler(t, repo, handler.Templates)
+
+	// Every check passes.
+	code, health := getHealth(t, e)
+	if code != http.StatusOK || health.Status != "pass" {
+		t.Errorf("Expected 200 pass, got %d %+v", code, health)
+	}
+	for _, name := range []string{"database:responseTime", "cache:lastFlush", "cache:dirty", "votes:queueDepth", "templates:loaded"} {
+		if checks := health.Checks[name]; len(checks) != 1 || checks[0].Status != "pass" {
+			t.Errorf("Expected check %s to pass, got %+v", name, checks)
+		}
+	}
+
+	// A database that is down or a nearly full queue are concerns, but votes are still served.
+	repo.down = true
+	code, health = getHealth(t, e)
+	if check := health.Checks["database:responseTime"][0]; code != http.StatusOK || health.Status != "warn" || check.Status != "warn" || check.Output != "connection refused" {
+		t.Errorf("Expected 200 warn for the database, got %d %+v", code, health)
+	}
+	repo.down = false
+	for i := 0; i < 4; i++ {
+		if _, err := votes.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, health = getHealth(t, e)
+	if check := health.Checks["votes:queueDepth"][0]; code != http.StatusOK || health.Status != "warn" || check.Status != "warn" {
+		t.Errorf("Expected 200 warn for the queue, got %d %+v", code, health)
+	}
+
+	// Missing templates fail the check, which outweighs any warning.
+	e, _, _ = newHealthHandler(t, newSCPStore(t), []string{"vote.html"})
+	code, health = getHealth(t, e)
+	check := health.Checks["templates:loaded"][0]
+	if code != http.StatusServiceUnavailable || health.Status != "fail" || check.Status != "fail" || !strings.HasPrefix(check.Output, "missing templates: rankings.html") {
+		t.Errorf("Expected 503 fail for the templates, got %d %+v", code, health)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	e, h, _ := newHealthHandler(t, newSCPStore(t), handler.Templates)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	if rec := get("/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected ready, got %d %s", rec.Code, rec.Body)
+	}
+
+	// While draining the instance is alive but not ready, and health checks note it.
+	h.SetDraining()
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "shutting down" {
+		t.Errorf("Expected 503 shutting down, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/livez"); rec.Code != http.StatusOK {
+		t.Errorf("Expected alive, got %d %s", rec.Code, rec.Body)
+	}
+	code, health := getHealth(t, e)
+	if code != http.StatusOK || len(health.Notes) != 1 || health.Notes[0] != "shutting down" {
+		t.Errorf("Expected a note while draining, got %d %+v", code, health)
+	}
+
+	// Without SCPs to vote on there is nothing to serve.
+	e, _, _ = newHealthHandler(t, store.NewMemorySCPStore(), handler.Templates)
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without SCPs, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/cycraig/scpbattle/session"
+)
+
+// Shown on the /me page.
+const (
+	maxFavourites = 5
+	maxUpsets     = 10
+)
+
+// Favourite is an SCP picked by a voter, with how often they picked it.
+type Favourite struct {
+	SCP   *Contender
+	Picks int
+}
+
+// Upset is a vote for an SCP currently rated lower than the one it was picked over.
+type Upset struct {
+	Winner *Contender
+	Loser  *Contender
+	Cast   time.Time
+}
+
+// MePageHandler renders the me.html template, the voting history of the voter's session:
+// how many votes they cast, their favourite SCPs and the picks that went against the crowd,
+// compared with the current ratings.
+func (h *Handler) MePageHandler(c echo.Context) error {
+	data := echo.Map{
+		"title": "My votes",
+		"done":  c.QueryParam("done"), // set by the redirects of the forms, see MeRevokeHandler and MeDeleteHandler
+	}
+	s := session.Current(c)
+	if s == nil {
+		return c.Render(http.StatusOK, "me.html", data)
+	}
+	votes, err := h.sessions.History(s.ID)
+	if err != nil {
+		msg := "Error retrieving your votes"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+
+	// SCPs that have since been removed are left out.
+	contenders := make(map[uint]*Contender)
+	contender := func(id uint) *Contender {
+		if cached, ok := contenders[id]; ok {
+			return cached
+		}
+		scp, err := h.scpCache.GetSnapshotByID(id)
+		if err != nil || scp == nil {
+			contenders[id] = nil
+			return nil
+		}
+		contenders[id] = h.newContender(scp)
+		return contenders[id]
+	}
+	picks := make(map[uint]int)
+	var upsets []Upset
+	for _, vote := range votes {
+		winner, loser := contender(vote.WinnerID), contender(vote.LoserID)
+		if winner == nil || loser == nil {
+			continue
+		}
+		picks[vote.WinnerID]++
+		if winner.Rating < loser.Rating {
+			upsets = append(upsets, Upset{Winner: winner, Loser: loser, Cast: vote.CreatedAt})
+		}
+	}
+	favourites := make([]Favourite, 0, len(picks))
+	for id, count := range picks {
+		favourites = append(favourites, Favourite{SCP: contenders[id], Picks: count})
+	}
+	sort.Slice(favourites, func(i, j int) bool {
+		if favourites[i].Picks != favourites[j].Picks {
+			return favourites[i].Picks > favourites[j].Picks
+		}
+		return favourites[i].SCP.Rating > favourites[j].SCP.Rating
+	})
+	if len(favourites) > maxFavourites {
+		favourites = favourites[:maxFavourites]
+	}
+	// Most recent first.
+	recent := make([]Upset, 0, maxUpsets)
+	for i := len(upsets) - 1; i >= 0 && len(recent) < maxUpsets; i-- {
+		recent = append(recent, upsets[i])
+	}
+
+	data["session"] = s
+	data["votes"] = len(votes)
+	data["favourites"] = favourites
+	data["upsets"] = recent
+	data["upsetCount"] = len(upsets)
+	return c.Render(http.StatusOK, "me.html", data)
+}
+
+// MeRevokeHandler ends the voter's session, deleting the votes logged for it, and redirects to the /me page.
+// Ratings are totals and keep the votes.
+func (h *Handler) MeRevokeHandler(c echo.Context) error {
+	if err := h.sessions.Revoke(c); err != nil {
+		msg := "Error ending your session"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	return c.Redirect(http.StatusSeeOther, "/me?done=revoked")
+}
+
+// MeDeleteHandler deletes the voter's session and the votes logged for it, and redirects to the /me page.
+// Ratings are totals and keep the votes.
+func (h *Handler) MeDeleteHandler(c echo.Context) error {
+	if err := h.sessions.Delete(c); err != nil {
+		msg := "Error deleting your data"
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	return c.Redirect(http.StatusSeeOther, "/me?done=deleted")
+}
@@ -0,0 +1,140 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/handler"
+)
+
+// historyRenderer renders the voting history passed to me.html.
+type historyRenderer struct{}
+
+func (historyRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	m := data.(echo.Map)
+	if m["session"] == nil {
+		_, err := fmt.Fprintf(w, "no session %s", m["done"])
+		return err
+	}
+	var favourites []string
+	for _, f := range m["favourites"].([]handler.Favourite) {
+		favourites = append(favourites, fmt.Sprintf("%s x%d", f.SCP.Name, f.Picks))
+	}
+	_, err := fmt.Fprintf(w, "%d votes, favourites %s, %d upsets", m["votes"], strings.Join(favourites, ", "), m["upsetCount"])
+	return err
+}
+
+func TestMePageHandler(t *testing.T) {
+	e, h, votes := newVoteHandler(t)
+	e.Renderer = historyRenderer{}
+	votes.Start(h.ProcessVote)
+	serve := func(method, path string, cookies []*http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	vote := func(cookies []*http.Cookie, winner string) *httptest.ResponseRecorder {
+		matchup := new(handler.Matchup)
+		if err := json.Unmarshal(serve(http.MethodGet, "/api/next", nil, "").Body.Bytes(), matchup); err != nil {
+			t.Fatal(err)
+		}
+		w, l := matchup.Left, matchup.Right
+		if w.Name != winner {
+			w, l = l, w
+		}
+		rec := serve(http.MethodPost, "/vote", cookies, fmt.Sprintf(`{"winnerID":%d,"loserID":%d,"ballot":%q}`, w.ID, l.ID, matchup.Ballot))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Expected the vote to be accepted, got %d %s", rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	if rec := serve(http.MethodGet, "/me", nil, ""); rec.Body.String() != "no session " {
+		t.Errorf("Expected no session before voting, got %q", rec.Body.String())
+	}
+
+	// The first vote starts a session.
+	cookies := vote(nil, "SCP-049").Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" || !cookies[0].HttpOnly || cookies[0].MaxAge != 3600 {
+		t.Fatalf("Expected a session cookie, got %v", cookies)
+	}
+	if more := vote(cookies, "SCP-049").Result().Cookies(); len(more) != 0 {
+		t.Errorf("Expected the session to be kept, got %v", more)
+	}
+	vote(cookies, "SCP-173")
+	vote(nil, "SCP-049") // another voter
+	if err := votes.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// SCP-049 won more votes, so picking SCP-173 was against the crowd.
+	if rec := serve(http.MethodGet, "/me", cookies, ""); rec.Body.String() != "3 votes, favourites SCP-049 x2, SCP-173 x1, 1 upsets" {
+		t.Errorf("Unexpected history %q", rec.Body.String())
+	}
+
+	// Forged cookies are removed.
+	forged := &http.Cookie{Name: "session", Value: strings.Replace(cookies[0].Value, ".", "x.", 1)}
+	rec := serve(http.MethodGet, "/me", []*http.Cookie{forged}, "")
+	if removed := rec.Result().Cookies(); rec.Body.String() != "no session " || len(removed) != 1 || removed[0].MaxAge >= 0 {
+		t.Errorf("Expected a forged cookie to be removed, got %q %v", rec.Body.String(), removed)
+	}
+
+	// Deleting the data ends the session.
+	rec = serve(http.MethodPost, "/me/delete", cookies, "")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "/me?done=deleted" {
+		t.Errorf("Expected a redirect to /me, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := serve(http.MethodGet, "/me", cookies, ""); rec.Body.String() != "no session " {
+		t.Errorf("Expected the session to be deleted, got %q", rec.Body.String())
+	}
+}
+
+func TestMeRevokeHandler(t *testing.T) {
+	e, _, _ := newVoteHandler(t)
+	e.Renderer = historyRenderer{}
+	matchup := new(handler.Matchup)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/next", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), matchup); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(fmt.Sprintf(`{"winnerID":%d,"loserID":%d,"ballot":%q}`, matchup.Left.ID, matchup.Right.ID, matchup.Ballot)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve(http.MethodGet, "/me"); strings.HasPrefix(rec.Body.String(), "no session") {
+		t.Fatalf("Expected a session, got %q", rec.Body.String())
+	}
+	rec = serve(http.MethodPost, "/me/revoke")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "/me?done=revoked" {
+		t.Errorf("Expected a redirect to /me, got %d %v", rec.Code, rec.Header())
+	}
+	// The cookie is rejected even if the browser keeps it.
+	if rec := serve(http.MethodGet, "/me?done=revoked"); rec.Body.String() != "no session revoked" {
+		t.Errorf("Expected the session to be revoked, got %q", rec.Body.String())
+	}
+}
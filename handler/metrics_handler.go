@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cycraig/scpbattle/metrics"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/labstack/echo/v4"
+)
+
+// Metrics holds the Prometheus metrics of the server, exposed by MetricsHandler.
+type Metrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	voteLatency     *metrics.Histogram
+	blockedRequests *metrics.Counter
+	allowedNetworks []*net.IPNet
+	token           string
+	routes          map[string]bool // registered route paths, see isRoute
+	routesOnce      sync.Once
+}
+
+// NewMetrics registers the HTTP and vote latency metrics, see RegisterHandler for the rest.
+// Scrapes are allowed from the given networks, or from anywhere with the bearer token if it is not empty.
+func NewMetrics(allowedNetworks []*net.IPNet, token string) *Metrics {
+	registry := metrics.NewRegistry()
+	m := &Metrics{
+		registry:        registry,
+		allowedNetworks: allowedNetworks,
+		token:           token,
+	}
+	m.requests = registry.NewCounterVec("scpbattle_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	m.requestDuration = registry.NewHistogramVec("scpbattle_http_request_duration_seconds",
+		"HTTP request durations by route and method.", metrics.DefaultBuckets, "route", "method")
+	m.blockedRequests = registry.NewCounter("scpbattle_blocked_requests_total",
+		"Requests refused because the client IP address is blocked.")
+	m.voteLatency = registry.NewHistogram("scpbattle_vote_latency_seconds",
+		"Time from accepting a vote until it was applied to the cache, excluding failed and replayed votes.", metrics.DefaultBuckets)
+	return m
+}
+
+// RegisterHandler registers the metrics of the handler's cache and vote queue.
+func (m *Metrics) RegisterHandler(h *Handler) {
+	registry := m.registry
+	votes := func(stat func(queue.Stats) float64) func() float64 {
+		return func() float64 {
+			return stat(h.votes.Stats())
+		}
+	}
+	registry.NewCounterFunc("scpbattle_votes_accepted_total", "Votes accepted into the vote queue.",
+		votes(func(s queue.Stats) float64 { return float64(s.Accepted) }))
+	registry.NewCounterFunc("scpbattle_votes_rejected_total", "Votes rejected because the vote queue was full.",
+		votes(func(s queue.Stats) float64 { return float64(s.Rejected) }))
+	registry.NewCounterFunc("scpbattle_votes_processed_total", "Votes taken off the vote queue and applied, including failures.",
+		votes(func(s queue.Stats) float64 { return float64(s.Processed) }))
+	registry.NewCounterFunc("scpbattle_votes_failed_total", "Votes that could not be applied.",
+		votes(func(s queue.Stats) float64 { return float64(s.Failed) }))
+	registry.NewCounterFunc("scpbattle_votes_replayed_total", "Votes replayed from the write-ahead log on startup.",
+		votes(func(s queue.Stats) float64 { return float64(s.Replayed) }))
+	registry.NewGaugeFunc("scpbattle_vote_queue_depth", "Votes waiting to be processed.",
+		votes(func(s queue.Stats) float64 { return float64(s.Depth) }))
+	registry.NewGaugeFunc("scpbattle_vote_queue_capacity", "Maximum number of votes waiting to be processed.",
+		votes(func(s queue.Stats) float64 { return float64(s.Capacity) }))
+	registry.NewGaugeFunc("scpbattle_vote_queue_segments", "Write-ahead log segments not yet checkpointed.",
+		votes(func(s queue.Stats) float64 { return float64(s.Segments) }))
+
+	registry.NewCounterFunc("scpbattle_cache_hits_total", "SCP cache accesses served from memory.",
+		func() float64 { return float64(h.scpCache.Counters().Hits) })
+	registry.NewCounterFunc("scpbattle_cache_misses_total", "SCP cache accesses that loaded the cache from the database.",
+		func() float64 { return float64(h.scpCache.Counters().Misses) })
+	registry.NewCounterFunc("scpbattle_cache_invalidations_total", "SCP cache invalidations.",
+		func() float64 { return float64(h.scpCache.Counters().Invalidations) })
+	registry.NewCounterFunc("scpbattle_rankings_recomputes_total", "Times the rankings were sorted again.",
+		func() float64 { return float64(h.scpCache.Counters().RankingRecomputes) })
+	registry.NewCounterFunc("scpbattle_cache_flushes_total", "Writes of cached votes back to the database.",
+		func() float64 { return float64(h.scpCache.Counters().Flushes) })
+	registry.NewCounterFunc("scpbattle_cache_flush_duration_seconds_total", "Total time spent writing cached votes back to the database.",
+		func() float64 { return h.scpCache.Counters().FlushSeconds })
+	registry.NewCounterFunc("scpbattle_cache_flush_failures_total", "Writes back to the database that failed after retries.",
+		func() float64 { return float64(h.scpCache.Stats().Failures) })
+	registry.NewGaugeFunc("scpbattle_cache_dirty_entries", "SCPs and matchups with votes not yet written to the database.",
+		func() float64 {
+			scps, matchups := h.scpCache.DirtyCount()
+			return float64(scps + matchups)
+		})
+	registry.NewGaugeFunc("scpbattle_cache_degraded", "1 while the database is unavailable and the cache is read-only.",
+		func() float64 {
+			if h.scpCache.Degraded() {
+				return 1
+			}
+			return 0
+		})
+}
+
+// ParseNetworks parses a comma-separated list of CIDR networks, e.g. "127.0.0.0/8,::1/128".
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Middleware counts and times every request by its route.
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		method := c.Request().Method
+		code := c.Response().Status
+		if err != nil && !c.Response().Committed {
+			// The error handler writes the response after the middleware returns.
+			code = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			}
+		}
+		route := c.Path()
+		if !m.isRoute(c.Echo(), route) {
+			// The path of unrouted requests is the request path, use fixed labels instead so that
+			// scanners cannot create unbounded label values.
+			route = "unmatched"
+			if err == nil {
+				route = "static"
+			}
+		}
+		m.requests.Inc(route, method, strconv.Itoa(code))
+		m.requestDuration.Observe(time.Since(start).Seconds(), route, method)
+		return err
+	}
+}
+
+func (m *Metrics) isRoute(e *echo.Echo, path string) bool {
+	// Routes are all registered before the server starts, so they only need to be read once.
+	m.routesOnce.Do(func() {
+		m.routes = make(map[string]bool)
+		for _, route := range e.Routes() {
+			m.routes[route.Path] = true
+		}
+	})
+	return m.routes[path]
+}
+
+// ObserveVote records the latency of a vote that was just processed, unless it failed or was replayed
+// from the write-ahead log, whose latency would include the downtime since an earlier run accepted it.
+func (m *Metrics) ObserveVote(vote queue.Vote, err error) {
+	if err != nil || vote.Replayed {
+		return
+	}
+	m.voteLatency.Observe(time.Since(vote.Accepted).Seconds())
+}
+
+// BlockedRequest counts a request refused because of its client IP address.
+func (m *Metrics) BlockedRequest() {
+	m.blockedRequests.Inc()
+}
+
+// MetricsHandler writes the metrics in the Prometheus text exposition format.
+// Responds with 403 Forbidden unless the client is in an allowed network or presents the bearer token.
+func (m *Metrics) MetricsHandler(c echo.Context) error {
+	if !m.allowed(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Metrics are not available from your network.")
+	}
+	c.Response().Header().Set(echo.HeaderContentType, metrics.ContentType)
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err := m.registry.WriteTo(c.Response())
+	return err
+}
+
+func (m *Metrics) allowed(c echo.Context) bool {
+	if m.token != "" {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(m.token)) == 1 {
+			return true
+		}
+	}
+	ip := net.ParseIP(c.RealIP())
+	if ip == nil {
+		return false
+	}
+	for _, network := range m.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
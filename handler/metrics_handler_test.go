@@ -0,0 +1,93 @@
+package handler_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/handler"
+	"github.com/cycraig/scpbattle/metrics"
+	"github.com/cycraig/scpbattle/queue"
+)
+
+func newMetricsEcho(t *testing.T, token string) (*echo.Echo, *handler.Metrics) {
+	networks, err := handler.ParseNetworks("127.0.0.0/8, ::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := handler.NewMetrics(networks, token)
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	e.GET("/metrics", m.MetricsHandler)
+	return e, m
+}
+
+func scrape(e *echo.Echo, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMetricsHandler(t *testing.T) {
+	e, _ := newMetricsEcho(t, "secret")
+	bearer := func(token string) http.Header {
+		return http.Header{echo.HeaderAuthorization: {"Bearer " + token}}
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		status     int
+	}{
+		{"allowed network", "127.0.0.1:4321", nil, http.StatusOK},
+		{"allowed IPv6 network", "[::1]:4321", nil, http.StatusOK},
+		{"disallowed network", "203.0.113.5:4321", nil, http.StatusForbidden},
+		{"token", "203.0.113.5:4321", bearer("secret"), http.StatusOK},
+		{"wrong token", "203.0.113.5:4321", bearer("secrets"), http.StatusForbidden},
+		{"token without bearer", "203.0.113.5:4321", http.Header{echo.HeaderAuthorization: {"secret"}}, http.StatusForbidden},
+		{"client of a trusted proxy", "10.0.0.1:4321", http.Header{echo.HeaderXForwardedFor: {"203.0.113.5"}}, http.StatusForbidden},
+		{"forwarded by an untrusted client", "203.0.113.5:4321", http.Header{echo.HeaderXForwardedFor: {"127.0.0.1"}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rec := scrape(e, test.remoteAddr, test.header)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.status, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code == http.StatusOK && rec.Header().Get(echo.HeaderContentType) != metrics.ContentType {
+			t.Errorf("%s: unexpected content type %q", test.name, rec.Header().Get(echo.HeaderContentType))
+		}
+	}
+
+	// Without a token, only the networks are allowed.
+	e, _ = newMetricsEcho(t, "")
+	if rec := scrape(e, "203.0.113.5:4321", bearer("")); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected an empty token to be refused, got %d", rec.Code)
+	}
+}
+
+func TestObserveVote(t *testing.T) {
+	e, m := newMetricsEcho(t, "")
+	accepted := time.Now().Add(-time.Hour)
+	m.ObserveVote(queue.Vote{Seq: 1, Accepted: time.Now()}, nil)
+	m.ObserveVote(queue.Vote{Seq: 2, Accepted: time.Now()}, errors.New("SCP not found"))
+	m.ObserveVote(queue.Vote{Seq: 3, Accepted: accepted, Replayed: true}, nil)
+
+	// Only the vote that was applied since being accepted by this run is observed.
+	body := scrape(e, "127.0.0.1:4321", nil).Body.String()
+	for _, sample := range []string{"scpbattle_vote_latency_seconds_count 1\n", `scpbattle_vote_latency_seconds_bucket{le="+Inf"} 1` + "\n"} {
+		if !strings.Contains(body, sample) {
+			t.Errorf("Expected %q in the metrics, got\n%s", sample, body)
+		}
+	}
+}
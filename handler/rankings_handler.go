@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
 // Candidate wraps SCP fields to be rendered in the rankings.html template.
@@ -23,7 +24,7 @@ func (h *Handler) RankingsPageHandler(c echo.Context) error {
 	rankedSCPs, err := h.scpCache.GetRankedSCPs()
 	if err != nil {
 		msg := fmt.Sprintf("Error retrieving ranked SCPs")
-		c.Logger().Error(msg, err)
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
 		return echo.NewHTTPError(http.StatusInternalServerError, msg)
 	}
 	// TODO: use the rankedSCPs slice directly to avoid extra allocation per request?
@@ -41,7 +42,7 @@ func (h *Handler) RankingsPageHandler(c echo.Context) error {
 	}
 	return c.Render(http.StatusOK, "rankings.html", echo.Map{
 		"title":      "Rankings",
-		"main-image": h.imageDir + rankedSCPs[0].Image,
+		"main-image": h.imageURL(rankedSCPs[0].Image),
 		"candidates": candidates,
 	})
 }
@@ -1,126 +1,221 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
-	"math"
 	"net/http"
-	"sync"
+	"strings"
 
+	"github.com/cycraig/scpbattle/ballot"
+	"github.com/cycraig/scpbattle/logging"
 	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/cycraig/scpbattle/store"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
+// Matchup is a pair of SCPs to vote on, with the ballot to vote with.
+type Matchup struct {
+	Left   *Contender `json:"left"`
+	Right  *Contender `json:"right"`
+	Ballot string     `json:"ballot"`
+}
+
+// VoteResponse is the response to votes sent as JSON, including the next matchup so that the
+// vote page can show it without reloading.
+type VoteResponse struct {
+	Message string   `json:"message"`
+	Next    *Matchup `json:"next,omitempty"` // nil if no matchup could be found, reload the page instead
+}
+
 // VotePageHandler renders the vote.html template.
 func (h *Handler) VotePageHandler(c echo.Context) error {
-	randomSCPs, err := h.scpCache.GetRandomSCPs(2)
+	matchup, err := h.nextMatchup(c)
 	if err != nil {
-		msg := "Error retrieving random SCPs "
-		c.Logger().Error(msg, err)
-		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		return err
 	}
-	if len(randomSCPs) < 2 {
-		// Shouldn't happen
-		msg := fmt.Sprintf("Too few random SCPs retrieved: %d", len(randomSCPs))
-		c.Logger().Error(msg)
-		return echo.NewHTTPError(http.StatusInternalServerError, msg)
-	}
-	left := randomSCPs[0]
-	right := randomSCPs[1]
+	left, right := matchup.Left, matchup.Right
 	return c.Render(http.StatusOK, "vote.html", echo.Map{
 		"title":      "Vote",
 		"id_left":    left.ID,
 		"name_left":  left.Name,
-		"desc_left":  left.Description,
-		"img_left":   h.imageDir + left.Image,
+		"desc_left":  left.Desc,
+		"img_left":   left.Image,
 		"link_left":  left.Link,
 		"id_right":   right.ID,
 		"name_right": right.Name,
-		"desc_right": right.Description,
-		"img_right":  h.imageDir + right.Image,
+		"desc_right": right.Desc,
+		"img_right":  right.Image,
 		"link_right": right.Link,
+		"ballot":     matchup.Ballot,
 	})
 }
 
+// NextMatchupHandler returns a random matchup as JSON, with preload hints for its images.
+func (h *Handler) NextMatchupHandler(c echo.Context) error {
+	matchup, err := h.nextMatchup(c)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store") // ballots are single-use
+	preload(c, matchup)
+	return c.JSON(http.StatusOK, matchup)
+}
+
+// nextMatchup returns a matchup between two random SCPs.
+func (h *Handler) nextMatchup(c echo.Context) (*Matchup, error) {
+	randomSCPs, err := h.scpCache.GetRandomSCPs(2)
+	if err != nil {
+		msg := "Error retrieving random SCPs "
+		c.Logger().Errorj(log.JSON{"message": msg, "error": err})
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	if len(randomSCPs) < 2 {
+		// Shouldn't happen
+		msg := fmt.Sprintf("Too few random SCPs retrieved: %d", len(randomSCPs))
+		c.Logger().Error(msg)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	left := randomSCPs[0]
+	right := randomSCPs[1]
+	return &Matchup{
+		Left:   h.newContender(left),
+		Right:  h.newContender(right),
+		Ballot: h.ballots.Issue(left.ID, right.ID),
+	}, nil
+}
+
+// preload adds Link headers hinting browsers to load the images of the matchup before it is shown.
+func preload(c echo.Context, matchup *Matchup) {
+	for _, contender := range []*Contender{matchup.Left, matchup.Right} {
+		c.Response().Header().Add("Link", "<"+contender.Image+">; rel=preload; as=image")
+	}
+}
+
 // VoteRequest contains a single vote outcome between two SCPs from a client.
 type VoteRequest struct {
 	// Using platform-dependent types is concerning, I wonder why gorm defaults to uint instead of uint64...
 	// We'll never go above 2^32-1 SCPs anyway, so it doesn't really matter.
 	WinnerID uint `json:"winnerID" form:"winnerID" query:"winnerID"`
 	LoserID  uint `json:"loserID" form:"loserID" query:"loserID"`
+	// Ballot is the signed matchup of the vote page, see ballot.Signer.
+	Ballot string `json:"ballot" form:"ballot"`
 }
 
-// VoteHandler processes client votes from vote.html as POST requests.
+// VoteHandler processes client votes from vote.html as POST requests, either JSON sent by its script,
+// answered with the next matchup (see VoteResponse), or the form of the chosen SCP without JavaScript,
+// which is redirected to a new matchup (303 See Other).
+// Votes are only accepted with the ballot of the matchup shown, once.
+// Votes are queued and applied asynchronously; when the queue is full the vote is rejected with
+// 429 Too Many Requests so the client can retry later with the same ballot.
 func (h *Handler) VoteHandler(c echo.Context) error {
-	// TODO: validate request by sending a hashcode or something to prevent spamming
-	//       vote requests without interacting with the page.
+	form := isForm(c)
 	req := new(VoteRequest)
 	if err := c.Bind(req); err != nil {
-		c.Logger().Warn("Vote request parsing error: ", err)
+		c.Logger().Warnj(log.JSON{"message": "Invalid vote request", "error": err})
 		return echo.NewHTTPError(http.StatusBadRequest, "Please provide valid IDs.")
 	}
-	c.Logger().Info("Received vote request: ", req)
-
-	go h.processVoteRequest(c, req.WinnerID, req.LoserID) // asynchronous to avoid blocking
-	return c.HTML(http.StatusAccepted, "Vote accepted")   // accepted but may not be processed yet (could still be rejected)
-}
-
-func (h *Handler) processVoteRequest(c echo.Context, winnerID uint, loserID uint) {
-	winner, err := h.scpCache.GetByID(winnerID)
-	if err != nil {
-		c.Logger().Error(fmt.Sprintf("Error finding SCP id: %d ", winnerID), err)
-		return
+	if req.WinnerID == 0 || req.LoserID == 0 || req.WinnerID == req.LoserID {
+		return echo.NewHTTPError(http.StatusBadRequest, "Please provide valid IDs.")
 	}
-	loser, err := h.scpCache.GetByID(loserID)
-	if err != nil {
-		c.Logger().Error(fmt.Sprintf("Error finding SCP id: %d ", loserID), err)
-		return
+	switch err := h.ballots.Redeem(req.Ballot, req.WinnerID, req.LoserID); err {
+	case nil:
+	case ballot.ErrExpired:
+		if form {
+			// Left open for too long, show a new matchup instead.
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, "This matchup has expired, please reload the page.")
+	case ballot.ErrUsed:
+		if form {
+			// Resubmitted, e.g. by going back or double-clicking, show a new matchup instead.
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		return echo.NewHTTPError(http.StatusConflict, "You have already voted on this matchup.")
+	default:
+		c.Logger().Warnj(log.JSON{"message": "Invalid ballot", "error": err, "client": logging.Client(c)})
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ballot, please reload the page.")
 	}
-	if winner == nil {
-		c.Logger().Warn(fmt.Sprintf("Could not find SCP id: %d", winnerID))
-		return
+	// Votes are attributed to the voter's session, started once their first vote is queued.
+	vote, err := h.votes.Enqueue(queue.Vote{
+		WinnerID:  req.WinnerID,
+		LoserID:   req.LoserID,
+		RequestID: logging.RequestID(c),
+		Client:    logging.Client(c),
+		Session:   h.sessions.ID(c),
+	})
+	if err != nil {
+		// Not cast, the voter can retry with the same ballot.
+		h.ballots.Release(req.Ballot)
 	}
-	if loser == nil {
-		c.Logger().Warn(fmt.Sprintf("Could not find SCP id: %d", loserID))
-		return
+	switch err {
+	case nil:
+		c.Logger().Infoj(log.JSON{
+			"message":   "Received vote",
+			"winner_id": req.WinnerID,
+			"loser_id":  req.LoserID,
+			"seq":       vote.Seq,
+			"client":    logging.Client(c),
+		})
+		if err := h.sessions.Start(c); err != nil {
+			// e.g. the database is unavailable, the vote still counts but isn't logged.
+			c.Logger().Warnj(log.JSON{"message": "Error starting session", "error": err})
+		}
+		if form {
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		// Accepted but may not be processed yet (could still be rejected).
+		res := VoteResponse{Message: "Vote accepted"}
+		if next, err := h.nextMatchup(c); err == nil {
+			res.Next = next
+			preload(c, next)
+		}
+		return c.JSON(http.StatusAccepted, res)
+	case queue.ErrQueueFull:
+		c.Logger().Warnj(log.JSON{"message": "Rejected vote", "error": err, "client": logging.Client(c)})
+		c.Response().Header().Set("Retry-After", "1")
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many votes, please try again.")
+	case queue.ErrQueueClosed:
+		c.Logger().Infoj(log.JSON{"message": "Rejected vote", "error": err, "client": logging.Client(c)})
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Shutting down, please try again.")
+	default:
+		c.Logger().Errorj(log.JSON{"message": "Error queueing vote", "error": err, "client": logging.Client(c)})
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error queueing vote.")
 	}
+}
 
-	// Calculate new Elo ratings
-	K := 20.0
-	Pwinner := eloExpectedProbability(winner.Rating, loser.Rating)
-	Ploser := eloExpectedProbability(loser.Rating, winner.Rating)
-	winnerDiff := K * (1.0 - Pwinner)
-	loserDiff := K * (0.0 - Ploser)
-	// fmt.Printf("Pwinner: %.4f\n", Pwinner)
-	// fmt.Printf("Ploser: %.4f\n", Ploser)
-	// fmt.Printf("winnerRating before: %.2f\n", winner.Rating)
-	// fmt.Printf("loserRating before: %.2f\n", loser.Rating)
-	h.updateEloRating(winner, winnerDiff, 1, 0)
-	h.updateEloRating(loser, loserDiff, 0, 1)
-	// fmt.Printf("winnerRating after: %.2f\n", winner.Rating)
-	// fmt.Printf("loserRating after: %.2f\n", loser.Rating)
-
-	err = h.scpCache.Update(winner, loser)
-	if err != nil {
-		c.Logger().Error("Error during update: ", err)
-	}
+// isForm returns whether the request is a form submission rather than JSON.
+func isForm(c echo.Context) bool {
+	ct := c.Request().Header.Get(echo.HeaderContentType)
+	return strings.HasPrefix(ct, echo.MIMEApplicationForm) || strings.HasPrefix(ct, echo.MIMEMultipartForm)
 }
 
-func (h *Handler) updateEloRating(scp *model.SCP, ratingDiff float64, winDiff uint64, lossDiff uint64) {
-	// Use a fine-grained lock per SCP to prevent lost updates.
-	if lock, ok := h.scpLock[scp.ID]; ok {
-		lock.Lock()
-		defer lock.Unlock()
-	} else {
-		lock = &sync.Mutex{}
-		h.scpLock[scp.ID] = lock
-		lock.Lock()
-		defer lock.Unlock()
+// ProcessVote applies a single vote from the VoteQueue to the SCP ratings, and logs it for the
+// voter's session, if any.
+func (h *Handler) ProcessVote(vote queue.Vote) error {
+	// The cache applies the update while holding its lock, so concurrent votes are never lost, and
+	// records the vote as applied and logs it along with its changes, so that it is only applied once.
+	applied := model.AppliedVote{WAL: h.votes.ID(), Seq: vote.Seq}
+	var voteLog *model.VoteLog
+	if vote.Session != "" {
+		voteLog = &model.VoteLog{
+			SessionID: vote.Session,
+			WinnerID:  vote.WinnerID,
+			LoserID:   vote.LoserID,
+			CreatedAt: vote.Accepted,
+			WAL:       applied.WAL,
+			Seq:       vote.Seq,
+		}
+	}
+	err := h.scpCache.VoteOnce(applied, voteLog, vote.WinnerID, vote.LoserID, h.updateEloRatings)
+	if errors.Is(err, store.ErrSCPNotFound) {
+		// Deleted since the vote was accepted, so replaying it would fail again.
+		return fmt.Errorf("%w: %v", queue.ErrInvalidVote, err)
 	}
-	scp.Rating += ratingDiff
-	scp.Wins += winDiff
-	scp.Losses += lossDiff
+	return err
 }
 
-func eloExpectedProbability(rating1 float64, rating2 float64) float64 {
-	return 1.0 / (1.0 + math.Pow(10.0, (rating2-rating1)/400.0))
+func (h *Handler) updateEloRatings(winner *model.SCP, loser *model.SCP) {
+	model.UpdateEloRatings(winner, loser, h.eloK)
 }
@@ -0,0 +1,340 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/asset"
+	"github.com/cycraig/scpbattle/ballot"
+	"github.com/cycraig/scpbattle/handler"
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/cycraig/scpbattle/render"
+	"github.com/cycraig/scpbattle/session"
+	"github.com/cycraig/scpbattle/store"
+)
+
+func newVoteEcho(t *testing.T) *echo.Echo {
+	e, _, _ := newVoteHandler(t)
+	return e
+}
+
+// newVoteHandler returns the routes of a Handler voting on SCP-049 and SCP-173, and its queue, not started.
+func newVoteHandler(t *testing.T) (*echo.Echo, *handler.Handler, *queue.VoteQueue) {
+	return newVoteHandlerWithAssets(t, nil)
+}
+
+// newVoteHandlerWithAssets is newVoteHandler resolving the URLs of the images with assets.
+func newVoteHandlerWithAssets(t *testing.T, assets render.Assets) (*echo.Echo, *handler.Handler, *queue.VoteQueue) {
+	scpStore := store.NewMemorySCPStore()
+	// Votes are written back, and logged for their sessions, as soon as they are applied.
+	scpCache := store.NewSCPCacheWithDuration(scpStore, 0, 5*time.Second)
+	for _, name := range []string{"SCP-049", "SCP-173"} {
+		if err := scpCache.Create(model.NewSCP(name, "", strings.ToLower(name)+".jpg", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := queue.DefaultOptions()
+	opts.Dir = ""
+	votes, err := queue.NewVoteQueue(opts, echo.New().Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := session.NewManager(scpStore.Sessions(), session.Config{Key: "key", MaxAge: time.Hour})
+	h := handler.NewHandler(scpCache, votes, ballot.NewSigner("key", time.Hour), sessions, "images/", assets, 20)
+
+	e := echo.New()
+	e.HTTPErrorHandler = handler.HTTPErrorHandler
+	e.POST("/vote", h.VoteHandler, sessions.Middleware)
+	e.GET("/api/next", h.NextMatchupHandler)
+	e.GET("/me", h.MePageHandler, sessions.Middleware)
+	e.POST("/me/revoke", h.MeRevokeHandler, sessions.Middleware)
+	e.POST("/me/delete", h.MeDeleteHandler, sessions.Middleware)
+	return e, h, votes
+}
+
+func checkMatchup(t *testing.T, matchup *handler.Matchup, header http.Header) {
+	t.Helper()
+	if matchup == nil || matchup.Left == nil || matchup.Right == nil || matchup.Ballot == "" {
+		t.Fatalf("Expected a matchup, got %+v", matchup)
+	}
+	if matchup.Left.ID == matchup.Right.ID || !strings.HasPrefix(matchup.Left.Image, "/images/scp-") {
+		t.Errorf("Unexpected matchup %+v vs %+v", matchup.Left, matchup.Right)
+	}
+	expected := []string{
+		"<" + matchup.Left.Image + ">; rel=preload; as=image",
+		"<" + matchup.Right.Image + ">; rel=preload; as=image",
+	}
+	if links := header.Values("Link"); strings.Join(links, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the preload hints %v, got %v", expected, links)
+	}
+}
+
+func TestNextMatchupHandler(t *testing.T) {
+	e := newVoteEcho(t)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/next", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderCacheControl) != "no-store" {
+		t.Fatalf("Unexpected response %d %v", rec.Code, rec.Header())
+	}
+	matchup := new(handler.Matchup)
+	if err := json.Unmarshal(rec.Body.Bytes(), matchup); err != nil {
+		t.Fatal(err)
+	}
+	checkMatchup(t, matchup, rec.Header())
+}
+
+func TestVoteHandler(t *testing.T) {
+	e := newVoteEcho(t)
+	next := func() *handler.Matchup {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/next", nil))
+		matchup := new(handler.Matchup)
+		if err := json.Unmarshal(rec.Body.Bytes(), matchup); err != nil {
+			t.Fatal(err)
+		}
+		return matchup
+	}
+	postJSON := func(winner, loser uint, ballot string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"winnerID":%d,"loserID":%d,"ballot":%q}`, winner, loser, ballot)
+		req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	postForm := func(winner, loser uint, ballot string) *httptest.ResponseRecorder {
+		form := url.Values{"winnerID": {fmt.Sprint(winner)}, "loserID": {fmt.Sprint(loser)}, "ballot": {ballot}}
+		req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// JSON votes get the next matchup.
+	m := next()
+	rec := postJSON(m.Left.ID, m.Right.ID, m.Ballot)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", rec.Code, rec.Body)
+	}
+	res := new(handler.VoteResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	checkMatchup(t, res.Next, rec.Header())
+	if rec := postJSON(m.Left.ID, m.Right.ID, m.Ballot); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 voting twice with a ballot, got %d", rec.Code)
+	}
+
+	// Forms are redirected to the next matchup.
+	m = res.Next
+	rec = postForm(m.Right.ID, m.Left.ID, m.Ballot)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "/" {
+		t.Errorf("Expected a redirect to /, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := postForm(m.Right.ID, m.Left.ID, m.Ballot); rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "/" {
+		t.Errorf("Expected a redirect to / voting twice with a ballot, got %d %v", rec.Code, rec.Header())
+	}
+	expired := ballot.NewSigner("key", 0).Issue(m.Left.ID, m.Right.ID)
+	if rec := postForm(m.Left.ID, m.Right.ID, expired); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected a redirect for an expired ballot, got %d", rec.Code)
+	}
+
+	// Votes without a valid ballot are rejected.
+	m = next()
+	for _, rec := range []*httptest.ResponseRecorder{
+		postJSON(m.Left.ID, m.Right.ID, ""),
+		postJSON(m.Left.ID, 3, m.Ballot),
+		postJSON(m.Left.ID, m.Right.ID, expired+"x"),
+		postForm(m.Left.ID, m.Right.ID, "forged"),
+		postJSON(m.Left.ID, m.Left.ID, m.Ballot),
+	} {
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestVoteHandlerFingerprintedImages(t *testing.T) {
+	// The images of the next matchup and their preload hints refer to the fingerprinted URLs.
+	manifest, err := asset.NewManifest(fstest.MapFS{
+		"images/scp-049.jpg": {Data: []byte("049")},
+		"images/scp-173.jpg": {Data: []byte("173")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _, votes := newVoteHandlerWithAssets(t, manifest)
+	defer votes.Close()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/next", nil))
+	m := new(handler.Matchup)
+	if err := json.Unmarshal(rec.Body.Bytes(), m); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"winnerID":%d,"loserID":%d,"ballot":%q}`, m.Left.ID, m.Right.ID, m.Ballot)
+	req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", rec.Code, rec.Body)
+	}
+	res := new(handler.VoteResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Next == nil {
+		t.Fatal("Expected the next matchup")
+	}
+	var expected []string
+	for _, contender := range []*handler.Contender{res.Next.Left, res.Next.Right} {
+		image := manifest.URL("images/" + strings.ToLower(contender.Name) + ".jpg")
+		if contender.Image != image || image == "/images/"+strings.ToLower(contender.Name)+".jpg" {
+			t.Errorf("Expected the image of %s at %q, got %q", contender.Name, image, contender.Image)
+		}
+		expected = append(expected, "<"+image+">; rel=preload; as=image")
+	}
+	if links := rec.Header().Values("Link"); strings.Join(links, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the preload hints %v, got %v", expected, links)
+	}
+}
+
+func TestVoteHandlerQueueFull(t *testing.T) {
+	e, h, votes := newVoteHandler(t)
+	defer votes.Close()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/next", nil))
+	m := new(handler.Matchup)
+	if err := json.Unmarshal(rec.Body.Bytes(), m); err != nil {
+		t.Fatal(err)
+	}
+	post := func() *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"winnerID":%d,"loserID":%d,"ballot":%q}`, m.Left.ID, m.Right.ID, m.Ballot)
+		req := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Fill the queue, which isn't processing votes yet.
+	for votes.Stats().Depth < votes.Stats().Capacity {
+		if _, err := votes.Enqueue(queue.Vote{WinnerID: m.Left.ID, LoserID: m.Right.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := post(); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("Expected 429 with Retry-After and without starting a session, got %d %v", rec.Code, rec.Header())
+	}
+
+	// The ballot wasn't cast, so the vote can be retried once there is room.
+	votes.Start(h.ProcessVote)
+	for votes.Stats().Depth == votes.Stats().Capacity {
+		time.Sleep(time.Millisecond)
+	}
+	if rec := post(); rec.Code != http.StatusAccepted || len(rec.Result().Cookies()) != 1 {
+		t.Errorf("Expected 202 retrying, starting a session, got %d %s %v", rec.Code, rec.Body, rec.Result().Cookies())
+	}
+	if rec := post(); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 once cast, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestProcessVoteReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestProcessVoteReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scpStore := store.NewMemorySCPStore()
+	if err := scpStore.Sessions().CreateSession(&model.Session{ID: "voter"}); err != nil {
+		t.Fatal(err)
+	}
+	run := func() (*store.SCPCache, *queue.VoteQueue) {
+		opts := queue.DefaultOptions()
+		opts.Dir = dir
+		votes, err := queue.NewVoteQueue(opts, echo.New().Logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := scpStore.GetAppliedVotes(votes.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		votes.SetApplied(applied)
+		scpCache := store.NewSCPCache(scpStore)
+		sessions := session.NewManager(scpStore.Sessions(), session.Config{Key: "key", MaxAge: time.Hour})
+		h := handler.NewHandler(scpCache, votes, ballot.NewSigner("key", time.Hour), sessions, "images/", nil, 20)
+		votes.Start(h.ProcessVote)
+		return scpCache, votes
+	}
+	checkWins := func(expected uint64) {
+		t.Helper()
+		scp, err := scpStore.GetByID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scp.Wins != expected {
+			t.Errorf("Expected %d persisted wins, got %d", expected, scp.Wins)
+		}
+		// Logged once for the session, along with the wins.
+		logged, err := scpStore.Sessions().GetVoteLog("voter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(logged)) != expected {
+			t.Errorf("Expected %d logged votes, got %d", expected, len(logged))
+		}
+	}
+
+	scpCache, votes := run()
+	for _, name := range []string{"SCP-049", "SCP-173"} {
+		if err := scpCache.Create(model.NewSCP(name, "", "", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := votes.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2, Session: "voter"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The votes are flushed, then the run crashes before the checkpoint deletes them from the log.
+	if err := votes.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := scpCache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkWins(3)
+
+	// The next run replays the log without counting the flushed votes again.
+	scpCache, votes = run()
+	if stats := votes.Stats(); stats.Replayed != 0 || stats.Skipped != 3 {
+		t.Errorf("Expected the 3 flushed votes to be skipped, got %+v", stats)
+	}
+	if _, err := votes.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2, Session: "voter"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := votes.Checkpoint(scpCache.Flush); err != nil {
+		t.Fatal(err)
+	}
+	if err := votes.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkWins(4)
+}
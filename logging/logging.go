@@ -0,0 +1,181 @@
+// Package logging writes structured JSON log lines with fixed fields, such as the request ID,
+// and assigns every HTTP request an ID, see Middleware.
+package logging
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+	"path"
+	"runtime"
+	"strconv"
+
+	"github.com/labstack/gommon/log"
+)
+
+// header is the start of every log line. The caller is added by Logger itself,
+// since gommon would report the location of the Logger method.
+const header = `{"time":"${time_rfc3339_nano}","level":"${level}","prefix":"${prefix}"}`
+
+// Logger is an echo.Logger writing every log line as a JSON object, including its fields.
+// Values logged with the *j methods are merged into the line, errors are logged as their message.
+type Logger struct {
+	*log.Logger
+	fields log.JSON
+}
+
+// New returns a Logger writing lines at or above the level to output.
+func New(prefix string, level log.Lvl, output io.Writer) *Logger {
+	logger := log.New(prefix)
+	logger.SetHeader(header)
+	logger.SetLevel(level)
+	logger.SetOutput(output)
+	return &Logger{Logger: logger}
+}
+
+// With returns a Logger adding the fields to every line, sharing the level and output of this one.
+func (l *Logger) With(fields log.JSON) *Logger {
+	merged := make(log.JSON, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{Logger: l.Logger, fields: merged}
+}
+
+// StdLogger returns a standard library logger writing errors through this one, e.g. for http.Server.
+func (l *Logger) StdLogger() *stdlog.Logger {
+	return stdlog.New(writer{l}, "", 0)
+}
+
+type writer struct {
+	l *Logger
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	w.l.Logger.Errorj(w.l.line(log.JSON{"message": string(trimNewline(p))}))
+	return len(p), nil
+}
+
+func trimNewline(p []byte) []byte {
+	if len(p) > 0 && p[len(p)-1] == '\n' {
+		return p[:len(p)-1]
+	}
+	return p
+}
+
+// line merges the fields, the caller of the Logger method and j.
+func (l *Logger) line(j log.JSON) log.JSON {
+	merged := make(log.JSON, len(l.fields)+len(j)+1)
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	// line is called by a Logger method, called by the caller.
+	if _, file, line, ok := runtime.Caller(2); ok {
+		merged["caller"] = path.Base(file) + ":" + strconv.Itoa(line)
+	}
+	for k, v := range j {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+func message(i []interface{}) log.JSON {
+	return log.JSON{"message": fmt.Sprint(i...)}
+}
+
+func messagef(format string, args []interface{}) log.JSON {
+	return log.JSON{"message": fmt.Sprintf(format, args...)}
+}
+
+// Print implements echo.Logger.
+func (l *Logger) Print(i ...interface{}) { l.Logger.Printj(l.line(message(i))) }
+
+// Printf implements echo.Logger.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.Logger.Printj(l.line(messagef(format, args)))
+}
+
+// Printj implements echo.Logger.
+func (l *Logger) Printj(j log.JSON) { l.Logger.Printj(l.line(j)) }
+
+// Debug implements echo.Logger.
+func (l *Logger) Debug(i ...interface{}) {
+	if l.Level() <= log.DEBUG {
+		l.Logger.Debugj(l.line(message(i)))
+	}
+}
+
+// Debugf implements echo.Logger.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.Level() <= log.DEBUG {
+		l.Logger.Debugj(l.line(messagef(format, args)))
+	}
+}
+
+// Debugj implements echo.Logger.
+func (l *Logger) Debugj(j log.JSON) {
+	if l.Level() <= log.DEBUG {
+		l.Logger.Debugj(l.line(j))
+	}
+}
+
+// Info implements echo.Logger.
+func (l *Logger) Info(i ...interface{}) { l.Logger.Infoj(l.line(message(i))) }
+
+// Infof implements echo.Logger.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Logger.Infoj(l.line(messagef(format, args)))
+}
+
+// Infoj implements echo.Logger.
+func (l *Logger) Infoj(j log.JSON) { l.Logger.Infoj(l.line(j)) }
+
+// Warn implements echo.Logger.
+func (l *Logger) Warn(i ...interface{}) { l.Logger.Warnj(l.line(message(i))) }
+
+// Warnf implements echo.Logger.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnj(l.line(messagef(format, args)))
+}
+
+// Warnj implements echo.Logger.
+func (l *Logger) Warnj(j log.JSON) { l.Logger.Warnj(l.line(j)) }
+
+// Error implements echo.Logger.
+func (l *Logger) Error(i ...interface{}) { l.Logger.Errorj(l.line(message(i))) }
+
+// Errorf implements echo.Logger.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorj(l.line(messagef(format, args)))
+}
+
+// Errorj implements echo.Logger.
+func (l *Logger) Errorj(j log.JSON) { l.Logger.Errorj(l.line(j)) }
+
+// Fatal implements echo.Logger.
+func (l *Logger) Fatal(i ...interface{}) { l.Logger.Fatalj(l.line(message(i))) }
+
+// Fatalf implements echo.Logger.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.Logger.Fatalj(l.line(messagef(format, args)))
+}
+
+// Fatalj implements echo.Logger.
+func (l *Logger) Fatalj(j log.JSON) { l.Logger.Fatalj(l.line(j)) }
+
+// Panic implements echo.Logger.
+func (l *Logger) Panic(i ...interface{}) { l.Logger.Panicj(l.line(message(i))) }
+
+// Panicf implements echo.Logger.
+func (l *Logger) Panicf(format string, args ...interface{}) {
+	l.Logger.Panicj(l.line(messagef(format, args)))
+}
+
+// Panicj implements echo.Logger.
+func (l *Logger) Panicj(j log.JSON) { l.Logger.Panicj(l.line(j)) }
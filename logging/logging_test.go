@@ -0,0 +1,162 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/cycraig/scpbattle/logging"
+)
+
+// lines decodes every JSON log line written to buf.
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var decoded []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var j map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &j); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", line, err)
+		}
+		decoded = append(decoded, j)
+	}
+	return decoded
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New("test", log.INFO, &buf)
+	reqLogger := logger.With(log.JSON{"request_id": "abc"})
+
+	reqLogger.Debug("not logged")
+	reqLogger.Infof("Hello %s", "world")
+	reqLogger.Errorj(log.JSON{"message": "failed", "error": errors.New("boom"), "seq": 3})
+	logger.Warn("no request")
+
+	logged := lines(t, &buf)
+	if len(logged) != 3 {
+		t.Fatalf("Expected 3 lines, got %d: %s", len(logged), buf.String())
+	}
+	if logged[0]["message"] != "Hello world" || logged[0]["level"] != "INFO" || logged[0]["request_id"] != "abc" || logged[0]["prefix"] != "test" {
+		t.Errorf("Unexpected line %v", logged[0])
+	}
+	if caller, _ := logged[0]["caller"].(string); !strings.HasPrefix(caller, "logging_test.go:") {
+		t.Errorf("Expected the caller in logging_test.go, got %q", caller)
+	}
+	if logged[1]["error"] != "boom" || logged[1]["seq"] != 3.0 || logged[1]["level"] != "ERROR" {
+		t.Errorf("Unexpected line %v", logged[1])
+	}
+	if _, ok := logged[2]["request_id"]; ok {
+		t.Errorf("Fields of derived loggers leaked into the parent: %v", logged[2])
+	}
+
+	buf.Reset()
+	logger.StdLogger().Println("http: TLS handshake error")
+	logged = lines(t, &buf)
+	if len(logged) != 1 || logged[0]["message"] != "http: TLS handshake error" || logged[0]["level"] != "ERROR" {
+		t.Errorf("Unexpected standard library log lines %v", logged)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New("test", log.INFO, &buf)
+	hasher := logging.NewIPHasher("key")
+	e := echo.New()
+	e.Pre(logging.Middleware(logger, hasher))
+	var seenID string
+	e.GET("/", func(c echo.Context) error {
+		seenID = logging.RequestID(c)
+		c.Logger().Info("handled")
+		return c.String(http.StatusOK, "ok")
+	})
+
+	tests := []struct {
+		header   string
+		expected string // empty if a new ID should be generated
+	}{
+		{"", ""},
+		{"upstream-id_1.2:3", "upstream-id_1.2:3"},
+		{"has spaces", ""},
+		{"<script>", ""},
+		{strings.Repeat("a", 65), ""},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		if test.header != "" {
+			req.Header.Set(echo.HeaderXRequestID, test.header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		id := rec.Header().Get(echo.HeaderXRequestID)
+		if test.expected != "" && id != test.expected {
+			t.Errorf("Expected request ID %q to be propagated, got %q", test.expected, id)
+		}
+		if test.expected == "" && (len(id) != 32 || id == test.header) {
+			t.Errorf("Expected a generated request ID instead of %q, got %q", test.header, id)
+		}
+		if seenID != id {
+			t.Errorf("Handler saw request ID %q, response has %q", seenID, id)
+		}
+		logged := lines(t, &buf)
+		if len(logged) != 2 {
+			t.Fatalf("Expected 2 lines, got %d: %s", len(logged), buf.String())
+		}
+		for _, line := range logged {
+			if line["request_id"] != id {
+				t.Errorf("Expected request ID %q in %v", id, line)
+			}
+		}
+		access := logged[1]
+		if access["message"] != "request" || access["status"] != 200.0 || access["method"] != "GET" || access["client"] != hasher.Hash("203.0.113.7") {
+			t.Errorf("Unexpected access log line %v", access)
+		}
+		if strings.Contains(buf.String(), "203.0.113.7") {
+			t.Errorf("Client IP address logged: %s", buf.String())
+		}
+	}
+}
+
+func TestMiddlewareError(t *testing.T) {
+	var buf bytes.Buffer
+	e := echo.New()
+	e.Pre(logging.Middleware(logging.New("test", log.INFO, &buf), logging.NewIPHasher("key")))
+	e.GET("/", func(c echo.Context) error {
+		return errors.New("database unavailable")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	logged := lines(t, &buf)
+	if len(logged) != 1 {
+		t.Fatalf("Expected 1 line, got %d: %s", len(logged), buf.String())
+	}
+	if logged[0]["status"] != 500.0 || logged[0]["level"] != "ERROR" || logged[0]["error"] != "database unavailable" {
+		t.Errorf("Unexpected access log line %v", logged[0])
+	}
+}
+
+func TestIPHasher(t *testing.T) {
+	hasher := logging.NewIPHasher("key")
+	hash := hasher.Hash("203.0.113.7")
+	if len(hash) != 16 || hash != hasher.Hash("203.0.113.7") {
+		t.Errorf("Expected a stable 16 character hash, got %q", hash)
+	}
+	if hash == hasher.Hash("203.0.113.8") {
+		t.Error("Different addresses have the same hash")
+	}
+	if hash == logging.NewIPHasher("other").Hash("203.0.113.7") || hash == logging.NewIPHasher("").Hash("203.0.113.7") {
+		t.Error("Different keys give the same hash")
+	}
+}
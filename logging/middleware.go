@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Context keys set by Middleware.
+const (
+	requestIDKey = "request_id"
+	clientKey    = "client"
+)
+
+// maxRequestIDLength is the longest request ID accepted from the X-Request-ID header.
+const maxRequestIDLength = 64
+
+// IPHasher pseudonymises client IP addresses for logs, with a keyed hash so that the addresses
+// cannot be recovered by hashing every possible address.
+type IPHasher struct {
+	key []byte
+}
+
+// NewIPHasher returns an IPHasher with the key, or a random key if it is empty, in which case
+// the same address hashes differently after a restart and on other instances.
+func NewIPHasher(key string) *IPHasher {
+	if key == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		return &IPHasher{key: random}
+	}
+	return &IPHasher{key: []byte(key)}
+}
+
+// Hash returns the hex-encoded hash of the IP address, truncated to 16 characters.
+func (h *IPHasher) Hash(ip string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Middleware assigns every request an ID, taken from the X-Request-ID header if it is valid and
+// generated otherwise, and returns it in the X-Request-ID response header. The request's logger
+// (c.Logger()) adds the request ID to every line, and every request is logged once it is handled,
+// with the hashed client IP address instead of the address itself.
+func Middleware(logger *Logger, hasher *IPHasher) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				id = newRequestID()
+				// Handlers and other middleware see the same ID.
+				req.Header.Set(echo.HeaderXRequestID, id)
+			}
+			client := hasher.Hash(c.RealIP())
+			c.Set(requestIDKey, id)
+			c.Set(clientKey, client)
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			reqLogger := logger.With(log.JSON{"request_id": id})
+			c.SetLogger(reqLogger)
+
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil && !c.Response().Committed {
+				// The error handler writes the response after the middleware returns.
+				status = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					status = he.Code
+				}
+			}
+			j := log.JSON{
+				"message":    "request",
+				"method":     req.Method,
+				"uri":        req.RequestURI,
+				"status":     status,
+				"latency_ms": float64(time.Since(start).Microseconds()) / 1000.0,
+				"bytes_out":  c.Response().Size,
+				"client":     client,
+				"user_agent": req.UserAgent(),
+			}
+			if err != nil {
+				j["error"] = err
+			}
+			if status >= http.StatusInternalServerError {
+				reqLogger.Errorj(j)
+			} else {
+				reqLogger.Infoj(j)
+			}
+			return err
+		}
+	}
+}
+
+// RequestID returns the ID of the request assigned by Middleware, empty if none.
+func RequestID(c echo.Context) string {
+	id, _ := c.Get(requestIDKey).(string)
+	return id
+}
+
+// Client returns the hashed client IP address of the request from Middleware, empty if none.
+func Client(c echo.Context) string {
+	client, _ := c.Get(clientKey).(string)
+	return client
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == ':'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"html/template"
-	"io"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/jpillora/ipfilter"
@@ -16,27 +17,20 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 
-	"github.com/cycraig/scpbattle/db"
+	"github.com/cycraig/scpbattle/asset"
+	"github.com/cycraig/scpbattle/ballot"
+	"github.com/cycraig/scpbattle/config"
 	"github.com/cycraig/scpbattle/handler"
-	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/logging"
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/cycraig/scpbattle/render"
+	"github.com/cycraig/scpbattle/security"
+	"github.com/cycraig/scpbattle/session"
 	"github.com/cycraig/scpbattle/store"
 )
 
-// TemplateRegistry holds a map of named HTML templates.
-type TemplateRegistry struct {
-	templates map[string]*template.Template
-}
-
-// Render applies the specified named HTML template with the given data.
-func (t *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	tmpl, ok := t.templates[name]
-	if !ok {
-		err := errors.New("Template not found: " + name)
-		fmt.Println("Template not found: " + name)
-		return err
-	}
-	return tmpl.ExecuteTemplate(w, "base", data)
-}
+// sessionPurgeInterval is how often expired sessions are deleted along with their votes.
+const sessionPurgeInterval = time.Hour
 
 // Clacks "Do you not know that a man is not dead while his name is still spoken?"
 // Adds the X-Clacks-Overhead header to HTTP responses.
@@ -49,148 +43,358 @@ func Clacks(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 // CacheControlHeaders middleware adds the Cache-Control header when serving certain static files in Echo.
-func CacheControlHeaders(next echo.HandlerFunc) echo.HandlerFunc {
-	shortCacheMaxAge := 86400   // 1 day
-	longCacheMaxAge := 31536000 // 1 year
+// Images and stylesheets are cached for shortMaxAge and fonts for longMaxAge, a zero max-age disables caching.
+func CacheControlHeaders(shortMaxAge time.Duration, longMaxAge time.Duration) echo.MiddlewareFunc {
+	shortCacheMaxAge := int(shortMaxAge.Seconds())
+	longCacheMaxAge := int(longMaxAge.Seconds())
 	shortCacheableExts := []string{".ico", ".jpg", ".jpeg", ".png", ".svg", ".css"}
 	longCacheableExts := []string{".eot", ".ttf", ".woff", ".woff2"}
-	return func(c echo.Context) error {
-		uri := c.Request().RequestURI
-		cacheMaxAge := 0
-		// TODO: it might be faster to traverse a trie (containing reversed extensions)
-		// or hashmaps of all the extensions of the same length.
-		// With such few extensions it's fine for now, need to do benchmarks to see if it's worthwhile.
-		for _, ext := range shortCacheableExts {
-			if strings.HasSuffix(uri, ext) {
-				cacheMaxAge = shortCacheMaxAge
-				break
-			}
-		}
-		if cacheMaxAge == 0 {
-			for _, ext := range longCacheableExts {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			uri := c.Request().RequestURI
+			cacheMaxAge := 0
+			// TODO: it might be faster to traverse a trie (containing reversed extensions)
+			// or hashmaps of all the extensions of the same length.
+			// With such few extensions it's fine for now, need to do benchmarks to see if it's worthwhile.
+			for _, ext := range shortCacheableExts {
 				if strings.HasSuffix(uri, ext) {
-					cacheMaxAge = longCacheMaxAge
+					cacheMaxAge = shortCacheMaxAge
 					break
 				}
 			}
+			if cacheMaxAge == 0 {
+				for _, ext := range longCacheableExts {
+					if strings.HasSuffix(uri, ext) {
+						cacheMaxAge = longCacheMaxAge
+						break
+					}
+				}
+			}
+			if cacheMaxAge != 0 {
+				c.Response().Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", cacheMaxAge))
+			}
+			err := next(c)
+			return err
 		}
-		if cacheMaxAge != 0 {
-			c.Response().Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", cacheMaxAge))
-		}
-		err := next(c)
-		return err
 	}
 }
 
-// GzipSkipper for the Echo Gzip middleware skips compressing common image files.
-func GzipSkipper(c echo.Context) bool {
-	uri := c.Request().RequestURI
+// GzipSkipper returns a Skipper for the Echo Gzip middleware skipping common image files, which are
+// compressed already, and the static files served precompressed by the manifest, if any.
+func GzipSkipper(manifest *asset.Manifest) middleware.Skipper {
 	excludeExts := []string{".ico", ".jpg", ".jpeg", ".png"}
-	for _, ext := range excludeExts {
-		if strings.HasSuffix(uri, ext) {
+	return func(c echo.Context) bool {
+		if manifest != nil && manifest.Skipper(c) {
 			return true
 		}
+		uri := c.Request().RequestURI
+		for _, ext := range excludeExts {
+			if strings.HasSuffix(uri, ext) {
+				return true
+			}
+		}
+		return false
 	}
-	return false
 }
 
-func filterIP(next echo.HandlerFunc) echo.HandlerFunc {
+// filterIP refuses requests from blocked IP addresses, counting them in the metrics.
+func filterIP(m *handler.Metrics) echo.MiddlewareFunc {
 	// TODO: implement a radix tree / ART to perform CIDR lookups...
 	filter := ipfilter.New(ipfilter.Options{
 		BlockedCountries: []string{"CN"},
 		BlockedIPs:       []string{"146.141.0.0/16"},
 		BlockByDefault:   false,
 	})
-	return func(c echo.Context) error {
-		ipAddr := c.RealIP()
-		if !filter.Allowed(ipAddr) {
-			return echo.NewHTTPError(http.StatusForbidden,
-				fmt.Sprintf("Blocked IP address %s", ipAddr))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ipAddr := c.RealIP()
+			if !filter.Allowed(ipAddr) {
+				m.BlockedRequest()
+				// The address isn't in the message, which is logged: the log line has the hashed client instead.
+				return handler.ErrBlockedIP
+			}
+			err := next(c)
+			return err
 		}
-		err := next(c)
-		return err
 	}
 }
 
 func main() {
+	os.Exit(run(os.Args[0], os.Args[1:]))
+}
+
+// serve runs the web server until it is interrupted or receives SIGTERM, and returns the exit code.
+func serve(cfg *config.Config) int {
 	// Echo instance
 	e := echo.New()
 
-	e.Debug = true
+	e.Debug = cfg.Server.Debug
 	e.IPExtractor = echo.ExtractIPFromXFFHeader() // Heroku uses x-forwarded-for
+	// Only JSON log lines are written to stdout, without the banner.
+	logger := logging.New("echo", logLevel(cfg.Server.LogLevel), os.Stdout)
+	e.Logger = logger
+	e.StdLogger = logger.StdLogger()
+	e.HideBanner = true
+	e.HidePort = true
 
-	// Using a map of template files instead of parseGlob because template
-	// definitions overwrite each other, e.g. body will be overwritten by
-	// the html template parsed last.
-	templates := make(map[string]*template.Template)
-	// renderer := &TemplateRenderer{
-	// 	templates: template.Must(template.ParseGlob(path.Join("view", "*.html"))),
-	// }
-	templates["vote.html"] = template.Must(template.ParseFiles(path.Join("view", "vote.html"), path.Join("view", "base.html")))
-	templates["rankings.html"] = template.Must(template.ParseFiles(path.Join("view", "rankings.html"), path.Join("view", "base.html")))
-	templates["error.html"] = template.Must(template.ParseFiles(path.Join("view", "error.html"), path.Join("view", "base.html")))
-	templates["about.html"] = template.Must(template.ParseFiles(path.Join("view", "about.html"), path.Join("view", "base.html")))
-	e.Renderer = &TemplateRegistry{
-		templates: templates,
+	views, static := assets(cfg.Server.Dev)
+	if cfg.Server.Dev {
+		e.Logger.Warn("Development mode, serving templates and static files from the working directory")
+	}
+	// Static files are fingerprinted on startup, except in development mode since they change while running.
+	var manifest *asset.Manifest
+	var staticURLs render.Assets
+	if !cfg.Server.Dev {
+		var err error
+		if manifest, err = asset.NewManifest(static); err != nil {
+			e.Logger.Errorj(log.JSON{"message": "Error fingerprinting static files", "error": err})
+			return exitError
+		}
+		staticURLs = manifest
 	}
+	renderer, err := newRenderer(views, staticURLs, cfg.Server.Dev)
+	if err != nil {
+		e.Logger.Errorj(log.JSON{"message": "Error loading templates", "error": err})
+		return exitError
+	}
+	e.Renderer = renderer
 	e.HTTPErrorHandler = handler.HTTPErrorHandler
-	e.Logger.SetLevel(log.DEBUG)
 
-	// Middleware
-	e.Pre(middleware.Logger())
+	// Metrics, only available from the allowed networks or with the token
+	metricsNetworks, err := handler.ParseNetworks(cfg.Metrics.AllowedNetworks)
+	if err != nil {
+		e.Logger.Errorj(log.JSON{"message": "Invalid metrics.allowedNetworks", "error": err})
+		return exitUsage
+	}
+	m := handler.NewMetrics(metricsNetworks, cfg.Metrics.Token)
+
+	// Middleware, logging first so that every other middleware logs with the request ID
+	e.Pre(logging.Middleware(logger, logging.NewIPHasher(cfg.Server.LogIPHashKey)))
 	e.Pre(middleware.Recover())
 	e.Pre(middleware.RemoveTrailingSlash())
-	e.Pre(filterIP)
-	e.Use(middleware.BodyLimit("1M"))
+	e.Pre(filterIP(m))
+	e.Use(m.Middleware)
+	e.Use(middleware.BodyLimit(cfg.Server.BodyLimit))
 	e.Use(Clacks)
+	e.Use(security.Middleware(security.Config{HSTSMaxAge: cfg.Server.HSTSMaxAge}))
 	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
-		Skipper: GzipSkipper,
-		Level:   5,
+		Skipper: GzipSkipper(manifest),
+		Level:   cfg.Server.GzipLevel,
+	}))
+	e.Use(CacheControlHeaders(cfg.Server.ShortCacheMaxAge, cfg.Server.LongCacheMaxAge))
+	if manifest != nil {
+		// Serves the static files precompressed, with fingerprinted URLs cached for a year instead.
+		e.Use(manifest.Middleware)
+	}
+	e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
+		Root:       ".",
+		Filesystem: http.FS(static),
 	}))
-	e.Use(CacheControlHeaders)
-	e.Use(middleware.Static("static"))
+	// After the static files, which don't need the CSRF cookie
+	e.Use(security.CSRF(security.CSRFConfig{CookieSecure: cfg.Server.SecureCookies}))
 
-	// Initialise database
-	dbURL := os.Getenv("DATABASE_URL")
+	// Initialise the store
 	var d *gorm.DB
-	if dbURL == "" {
-		d = db.NewDB("sqlite3", "data.db", true)
-	} else {
-		d = db.NewDB("postgres", dbURL, false)
-	}
-	defer d.Close()
-	scpCache := store.NewSCPCache(store.NewSCPStore(d))
-	h := handler.NewHandler(scpCache, "images/")
-
-	// Populate example data
-	// TODO: replace this
-	scpCache.Create(model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"))
-	scpCache.Create(model.NewSCP("SCP-055", "Not a Sphere?", "scp_055.jpg", "http://www.scp-wiki.net/scp-055"))
-	scpCache.Create(model.NewSCP("SCP-087", "The Stairwell", "scp_087.jpg", "http://www.scp-wiki.net/scp-087"))
-	scpCache.Create(model.NewSCP("SCP-093", "Red Sea Object", "scp_093.jpg", "http://www.scp-wiki.net/scp-093"))
-	scpCache.Create(model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"))
-	scpCache.Create(model.NewSCP("SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106"))
-	scpCache.Create(model.NewSCP("SCP-173", "The Sculpture", "scp_173.jpg", "http://www.scp-wiki.net/scp-173"))
-	scpCache.Create(model.NewSCP("SCP-610", "The Flesh that Hates", "scp_610.jpg", "http://www.scp-wiki.net/scp-610"))
-	scpCache.Create(model.NewSCP("SCP-682", "The Hard-To-Destroy Reptile", "scp_682.jpg", "http://www.scp-wiki.net/scp-682"))
-	scpCache.Create(model.NewSCP("SCP-939", "With Many Voices", "scp_939.jpg", "http://www.scp-wiki.net/scp-939"))
-	scpCache.Create(model.NewSCP("●●|●●●●●|●●|●", "", "scp_2521.jpg", "http://www.scp-wiki.net/scp-2521"))
-	scpCache.Create(model.NewSCP("SCP-3000", "Anantashesha", "scp_3000.jpg", "http://www.scp-wiki.net/scp-3000"))
-	scpCache.Create(model.NewSCP("SCP-3001", "Red Reality", "scp_3001.jpg", "http://www.scp-wiki.net/scp-3001"))
-	scpCache.Create(model.NewSCP("SCP-____-J", "Procrastinati", "scp_j.jpg", "http://www.scp-wiki.net/scp-j"))
+	var notifier store.CatalogueNotifier
+	var scpStore store.SCPRepository
+	var sessionStore store.SessionRepository
+	switch cfg.Database.Store {
+	case "memory":
+		e.Logger.Warn("Using the in-memory store, votes will be lost on exit")
+		memoryStore := store.NewMemorySCPStore()
+		scpStore = memoryStore
+		sessionStore = memoryStore.Sessions()
+	case "database":
+		d, err = openDatabase(cfg)
+		if err != nil {
+			e.Logger.Error(err)
+			return exitError
+		}
+		scpStore = store.NewSCPStore(d)
+		sessionStore = store.NewSessionStore(d)
+
+		// Keep the catalogue in sync with other instances sharing the database
+		notifier, err = newNotifier(cfg, d)
+		if err != nil {
+			e.Logger.Error(err)
+			d.Close()
+			return exitError
+		}
+	}
+	scpCache := store.NewSCPCacheWithDuration(scpStore, cfg.Cache.UpdateTTL, cfg.Cache.RankingTTL)
+	scpCache.SetLogger(e.Logger)
+	if notifier != nil {
+		scpCache.WatchCatalogue(notifier)
+	}
+	scpCache.StartFlusher(cfg.Cache.FlushInterval)
+
+	// Populate an empty catalogue with the example SCPs, see the seed command
+	if scps, err := scpStore.GetAllSCPs(); err == nil && len(scps) == 0 {
+		created, err := seed(scpCache.Create, exampleSCPs)
+		if err != nil {
+			e.Logger.Errorj(log.JSON{"message": "Error seeding example SCPs", "error": err})
+		}
+		e.Logger.Infof("Seeded %d example SCPs", created)
+	}
+
+	// Initialise the vote queue, replaying votes left in the write-ahead log by the last run
+	queueOpts := queue.DefaultOptions()
+	queueOpts.Dir = cfg.Votes.QueueDir
+	if d == nil {
+		// Votes for SCPs that are not persisted cannot be replayed by the next run.
+		queueOpts.Dir = ""
+	}
+	queueOpts.Capacity = cfg.Votes.QueueCapacity
+	queueOpts.Workers = cfg.Votes.QueueWorkers
+	votes, err := queue.NewVoteQueue(queueOpts, e.Logger)
+	if err == nil && votes.ID() != "" {
+		// Votes persisted by a flush before a crash are not applied again.
+		var applied []uint64
+		if applied, err = scpStore.GetAppliedVotes(votes.ID()); err == nil {
+			votes.SetApplied(applied)
+		}
+	}
+	if err != nil {
+		e.Logger.Error(err)
+		scpCache.StopFlusher()
+		closeStore(e.Logger, notifier, d)
+		return exitError
+	}
+	ballots := ballot.NewSigner(cfg.Votes.BallotKey, cfg.Votes.BallotTTL)
+	sessions := session.NewManager(sessionStore, session.Config{
+		Key:          cfg.Server.SessionKey,
+		MaxAge:       cfg.Server.SessionMaxAge,
+		CookieSecure: cfg.Server.SecureCookies,
+	})
+	h := handler.NewHandler(scpCache, votes, ballots, sessions, cfg.Server.ImageDir, staticURLs, cfg.Votes.EloK)
+	m.RegisterHandler(h)
+	votes.Start(func(vote queue.Vote) error {
+		err := h.ProcessVote(vote)
+		m.ObserveVote(vote, err)
+		return err
+	})
+	votes.StartCheckpoints(cfg.Cache.FlushInterval, persistVotes(votes, scpStore, scpCache.Flush))
+	sessions.StartPurging(sessionPurgeInterval, e.Logger)
 
 	// Routes
 	e.GET("/", h.VotePageHandler)
-	e.POST("/vote", h.VoteHandler)
+	e.POST("/vote", h.VoteHandler, sessions.Middleware)
+	e.GET("/api/next", h.NextMatchupHandler)
 	e.GET("/healthz", h.HealthCheckHandler)
+	e.GET("/livez", h.LivenessHandler)
+	e.GET("/readyz", h.ReadinessHandler)
+	e.GET("/metrics", m.MetricsHandler)
 	e.GET("/rankings", h.RankingsPageHandler)
 	e.GET("/about", h.AboutPageHandler)
+	e.GET("/me", h.MePageHandler, sessions.Middleware)
+	e.POST("/me/revoke", h.MeRevokeHandler, sessions.Middleware)
+	e.POST("/me/delete", h.MeDeleteHandler, sessions.Middleware)
+	e.GET("/compare", h.ComparePageHandler)
+	e.GET("/api/compare", h.CompareAPIHandler)
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		// local development
-		port = "1323"
+	e.Logger.Infoj(log.JSON{"message": "Starting server", "port": cfg.Server.Port})
+	go func() {
+		if err := e.Start(":" + strconv.Itoa(cfg.Server.Port)); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	// Wait for an interrupt or SIGTERM (sent on every Heroku restart) to shut down gracefully.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	// Fail readiness checks first, giving load balancers time to stop routing requests here.
+	h.SetDraining()
+	e.Logger.Infof("Draining for %s before shutting down", cfg.Server.ShutdownDrainDelay)
+	time.Sleep(cfg.Server.ShutdownDrainDelay)
+	sessions.StopPurging()
+	shutdown(e, votes, scpStore, scpCache, notifier, d, cfg.Server.ShutdownTimeout)
+	return exitOK
+}
+
+// persistVotes returns the persist function of the vote queue's checkpoints: flush writes the cached votes
+// back, recording them as applied, then the records of votes deleted by earlier checkpoints are deleted.
+func persistVotes(votes *queue.VoteQueue, scpStore store.SCPRepository, flush func() error) func() error {
+	return func() error {
+		if err := flush(); err != nil {
+			return err
+		}
+		return forgetAppliedVotes(votes, scpStore)
+	}
+}
+
+// forgetAppliedVotes deletes the records of the votes deleted from the write-ahead log by checkpoints,
+// which can no longer be replayed.
+func forgetAppliedVotes(votes *queue.VoteQueue, scpStore store.SCPRepository) error {
+	if votes.ID() == "" || votes.Truncated() == 0 {
+		return nil
+	}
+	return scpStore.ForgetAppliedVotes(votes.ID(), votes.Truncated())
+}
+
+// logLevel returns the gommon log level of a validated server.logLevel.
+func logLevel(level string) log.Lvl {
+	switch level {
+	case "debug":
+		return log.DEBUG
+	case "warn":
+		return log.WARN
+	case "error":
+		return log.ERROR
+	case "off":
+		return log.OFF
+	default:
+		return log.INFO
+	}
+}
+
+// shutdown stops accepting requests, drains the vote queue and writes cached changes back
+// to the database before closing it (if any). Anything not finished within the timeout is abandoned,
+// queued votes are kept in the write-ahead log in that case.
+func shutdown(e *echo.Echo, votes *queue.VoteQueue, scpStore store.SCPRepository, scpCache *store.SCPCache, notifier store.CatalogueNotifier, d *gorm.DB, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	e.Logger.Infof("Shutting down (timeout %s)", timeout)
+
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Errorj(log.JSON{"message": "Error stopping server", "error": err})
+	}
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		if err := votes.Close(); err != nil {
+			e.Logger.Errorj(log.JSON{"message": "Error closing vote queue", "error": err})
+		}
+		scpCache.StopFlusher()
+		scps, matchups := scpCache.DirtyCount()
+		if err := votes.Checkpoint(scpCache.SynchroniseThenInvalidate); err != nil {
+			e.Logger.Errorj(log.JSON{"message": "Error flushing cache", "error": err})
+			return
+		}
+		if err := forgetAppliedVotes(votes, scpStore); err != nil {
+			e.Logger.Errorj(log.JSON{"message": "Error deleting records of applied votes", "error": err})
+		}
+		e.Logger.Infof("Flushed %d SCPs and %d matchups to the store", scps, matchups)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		e.Logger.Error("Shutdown timed out, unflushed votes have been lost")
+	}
+	closeStore(e.Logger, notifier, d)
+}
+
+// closeStore closes the catalogue notifier and database, if any.
+func closeStore(logger echo.Logger, notifier store.CatalogueNotifier, d *gorm.DB) {
+	if notifier != nil {
+		if err := notifier.Close(); err != nil {
+			logger.Errorj(log.JSON{"message": "Error closing catalogue notifier", "error": err})
+		}
+	}
+	if d != nil {
+		if err := d.Close(); err != nil {
+			logger.Errorj(log.JSON{"message": "Error closing database", "error": err})
+		}
 	}
-	e.Logger.Fatal(e.Start(":" + port))
 }
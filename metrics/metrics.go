@@ -0,0 +1,354 @@
+// Package metrics implements the few Prometheus metric types the server needs, exposed in the
+// Prometheus text exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format written by Registry.WriteTo.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets (in seconds) suitable for request and processing latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics in the order they were registered.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (registry *Registry) register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.names[m.name()] {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	registry.names[m.name()] = true
+	registry.metrics = append(registry.metrics, m)
+}
+
+// WriteTo writes all metrics to w in the text exposition format.
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.lock.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.lock.Unlock()
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type desc struct {
+	metricName string
+	help       string
+	metricType string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, d.metricType)
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames []string, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labelName)
+			w.WriteString(`="`)
+			w.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(labelValues[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	desc
+	lock  sync.Mutex
+	value float64
+}
+
+// NewCounter registers a new Counter.
+func (registry *Registry) NewCounter(name string, help string) *Counter {
+	counter := &Counter{desc: desc{metricName: name, help: help, metricType: "counter"}}
+	registry.register(counter)
+	return counter
+}
+
+// Inc adds one to the counter.
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+// Add adds the non-negative delta to the counter.
+func (counter *Counter) Add(delta float64) {
+	counter.lock.Lock()
+	counter.value += delta
+	counter.lock.Unlock()
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.lock.Lock()
+	value := counter.value
+	counter.lock.Unlock()
+	counter.writeHeader(w)
+	writeSample(w, counter.metricName, nil, nil, value)
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	lock     sync.Mutex
+	counters map[string]*labelled
+}
+
+type labelled struct {
+	labelValues []string
+	value       float64
+	histogram   *histogramData // only for HistogramVec
+}
+
+// NewCounterVec registers a new CounterVec with the given label names.
+func (registry *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	vec := &CounterVec{
+		desc:     desc{metricName: name, help: help, metricType: "counter", labels: labels},
+		counters: make(map[string]*labelled),
+	}
+	registry.register(vec)
+	return vec
+}
+
+// Inc adds one to the counter with the given label values, in the order of the label names.
+func (vec *CounterVec) Inc(labelValues ...string) {
+	vec.Add(1, labelValues...)
+}
+
+// Add adds the non-negative delta to the counter with the given label values.
+func (vec *CounterVec) Add(delta float64, labelValues ...string) {
+	if len(labelValues) != len(vec.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", vec.metricName, len(vec.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	counter, ok := vec.counters[key]
+	if !ok {
+		counter = &labelled{labelValues: append([]string(nil), labelValues...)}
+		vec.counters[key] = counter
+	}
+	counter.value += delta
+}
+
+func (vec *CounterVec) write(w *bufio.Writer) {
+	vec.writeHeader(w)
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	for _, key := range sortedKeys(vec.counters) {
+		counter := vec.counters[key]
+		writeSample(w, vec.metricName, vec.labels, counter.labelValues, counter.value)
+	}
+}
+
+func sortedKeys(m map[string]*labelled) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Func is a counter or gauge whose value is read when the metrics are written,
+// e.g. to expose statistics that are already kept elsewhere.
+type Func struct {
+	desc
+	value func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by the function.
+func (registry *Registry) NewCounterFunc(name string, help string, value func() float64) *Func {
+	f := &Func{desc: desc{metricName: name, help: help, metricType: "counter"}, value: value}
+	registry.register(f)
+	return f
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by the function.
+func (registry *Registry) NewGaugeFunc(name string, help string, value func() float64) *Func {
+	f := &Func{desc: desc{metricName: name, help: help, metricType: "gauge"}, value: value}
+	registry.register(f)
+	return f
+}
+
+func (f *Func) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	writeSample(w, f.metricName, nil, nil, f.value())
+}
+
+// histogramData holds the observations of a single histogram.
+type histogramData struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (data *histogramData) observe(buckets []float64, value float64) {
+	for i, upper := range buckets {
+		if value <= upper {
+			data.counts[i]++
+			break
+		}
+	}
+	data.count++
+	data.sum += value
+}
+
+func (data *histogramData) write(w *bufio.Writer, d *desc, buckets []float64, labelValues []string) {
+	labelNames := append(append([]string(nil), d.labels...), "le")
+	var cumulative uint64
+	for i, upper := range buckets {
+		cumulative += data.counts[i]
+		writeSample(w, d.metricName+"_bucket", labelNames, append(append([]string(nil), labelValues...), formatFloat(upper)), float64(cumulative))
+	}
+	writeSample(w, d.metricName+"_bucket", labelNames, append(append([]string(nil), labelValues...), "+Inf"), float64(data.count))
+	writeSample(w, d.metricName+"_sum", d.labels, labelValues, data.sum)
+	writeSample(w, d.metricName+"_count", d.labels, labelValues, float64(data.count))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	data    histogramData
+}
+
+// NewHistogram registers a new Histogram with the given upper bounds of its buckets, in increasing order.
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		desc:    desc{metricName: name, help: help, metricType: "histogram"},
+		buckets: buckets,
+		data:    histogramData{counts: make([]uint64, len(buckets))},
+	}
+	registry.register(histogram)
+	return histogram
+}
+
+// Observe adds a single observation to the histogram.
+func (histogram *Histogram) Observe(value float64) {
+	histogram.lock.Lock()
+	histogram.data.observe(histogram.buckets, value)
+	histogram.lock.Unlock()
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.writeHeader(w)
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	histogram.data.write(w, &histogram.desc, histogram.buckets, nil)
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	lock       sync.Mutex
+	histograms map[string]*labelled
+}
+
+// NewHistogramVec registers a new HistogramVec with the given buckets and label names.
+func (registry *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	vec := &HistogramVec{
+		desc:       desc{metricName: name, help: help, metricType: "histogram", labels: labels},
+		buckets:    buckets,
+		histograms: make(map[string]*labelled),
+	}
+	registry.register(vec)
+	return vec
+}
+
+// Observe adds a single observation to the histogram with the given label values.
+func (vec *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(vec.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", vec.metricName, len(vec.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	histogram, ok := vec.histograms[key]
+	if !ok {
+		histogram = &labelled{
+			labelValues: append([]string(nil), labelValues...),
+			histogram:   &histogramData{counts: make([]uint64, len(vec.buckets))},
+		}
+		vec.histograms[key] = histogram
+	}
+	histogram.histogram.observe(vec.buckets, value)
+}
+
+func (vec *HistogramVec) write(w *bufio.Writer) {
+	vec.writeHeader(w)
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	for _, key := range sortedKeys(vec.histograms) {
+		histogram := vec.histograms[key]
+		histogram.histogram.write(w, &vec.desc, vec.buckets, histogram.labelValues)
+	}
+}
@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cycraig/scpbattle/metrics"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	votes := registry.NewCounter("votes_total", "Votes cast.")
+	requests := registry.NewCounterVec("requests_total", "Requests by route.", "route", "code")
+	registry.NewGaugeFunc("queue_depth", "Votes waiting.", func() float64 { return 3 })
+	latency := registry.NewHistogram("latency_seconds", "Vote latency.", []float64{0.1, 1})
+	durations := registry.NewHistogramVec("duration_seconds", "Request duration.", []float64{1}, "route")
+
+	votes.Inc()
+	votes.Add(2)
+	requests.Inc("/vote", "202")
+	requests.Inc("/", "200")
+	requests.Inc("/", "200")
+	requests.Inc(`/"quoted"`, "404")
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+	durations.Observe(0.5, "/")
+
+	var out strings.Builder
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP votes_total Votes cast.
+# TYPE votes_total counter
+votes_total 3
+# HELP requests_total Requests by route.
+# TYPE requests_total counter
+requests_total{route="/",code="200"} 2
+requests_total{route="/\"quoted\"",code="404"} 1
+requests_total{route="/vote",code="202"} 1
+# HELP queue_depth Votes waiting.
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP latency_seconds Vote latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/",le="1"} 1
+duration_seconds_bucket{route="/",le="+Inf"} 1
+duration_seconds_sum{route="/"} 0.5
+duration_seconds_count{route="/"} 1
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nExpected:\n%s", out.String(), expected)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a duplicate metric to panic")
+		}
+	}()
+	registry.NewCounter("votes_total", "Duplicate.")
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Admin is an account allowed to manage the SCP catalogue, created with the create-admin command.
+type Admin struct {
+	gorm.Model
+	Username     string `gorm:"unique_index;not null"`
+	PasswordHash string `gorm:"not null"` // bcrypt
+}
+
+// NewAdmin returns an Admin with the bcrypt hash of the password.
+func NewAdmin(username string, password string) (*Admin, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &Admin{
+		Username:     username,
+		PasswordHash: string(hash),
+	}, nil
+}
+
+// CheckPassword reports whether the password matches the admin's, in constant time.
+func (admin *Admin) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(admin.PasswordHash), []byte(password)) == nil
+}
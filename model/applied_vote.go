@@ -0,0 +1,9 @@
+package model
+
+// AppliedVote records that a vote from the write-ahead log of a vote queue has been persisted. It is
+// written in the same transaction as the changes of the vote, so that the vote is skipped if the log
+// is replayed after a crash. Records are deleted once the log no longer holds the vote.
+type AppliedVote struct {
+	WAL string `gorm:"primary_key"`                      // ID of the write-ahead log, see queue.VoteQueue.ID
+	Seq uint64 `gorm:"primary_key;auto_increment:false"` // sequence number of the vote in the log
+}
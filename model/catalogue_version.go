@@ -0,0 +1,8 @@
+package model
+
+// CatalogueVersion is a single row counting changes to the SCP catalogue (added or edited SCPs).
+// App instances poll it to notice changes made by other instances when LISTEN/NOTIFY is unavailable.
+type CatalogueVersion struct {
+	ID      uint `gorm:"primary_key;auto_increment:false"`
+	Version uint64
+}
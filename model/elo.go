@@ -0,0 +1,23 @@
+package model
+
+import (
+	"math"
+)
+
+// InitialRating is the Elo rating of a new SCP.
+const InitialRating = 1000.0
+
+// UpdateEloRatings records a win of winner over loser, moving their Elo ratings by at most k.
+func UpdateEloRatings(winner *SCP, loser *SCP, k float64) {
+	Pwinner := EloExpectedProbability(winner.Rating, loser.Rating)
+	Ploser := EloExpectedProbability(loser.Rating, winner.Rating)
+	winner.Rating += k * (1.0 - Pwinner)
+	loser.Rating += k * (0.0 - Ploser)
+	winner.Wins++
+	loser.Losses++
+}
+
+// EloExpectedProbability returns the probability of an SCP rated rating1 beating one rated rating2.
+func EloExpectedProbability(rating1 float64, rating2 float64) float64 {
+	return 1.0 / (1.0 + math.Pow(10.0, (rating2-rating1)/400.0))
+}
@@ -0,0 +1,46 @@
+package model
+
+// Matchup holds the head-to-head record between two SCPs.
+// Each pair is stored once with FirstID < SecondID, see NewMatchup.
+type Matchup struct {
+	FirstID    uint `gorm:"primary_key;auto_increment:false"`
+	SecondID   uint `gorm:"primary_key;auto_increment:false"`
+	FirstWins  uint64
+	SecondWins uint64
+}
+
+// NewMatchup returns an empty Matchup for the pair of SCP IDs in canonical order.
+func NewMatchup(id1 uint, id2 uint) *Matchup {
+	if id1 > id2 {
+		id1, id2 = id2, id1
+	}
+	return &Matchup{
+		FirstID:  id1,
+		SecondID: id2,
+	}
+}
+
+// Opponent returns the ID of the other SCP in the matchup.
+func (m *Matchup) Opponent(id uint) uint {
+	if id == m.FirstID {
+		return m.SecondID
+	}
+	return m.FirstID
+}
+
+// RecordFor returns the number of wins and losses of the SCP with the given ID in this matchup.
+func (m *Matchup) RecordFor(id uint) (wins uint64, losses uint64) {
+	if id == m.FirstID {
+		return m.FirstWins, m.SecondWins
+	}
+	return m.SecondWins, m.FirstWins
+}
+
+// AddWin records a single win for the SCP with the given ID.
+func (m *Matchup) AddWin(winnerID uint) {
+	if winnerID == m.FirstID {
+		m.FirstWins++
+	} else {
+		m.SecondWins++
+	}
+}
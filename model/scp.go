@@ -21,7 +21,7 @@ func NewSCP(name string, desc string, image string, link string) *SCP {
 		Description: desc,
 		Image:       image,
 		Link:        link,
-		Rating:      1000.0,
+		Rating:      InitialRating,
 		Wins:        0,
 		Losses:      0,
 	}
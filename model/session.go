@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+)
+
+// Session is an anonymous voter, identified by a signed cookie. There are no accounts: a session only
+// lasts as long as the cookie, or until it is revoked.
+type Session struct {
+	ID        string `gorm:"primary_key"` // random, see session.Manager
+	CreatedAt time.Time
+	RevokedAt *time.Time // nil while the session is valid
+}
+
+// VoteLog records a vote cast by a session. Votes are only logged for sessions, to show voters their
+// history; ratings only keep the totals. Votes are logged along with their changes to the ratings, see
+// store.SCPRepository.ApplyDeltas.
+type VoteLog struct {
+	ID        uint      `gorm:"primary_key"`
+	SessionID string    `gorm:"not null"`
+	WinnerID  uint      `gorm:"not null"`
+	LoserID   uint      `gorm:"not null"`
+	CreatedAt time.Time // when the vote was accepted
+	// WAL and Seq identify the vote in the write-ahead log of the vote queue, like AppliedVote, so that
+	// it is logged once even if the log is replayed. WAL is empty (NULL) if the queue isn't durable.
+	WAL string
+	Seq uint64
+}
@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt = ".wal"
+	idFile     = "id"
+)
+
+// segment is a single write-ahead log file holding one JSON-encoded vote per line.
+type segment struct {
+	path    string
+	records int            // votes in the segment, including those still being written, guarded by the queue's lock
+	last    uint64         // highest sequence number in the segment, guarded by the queue's lock
+	failed  int            // votes that failed to be processed, replayed on restart, guarded by the queue's lock
+	votes   []Vote         // only populated while loading a segment from disk
+	pending sync.WaitGroup // votes in this segment that have not been processed yet
+	writes  sync.WaitGroup // votes being appended, the file is only closed once they are written
+
+	lock     sync.Mutex // guards file, written, size and err
+	file     *os.File   // nil once closed
+	written  int        // votes written to the file
+	size     int64      // bytes of the votes written to the file
+	err      error      // set if a failed write could not be undone, no more votes are appended
+	syncLock sync.Mutex // serialises fsyncs, guards synced
+	synced   int        // votes written before the last fsync
+}
+
+func segmentName(firstSeq uint64) string {
+	// Zero-padded so segments sort in the order they were written.
+	return fmt.Sprintf("votes-%020d%s", firstSeq, segmentExt)
+}
+
+func createSegment(dir string, firstSeq uint64) (*segment, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, segmentName(firstSeq))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// loadSegments reads all segments in the directory in the order they were written.
+func loadSegments(dir string) ([]*segment, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	segments := make([]*segment, 0, len(names))
+	for _, name := range names {
+		seg := &segment{path: filepath.Join(dir, name)}
+		if err := seg.load(); err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func (seg *segment) load() error {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A final line without a newline is a write interrupted by a crash, that vote was never accepted.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var vote Vote
+		if err := json.Unmarshal(line, &vote); err != nil {
+			return fmt.Errorf("corrupt write-ahead log segment %s: %v", seg.path, err)
+		}
+		seg.votes = append(seg.votes, vote)
+		seg.records++
+		if vote.Seq > seg.last {
+			seg.last = vote.Seq
+		}
+	}
+}
+
+// append writes the vote to the segment, then syncs it to disk if sync is set. Concurrent appends are
+// committed as a group: a single fsync covers every vote written before it.
+// A failed write is truncated, since a partial line followed by other votes would corrupt the segment.
+func (seg *segment) append(vote Vote, sync bool) error {
+	line, err := json.Marshal(vote)
+	if err != nil {
+		return err
+	}
+	seg.lock.Lock()
+	if seg.err != nil {
+		seg.lock.Unlock()
+		return seg.err
+	}
+	n, err := seg.file.Write(append(line, '\n'))
+	if err != nil {
+		if truncateErr := seg.file.Truncate(seg.size); truncateErr != nil {
+			seg.err = fmt.Errorf("write-ahead log segment %s has a partial vote: %v", seg.path, truncateErr)
+		}
+		seg.lock.Unlock()
+		return err
+	}
+	seg.size += int64(n)
+	seg.written++
+	written := seg.written
+	seg.lock.Unlock()
+	if !sync {
+		return nil
+	}
+	seg.syncLock.Lock()
+	defer seg.syncLock.Unlock()
+	if seg.synced >= written {
+		// Synced by a concurrent append while waiting.
+		return nil
+	}
+	seg.lock.Lock()
+	written = seg.written
+	seg.lock.Unlock()
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	seg.synced = written
+	return nil
+}
+
+// close closes the file once the votes being appended have been written.
+func (seg *segment) close() error {
+	seg.writes.Wait()
+	seg.lock.Lock()
+	defer seg.lock.Unlock()
+	if seg.file == nil {
+		return nil
+	}
+	err := seg.file.Close()
+	seg.file = nil
+	return err
+}
+
+func (seg *segment) remove() error {
+	if err := seg.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadID returns the ID of the write-ahead log in the directory. A new ID is created if the log holds
+// no votes, since sequence numbers then start again from 1 and must not be confused with earlier ones.
+func loadID(dir string, empty bool) (string, error) {
+	path := filepath.Join(dir, idFile)
+	if !empty {
+		id, err := ioutil.ReadFile(path)
+		if err == nil && len(id) > 0 {
+			return string(id), nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		// Written by a release without IDs, nothing was recorded for its votes.
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(id); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", err
+	}
+	return id, file.Close()
+}
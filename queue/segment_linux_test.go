@@ -0,0 +1,74 @@
+package queue_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/cycraig/scpbattle/queue"
+)
+
+func TestVoteQueueFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueueFailedWrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, dir, 100)
+	if _, err := q.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "votes-00000000000000000001.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file size limit cuts the next vote short, as a full disk would.
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	short := limit
+	short.Cur = uint64(info.Size()) + 10
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &short); err != nil {
+		t.Skip("Cannot limit the file size:", err)
+	}
+	_, err = q.Enqueue(queue.Vote{WinnerID: 3, LoserID: 4})
+	if restoreErr := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if truncated, err := os.Stat(filepath.Join(dir, "votes-00000000000000000001.wal")); err != nil {
+		t.Fatal(err)
+	} else if truncated.Size() != info.Size() {
+		t.Errorf("Expected the partial vote to be truncated, the segment has %d bytes instead of %d", truncated.Size(), info.Size())
+	}
+
+	// Later votes are accepted, and every accepted vote is replayed by the next run.
+	for i := uint(5); i <= 6; i++ {
+		if _, err := q.Enqueue(queue.Vote{WinnerID: i, LoserID: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q = newTestQueue(t, dir, 100)
+	var replayed []uint64
+	q.Start(func(vote queue.Vote) error {
+		replayed = append(replayed, vote.Seq)
+		return nil
+	})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(replayed) != "[1 3 4]" {
+		t.Errorf("Expected the accepted votes to be replayed, got %v", replayed)
+	}
+}
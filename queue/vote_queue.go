@@ -0,0 +1,465 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue is at capacity; the client should retry later.
+	ErrQueueFull = errors.New("vote queue is full")
+	// ErrQueueClosed is returned by Enqueue once the queue has been closed for shutdown.
+	ErrQueueClosed = errors.New("vote queue is closed")
+	// ErrInvalidVote is wrapped by the errors of a ProcessFunc for votes that can never be applied, e.g.
+	// for a deleted SCP, which are dropped instead of being kept in the write-ahead log.
+	ErrInvalidVote = errors.New("invalid vote")
+)
+
+// Vote is a single accepted vote waiting to be applied.
+type Vote struct {
+	Seq       uint64    `json:"seq"` // increasing sequence number, unique within the write-ahead log
+	WinnerID  uint      `json:"winnerID"`
+	LoserID   uint      `json:"loserID"`
+	Accepted  time.Time `json:"accepted"`
+	RequestID string    `json:"requestID,omitempty"` // of the request casting the vote, for correlating logs
+	Client    string    `json:"client,omitempty"`    // hashed client IP address, see logging.IPHasher
+	Session   string    `json:"session,omitempty"`   // ID of the voter's session, if any, see session.Manager
+	Replayed  bool      `json:"-"`                   // accepted by an earlier run, replayed from the write-ahead log
+}
+
+// ProcessFunc applies a single vote, e.g. to the SCP cache. Votes it fails to apply, unless the error
+// wraps ErrInvalidVote, are kept in the write-ahead log to be replayed on restart, see Checkpoint.
+type ProcessFunc func(vote Vote) error
+
+// Logger is the subset of echo.Logger used by the queue.
+type Logger interface {
+	Debugj(j log.JSON)
+	Infoj(j log.JSON)
+	Errorj(j log.JSON)
+}
+
+// Options configures a VoteQueue.
+type Options struct {
+	Dir         string // directory holding the write-ahead log segments, empty disables durability
+	Capacity    int    // maximum number of votes waiting to be processed
+	Workers     int    // number of goroutines processing votes
+	SegmentSize int    // maximum number of votes per write-ahead log segment
+	SyncWrites  bool   // fsync every vote to disk before accepting it
+}
+
+// DefaultOptions returns the default VoteQueue options, logging to the "wal" directory.
+func DefaultOptions() Options {
+	return Options{
+		Dir:         "wal",
+		Capacity:    1000,
+		Workers:     4,
+		SegmentSize: 10000,
+		SyncWrites:  true,
+	}
+}
+
+// Stats describes the current state of a VoteQueue, e.g. for health checks and metrics.
+type Stats struct {
+	Depth          int           `json:"depth"`
+	Capacity       int           `json:"capacity"`
+	Accepted       uint64        `json:"accepted"`
+	Rejected       uint64        `json:"rejected"` // rejected because the queue was full
+	Processed      uint64        `json:"processed"`
+	Failed         uint64        `json:"failed"` // processed, but the ProcessFunc returned an error
+	Replayed       uint64        `json:"replayed"`
+	Skipped        uint64        `json:"skipped"`     // loaded from the write-ahead log but already persisted, see SetApplied
+	Segments       int           `json:"segments"`    // write-ahead log segments not yet checkpointed
+	LastLatency    time.Duration `json:"lastLatency"` // from accepting a vote until it was processed
+	AverageLatency time.Duration `json:"averageLatency"`
+	MaxLatency     time.Duration `json:"maxLatency"`
+}
+
+type pending struct {
+	vote    Vote
+	segment *segment // nil if durability is disabled
+}
+
+// VoteQueue is a bounded in-process queue of votes processed by a pool of workers.
+//
+// Accepted votes are appended to a write-ahead log before they are queued, so votes that were
+// not yet applied and persisted survive a crash or restart: they are replayed by Start.
+// Segments of the log are only deleted by Checkpoint, once their votes have been processed and
+// persisted, so delivery is at-least-once. Votes are identified by the ID of the log and their
+// sequence number, so that votes persisted before a crash can be skipped, see SetApplied.
+type VoteQueue struct {
+	opts     Options
+	logger   Logger
+	id       string
+	votes    chan *pending
+	process  ProcessFunc
+	workers  sync.WaitGroup
+	enqueues sync.WaitGroup // votes being written to the log, which are queued once written
+
+	lock      sync.Mutex // guards everything below
+	seq       uint64
+	reserved  int // space in the queue for votes being written to the log
+	closed    bool
+	active    *segment
+	sealed    []*segment
+	truncated uint64 // highest sequence number deleted from the log by Checkpoint
+	replayed  []*pending
+	stats     Stats
+	latency   time.Duration // total latency of all processed votes
+
+	checkpointLock sync.Mutex    // serialises checkpoints
+	checkpointStop chan struct{} // closed by Close to stop background checkpoints
+	checkpointDone chan struct{} // closed once background checkpoints have stopped
+}
+
+// NewVoteQueue creates a VoteQueue and loads any votes left in the write-ahead log by a previous run.
+// The loaded votes are processed by Start before any new votes.
+func NewVoteQueue(opts Options, logger Logger) (*VoteQueue, error) {
+	if opts.Capacity < 1 {
+		return nil, fmt.Errorf("invalid vote queue capacity: %d", opts.Capacity)
+	}
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("invalid number of vote queue workers: %d", opts.Workers)
+	}
+	if opts.SegmentSize < 1 {
+		opts.SegmentSize = DefaultOptions().SegmentSize
+	}
+	q := &VoteQueue{
+		opts:   opts,
+		logger: logger,
+		votes:  make(chan *pending, opts.Capacity),
+	}
+	q.stats.Capacity = opts.Capacity
+	if opts.Dir != "" {
+		segments, err := loadSegments(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range segments {
+			for _, vote := range seg.votes {
+				vote.Replayed = true
+				seg.pending.Add(1)
+				q.replayed = append(q.replayed, &pending{vote: vote, segment: seg})
+				if vote.Seq > q.seq {
+					q.seq = vote.Seq
+				}
+			}
+			seg.votes = nil
+		}
+		q.sealed = segments
+		if q.id, err = loadID(opts.Dir, len(q.replayed) == 0); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// ID returns the ID of the write-ahead log, which identifies votes along with their sequence numbers.
+// It is empty if durability is disabled.
+func (q *VoteQueue) ID() string {
+	return q.id
+}
+
+// SetApplied skips the votes with the given sequence numbers when replaying the write-ahead log, e.g.
+// votes recorded as persisted along with their changes before a crash. Must be called before Start.
+func (q *VoteQueue) SetApplied(seqs []uint64) {
+	applied := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		applied[seq] = true
+	}
+	replayed := q.replayed[:0]
+	for _, p := range q.replayed {
+		if applied[p.vote.Seq] {
+			p.segment.pending.Done()
+			q.stats.Skipped++
+			continue
+		}
+		replayed = append(replayed, p)
+	}
+	q.replayed = replayed
+}
+
+// Start processes the votes replayed from the write-ahead log, then starts the workers.
+func (q *VoteQueue) Start(process ProcessFunc) {
+	q.process = process
+	if len(q.replayed) > 0 || q.stats.Skipped > 0 {
+		q.logger.Infoj(log.JSON{"message": "Replaying votes from the write-ahead log", "votes": len(q.replayed), "skipped": q.stats.Skipped})
+	}
+	for _, p := range q.replayed {
+		q.apply(p)
+		q.lock.Lock()
+		q.stats.Replayed++
+		q.lock.Unlock()
+	}
+	q.replayed = nil
+	for i := 0; i < q.opts.Workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for p := range q.votes {
+				q.apply(p)
+			}
+		}()
+	}
+}
+
+func (q *VoteQueue) apply(p *pending) {
+	err := q.process(p.vote)
+	latency := time.Since(p.vote.Accepted)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if p.segment != nil {
+		// Counted before the vote is done, so that Checkpoint keeps the segment.
+		if err != nil && !errors.Is(err, ErrInvalidVote) {
+			p.segment.failed++
+		}
+		p.segment.pending.Done()
+	}
+	q.stats.Processed++
+	j := log.JSON{
+		"seq":        p.vote.Seq,
+		"winner_id":  p.vote.WinnerID,
+		"loser_id":   p.vote.LoserID,
+		"request_id": p.vote.RequestID,
+		"client":     p.vote.Client,
+		"latency_ms": float64(latency.Microseconds()) / 1000.0,
+	}
+	if err != nil {
+		q.stats.Failed++
+		j["message"] = "Error applying vote"
+		j["error"] = err
+		q.logger.Errorj(j)
+	} else {
+		j["message"] = "Applied vote"
+		q.logger.Debugj(j)
+	}
+	q.stats.LastLatency = latency
+	q.latency += latency
+	if latency > q.stats.MaxLatency {
+		q.stats.MaxLatency = latency
+	}
+}
+
+// Enqueue accepts a vote for processing, writing it to the write-ahead log first, and returns it
+// with its sequence number and time accepted assigned.
+// Returns ErrQueueFull if the queue is at capacity, in which case the vote was not accepted.
+func (q *VoteQueue) Enqueue(vote Vote) (Vote, error) {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return Vote{}, ErrQueueClosed
+	}
+	// Only workers receive from the channel, so reserving space under the lock guarantees
+	// the send below will not block.
+	if len(q.votes)+q.reserved >= cap(q.votes) {
+		q.stats.Rejected++
+		q.lock.Unlock()
+		return Vote{}, ErrQueueFull
+	}
+	vote.Seq = q.seq + 1
+	vote.Accepted = time.Now()
+	p := &pending{vote: vote}
+	if q.opts.Dir != "" {
+		seg, err := q.activeSegment()
+		if err != nil {
+			q.lock.Unlock()
+			return Vote{}, err
+		}
+		seg.records++
+		seg.last = vote.Seq
+		seg.pending.Add(1)
+		seg.writes.Add(1)
+		p.segment = seg
+	}
+	q.seq = vote.Seq
+	q.reserved++
+	q.enqueues.Add(1)
+	q.lock.Unlock()
+	defer q.enqueues.Done()
+
+	// Written without holding the lock, so that concurrent votes are synced to disk together.
+	var err error
+	if p.segment != nil {
+		err = p.segment.append(vote, q.opts.SyncWrites)
+		p.segment.writes.Done()
+		if err != nil {
+			p.segment.pending.Done()
+		}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.reserved--
+	if err != nil {
+		if p.segment != nil && p.segment == q.active {
+			// Later votes go to a new segment, in case the failed write could not be undone.
+			q.sealActive()
+		}
+		return Vote{}, err
+	}
+	q.stats.Accepted++
+	q.votes <- p
+	return vote, nil
+}
+
+func (q *VoteQueue) activeSegment() (*segment, error) {
+	// Returns the segment new votes are appended to, rotating full segments, must hold the lock.
+	if q.active != nil && q.active.records >= q.opts.SegmentSize {
+		q.sealActive()
+	}
+	if q.active == nil {
+		seg, err := createSegment(q.opts.Dir, q.seq+1)
+		if err != nil {
+			return nil, err
+		}
+		q.active = seg
+	}
+	return q.active, nil
+}
+
+func (q *VoteQueue) sealActive() {
+	// Stops appending to the active segment, must hold the lock. Its file is closed once the votes
+	// being written are, see segment.close.
+	if q.active == nil {
+		return
+	}
+	q.sealed = append(q.sealed, q.active)
+	q.active = nil
+}
+
+// Checkpoint deletes the write-ahead log segments whose votes have all been persisted.
+// It seals the active segment, waits for its votes to be processed, then calls persist (e.g. flushing
+// the SCP cache to the database). The segments are only deleted if persist succeeds. Segments from the
+// first one holding votes that failed to be processed are kept, to be replayed on restart, and an
+// error is returned.
+func (q *VoteQueue) Checkpoint(persist func() error) error {
+	q.checkpointLock.Lock()
+	defer q.checkpointLock.Unlock()
+	q.lock.Lock()
+	q.sealActive()
+	sealed := q.sealed
+	q.lock.Unlock()
+	for _, seg := range sealed {
+		seg.pending.Wait()
+	}
+	if err := persist(); err != nil {
+		return err
+	}
+	// Segments are deleted in order, since the log is truncated up to the last vote deleted.
+	q.lock.Lock()
+	removable, failed := len(sealed), 0
+	for i, seg := range sealed {
+		if seg.failed > 0 && removable == len(sealed) {
+			removable = i
+		}
+		failed += seg.failed
+	}
+	q.lock.Unlock()
+	removed := 0
+	var err error
+	for _, seg := range sealed[:removable] {
+		if err = seg.remove(); err != nil {
+			break
+		}
+		removed++
+	}
+	q.lock.Lock()
+	q.sealed = q.sealed[removed:]
+	if removed > 0 {
+		q.truncated = sealed[removed-1].last
+	}
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d votes failed to be processed, kept in the write-ahead log to be replayed on restart", failed)
+	}
+	return nil
+}
+
+// Truncated returns the sequence number up to which votes have been deleted from the write-ahead log by
+// Checkpoint. Those votes are never replayed, so records of them being persisted can be deleted.
+func (q *VoteQueue) Truncated() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.truncated
+}
+
+// StartCheckpoints calls Checkpoint with persist every interval in a background goroutine until Close.
+func (q *VoteQueue) StartCheckpoints(interval time.Duration, persist func() error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.checkpointStop != nil || q.closed {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	q.checkpointStop = stop
+	q.checkpointDone = done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.Checkpoint(persist); err != nil {
+					q.logger.Errorj(log.JSON{"message": "Error checkpointing the write-ahead log", "error": err})
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops accepting votes and waits until all queued votes have been processed.
+// Call Checkpoint afterwards to clear the write-ahead log once the votes are persisted.
+func (q *VoteQueue) Close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.closed = true
+	checkpointStop, checkpointDone := q.checkpointStop, q.checkpointDone
+	q.lock.Unlock()
+	// Votes being written to the log are queued once written.
+	q.enqueues.Wait()
+	close(q.votes)
+	if checkpointStop != nil {
+		close(checkpointStop)
+		<-checkpointDone
+	}
+	q.workers.Wait()
+	q.lock.Lock()
+	q.sealActive()
+	sealed := q.sealed
+	q.lock.Unlock()
+	var err error
+	for _, seg := range sealed {
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Stats returns the current Stats of the queue.
+func (q *VoteQueue) Stats() Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	stats.Depth = len(q.votes)
+	stats.Segments = len(q.sealed)
+	if q.active != nil {
+		stats.Segments++
+	}
+	if stats.Processed > 0 {
+		stats.AverageLatency = q.latency / time.Duration(stats.Processed)
+	}
+	return stats
+}
@@ -0,0 +1,321 @@
+package queue_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cycraig/scpbattle/queue"
+	"github.com/labstack/gommon/log"
+)
+
+func newTestQueue(t *testing.T, dir string, capacity int) *queue.VoteQueue {
+	opts := queue.DefaultOptions()
+	opts.Dir = dir
+	opts.Capacity = capacity
+	opts.Workers = 2
+	opts.SegmentSize = 3
+	opts.SyncWrites = false
+	q, err := queue.NewVoteQueue(opts, log.New("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func countSegments(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestVoteQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := newTestQueue(t, dir, 100)
+	var lock sync.Mutex
+	processed := make(map[uint64]queue.Vote)
+	q.Start(func(vote queue.Vote) error {
+		lock.Lock()
+		defer lock.Unlock()
+		processed[vote.Seq] = vote
+		return nil
+	})
+	for i := uint(1); i <= 10; i++ {
+		if _, err := q.Enqueue(queue.Vote{WinnerID: i, LoserID: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2}); err != queue.ErrQueueClosed {
+		t.Errorf("Expected %v after closing, got %v", queue.ErrQueueClosed, err)
+	}
+	if len(processed) != 10 {
+		t.Fatalf("Expected 10 processed votes, got %d", len(processed))
+	}
+	for seq, vote := range processed {
+		if vote.LoserID != vote.WinnerID+1 || vote.Accepted.IsZero() || seq < 1 || seq > 10 {
+			t.Errorf("Unexpected vote %+v", vote)
+		}
+	}
+	stats := q.Stats()
+	if stats.Accepted != 10 || stats.Processed != 10 || stats.Depth != 0 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Segments hold at most 3 votes each and are kept until checkpointed.
+	if n := countSegments(t, dir); n != 4 {
+		t.Errorf("Expected 4 segments, got %d", n)
+	}
+	persisted := false
+	if err := q.Checkpoint(func() error {
+		persisted = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !persisted {
+		t.Error("Checkpoint did not persist")
+	}
+	if n := countSegments(t, dir); n != 0 {
+		t.Errorf("Expected no segments after checkpoint, got %d", n)
+	}
+}
+
+func TestVoteQueueFull(t *testing.T) {
+	q := newTestQueue(t, "", 2)
+	// Not started, so nothing is taken off the queue.
+	for i := uint(1); i <= 2; i++ {
+		if _, err := q.Enqueue(queue.Vote{WinnerID: i, LoserID: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.Enqueue(queue.Vote{WinnerID: 3, LoserID: 4}); err != queue.ErrQueueFull {
+		t.Errorf("Expected %v, got %v", queue.ErrQueueFull, err)
+	}
+	stats := q.Stats()
+	if stats.Depth != 2 || stats.Rejected != 1 || stats.Accepted != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestVoteQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueueReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Simulate a crash: votes are accepted but never processed or checkpointed.
+	q := newTestQueue(t, dir, 100)
+	for i := uint(1); i <= 5; i++ {
+		if _, err := q.Enqueue(queue.Vote{WinnerID: i, LoserID: i + 1, RequestID: "req-1", Client: "abc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A vote interrupted halfway through being written was never accepted and is ignored.
+	partial, err := os.OpenFile(filepath.Join(dir, "votes-99999999999999999999.wal"), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.WriteString(`{"seq":6,"winn`)
+	partial.Close()
+
+	// The votes are replayed by the next run, before any new votes, except those already persisted.
+	id := q.ID()
+	q = newTestQueue(t, dir, 100)
+	if q.ID() != id || id == "" {
+		t.Errorf("Expected the log to keep its ID %q, got %q", id, q.ID())
+	}
+	q.SetApplied([]uint64{2, 4})
+	var replayed []queue.Vote
+	q.Start(func(vote queue.Vote) error {
+		replayed = append(replayed, vote)
+		return nil
+	})
+	if len(replayed) != 3 {
+		t.Fatalf("Expected 3 replayed votes, got %d", len(replayed))
+	}
+	for i, vote := range replayed {
+		// The request ID and client are kept to trace replayed votes back to their requests.
+		if vote.Seq != uint64(2*i+1) || vote.WinnerID != uint(2*i+1) || vote.RequestID != "req-1" || vote.Client != "abc" || !vote.Replayed {
+			t.Errorf("Unexpected replayed vote %+v", vote)
+		}
+	}
+	vote, err := q.Enqueue(queue.Vote{WinnerID: 10, LoserID: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote.Seq != 6 {
+		t.Errorf("Expected sequence numbers to continue from the replayed votes, got %d", vote.Seq)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Replayed != 3 || stats.Skipped != 2 || stats.Processed != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if err := q.Checkpoint(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSegments(t, dir); n != 0 {
+		t.Errorf("Expected no segments after checkpoint, got %d", n)
+	}
+	if truncated := q.Truncated(); truncated != 6 {
+		t.Errorf("Expected votes up to 6 to be deleted from the log, got %d", truncated)
+	}
+
+	// Sequence numbers start again with an empty log, which gets a new ID.
+	q = newTestQueue(t, dir, 100)
+	if q.ID() == id {
+		t.Errorf("Expected a new ID for an empty log, got %q", q.ID())
+	}
+}
+
+func TestVoteQueueCorruptSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueueCorruptSegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only the final line of a segment may be partial, anything else is corrupt.
+	segment := `{"seq":1,"winn` + "\n" + `{"seq":2,"winnerID":1,"loserID":2}` + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "votes-00000000000000000001.wal"), []byte(segment), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := queue.DefaultOptions()
+	opts.Dir = dir
+	if _, err := queue.NewVoteQueue(opts, log.New("test")); err == nil {
+		t.Error("Expected an error loading a corrupt segment")
+	}
+}
+
+func TestVoteQueueFailedVotes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueueFailedVotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Votes that failed to be applied are kept in the log, except invalid ones.
+	q := newTestQueue(t, dir, 100)
+	q.Start(func(vote queue.Vote) error {
+		switch vote.Seq {
+		case 2:
+			return fmt.Errorf("%w: deleted SCP", queue.ErrInvalidVote)
+		case 5:
+			return errors.New("database unavailable")
+		}
+		return nil
+	})
+	for i := uint(1); i <= 6; i++ {
+		if _, err := q.Enqueue(queue.Vote{WinnerID: i, LoserID: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Processed != 6 || stats.Failed != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if err := q.Checkpoint(func() error { return nil }); err == nil {
+		t.Error("Expected the checkpoint to fail")
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Errorf("Expected the segment with the failed vote to be kept, got %d segments", n)
+	}
+	if truncated := q.Truncated(); truncated != 3 {
+		t.Errorf("Expected votes up to 3 to be deleted from the log, got %d", truncated)
+	}
+
+	// The segment is replayed by the next run.
+	q = newTestQueue(t, dir, 100)
+	var replayed []uint64
+	q.Start(func(vote queue.Vote) error {
+		replayed = append(replayed, vote.Seq)
+		return nil
+	})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(replayed) != "[4 5 6]" {
+		t.Errorf("Expected votes 4 to 6 to be replayed, got %v", replayed)
+	}
+	if err := q.Checkpoint(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSegments(t, dir); n != 0 {
+		t.Errorf("Expected no segments after checkpoint, got %d", n)
+	}
+}
+
+func TestVoteQueueConcurrentEnqueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVoteQueueConcurrentEnqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Votes are written and synced concurrently, rotating segments, then the run crashes.
+	opts := queue.DefaultOptions()
+	opts.Dir = dir
+	opts.SegmentSize = 7
+	q, err := queue.NewVoteQueue(opts, log.New("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const voters, votesPerVoter = 8, 25
+	var wg sync.WaitGroup
+	for v := 0; v < voters; v++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < votesPerVoter; i++ {
+				if _, err := q.Enqueue(queue.Vote{WinnerID: 1, LoserID: 2}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := q.Stats(); stats.Accepted != voters*votesPerVoter || stats.Depth != voters*votesPerVoter {
+		t.Errorf("Unexpected stats %+v", q.Stats())
+	}
+
+	// Every vote is replayed once.
+	q, err = queue.NewVoteQueue(opts, log.New("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := make(map[uint64]bool)
+	q.Start(func(vote queue.Vote) error {
+		seqs[vote.Seq] = true
+		return nil
+	})
+	if len(seqs) != voters*votesPerVoter {
+		t.Errorf("Expected %d replayed votes, got %d", voters*votesPerVoter, len(seqs))
+	}
+	for seq := uint64(1); seq <= voters*votesPerVoter; seq++ {
+		if !seqs[seq] {
+			t.Errorf("Vote %d was not replayed", seq)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
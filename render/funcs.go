@@ -0,0 +1,108 @@
+package render
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Assets resolves the URLs of static files, e.g. asset.Manifest.
+type Assets interface {
+	URL(name string) string       // e.g. "/css/style.css" for "css/style.css"
+	Integrity(name string) string // Subresource Integrity hash, empty if unknown
+}
+
+// Funcs returns the functions available to templates:
+//   - asset returns the URL of a static file, e.g. {{asset "css/style.css"}},
+//   - sri returns the URL attribute of a static file with its Subresource Integrity hash,
+//     e.g. <link rel="stylesheet" {{sri "href" "css/style.css"}}>,
+//   - number formats a number rounded to an integer with thousands separators, e.g. 1,234,
+//   - ordinal formats a rank, e.g. 1st, 2nd, 3rd, 11th.
+//
+// Without assets, static files are referred to by their path and without integrity hashes.
+func Funcs(assets Assets) template.FuncMap {
+	if assets == nil {
+		assets = paths{}
+	}
+	return template.FuncMap{
+		"asset": assets.URL,
+		"sri": func(attr string, name string) (template.HTMLAttr, error) {
+			if attr != "href" && attr != "src" {
+				return "", fmt.Errorf("sri: unsupported attribute %q", attr)
+			}
+			html := attr + `="` + template.HTMLEscapeString(assets.URL(name)) + `"`
+			if integrity := assets.Integrity(name); integrity != "" {
+				html += ` integrity="` + template.HTMLEscapeString(integrity) + `"`
+			}
+			return template.HTMLAttr(html), nil
+		},
+		"number":  Number,
+		"ordinal": Ordinal,
+	}
+}
+
+// paths refers to static files by their path.
+type paths struct{}
+
+func (paths) URL(name string) string       { return "/" + strings.TrimPrefix(name, "/") }
+func (paths) Integrity(name string) string { return "" }
+
+// Number formats a number rounded to an integer with thousands separators, e.g. 1,234.
+// It accepts any integer or floating point type.
+func Number(n interface{}) (string, error) {
+	var i int64
+	switch v := n.(type) {
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case uint64:
+		i = int64(v)
+	case float32:
+		i = int64(math.Round(float64(v)))
+	case float64:
+		i = int64(math.Round(v))
+	default:
+		return "", fmt.Errorf("number: unsupported type %T", n)
+	}
+	digits := strconv.FormatInt(i, 10)
+	sign := ""
+	if i < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	for j, d := range digits {
+		if j > 0 && (len(digits)-j)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String(), nil
+}
+
+// Ordinal formats a rank, e.g. 1st, 2nd, 3rd, 11th.
+func Ordinal(n int) string {
+	suffix := "th"
+	switch n % 100 {
+	case 11, 12, 13:
+	default:
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return strconv.Itoa(n) + suffix
+}
@@ -0,0 +1,190 @@
+// Package render discovers and renders the HTML page templates.
+package render
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/security"
+)
+
+// Directories of the templates shared by every page.
+const (
+	layoutDir  = "layouts"
+	partialDir = "partials"
+)
+
+// Registry renders the page templates of a file system, found by convention:
+//   - every .html file at the root is a page, named after the file (e.g. "vote.html") and rendered by
+//     executing its "base" template,
+//   - layouts/*.html define the page structure, e.g. "base" including the page's "title" and "body",
+//   - partials/*.html define templates included by pages and layouts, e.g. {{template "navbar" .}}.
+//
+// Every page is parsed separately with the layouts and partials, so that pages can define the same
+// templates, e.g. "body".
+type Registry struct {
+	fsys  fs.FS
+	funcs template.FuncMap
+	dev   bool
+
+	lock  sync.RWMutex
+	pages map[string]*template.Template
+	files string // the files parsed with their sizes and modification times, to reload them in dev mode
+}
+
+// New parses the templates of fsys with the functions, see Funcs. In dev mode the templates are parsed
+// again whenever a file changes.
+func New(fsys fs.FS, funcs template.FuncMap, dev bool) (*Registry, error) {
+	r := &Registry{fsys: fsys, funcs: funcs, dev: dev}
+	files, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.parse(files); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Render implements echo.Renderer, executing the named page's "base" template with the data.
+// Pages rendered with an echo.Map also get the request's Content Security Policy nonce as "nonce",
+// for the nonce attribute of scripts, e.g. <script nonce="{{index . "nonce"}}">, and its CSRF token as
+// "csrf", to send back with forms and scripts.
+func (r *Registry) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if m, ok := data.(echo.Map); ok && c != nil {
+		withRequest := make(echo.Map, len(m)+2)
+		for k, v := range m {
+			withRequest[k] = v
+		}
+		withRequest["nonce"] = security.Nonce(c)
+		withRequest["csrf"] = security.CSRFToken(c)
+		data = withRequest
+	}
+	if r.dev {
+		if err := r.reload(); err != nil {
+			return err
+		}
+	}
+	r.lock.RLock()
+	tmpl, ok := r.pages[name]
+	r.lock.RUnlock()
+	if !ok {
+		return errors.New("Template not found: " + name)
+	}
+	return tmpl.ExecuteTemplate(w, "base", data)
+}
+
+// Templates returns the sorted names of the pages, for health checks.
+func (r *Registry) Templates() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.pages))
+	for name := range r.pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Require returns an error listing the pages that are missing, if any.
+func (r *Registry) Require(names ...string) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var missing []string
+	for _, name := range names {
+		if _, ok := r.pages[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("missing templates: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// reload parses the templates again if any file has been added, removed or changed since they were parsed.
+func (r *Registry) reload() error {
+	files, err := r.stat()
+	if err != nil {
+		return err
+	}
+	r.lock.RLock()
+	changed := files != r.files
+	r.lock.RUnlock()
+	if !changed {
+		return nil
+	}
+	return r.parse(files)
+}
+
+// stat returns the names, sizes and modification times of the template files.
+func (r *Registry) stat() (string, error) {
+	var files strings.Builder
+	for _, pattern := range []string{"*.html", path.Join(layoutDir, "*.html"), path.Join(partialDir, "*.html")} {
+		names, err := fs.Glob(r.fsys, pattern)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range names {
+			info, err := fs.Stat(r.fsys, name)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&files, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return files.String(), nil
+}
+
+func (r *Registry) parse(files string) error {
+	shared, err := fs.Glob(r.fsys, path.Join(layoutDir, "*.html"))
+	if err != nil {
+		return err
+	}
+	partials, err := fs.Glob(r.fsys, path.Join(partialDir, "*.html"))
+	if err != nil {
+		return err
+	}
+	shared = append(shared, partials...)
+	if len(shared) == 0 {
+		return errors.New("no layouts found in " + layoutDir + "/")
+	}
+	// Parsed once and cloned for every page, which can then redefine templates.
+	base, err := template.New("").Funcs(r.funcs).ParseFS(r.fsys, shared...)
+	if err != nil {
+		return err
+	}
+	names, err := fs.Glob(r.fsys, "*.html")
+	if err != nil {
+		return err
+	}
+	pages := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		tmpl, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if tmpl, err = tmpl.ParseFS(r.fsys, name); err != nil {
+			return err
+		}
+		if tmpl.Lookup("base") == nil {
+			return fmt.Errorf("template: %s: no base template defined by the layouts", name)
+		}
+		pages[name] = tmpl
+	}
+
+	r.lock.Lock()
+	r.pages = pages
+	r.files = files
+	r.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,134 @@
+package render_test
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/cycraig/scpbattle/render"
+)
+
+func testFS() fstest.MapFS {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(data), ModTime: time.Unix(1, 0)}
+	}
+	return fstest.MapFS{
+		"layouts/base.html":   file(`{{define "base"}}<title>{{template "title" .}}</title>{{template "nav" .}}{{template "body" .}}{{end}}`),
+		"partials/nav.html":   file(`{{define "nav"}}<link {{sri "href" "css/style.css"}}><img src="{{asset "logo.svg"}}">{{end}}`),
+		"rankings.html":       file(`{{define "title"}}Rankings{{end}}{{define "body"}}{{ordinal .Rank}}: {{number .Rating}}{{end}}`),
+		"about.html":          file(`{{define "title"}}About{{end}}{{define "body"}}About{{end}}`),
+		"partials/readme.txt": file(`not a template`),
+	}
+}
+
+// testAssets serves static files from /static/, with an integrity hash for css/style.css only.
+type testAssets struct{}
+
+func (testAssets) URL(name string) string { return "/static/" + name }
+func (testAssets) Integrity(name string) string {
+	if name == "css/style.css" {
+		return "sha384-abc"
+	}
+	return ""
+}
+
+func renderPage(t *testing.T, r *render.Registry, name string, data interface{}) string {
+	var buf bytes.Buffer
+	if err := r.Render(&buf, name, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestRegistry(t *testing.T) {
+	r, err := render.New(testFS(), render.Funcs(testAssets{}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(r.Templates(), ","); names != "about.html,rankings.html" {
+		t.Errorf("Expected the pages about.html and rankings.html, got %s", names)
+	}
+	// Pages define the same templates without overwriting each other.
+	expected := `<title>Rankings</title><link href="/static/css/style.css" integrity="sha384-abc"><img src="/static/logo.svg">2nd: 1,235`
+	if page := renderPage(t, r, "rankings.html", map[string]interface{}{"Rank": 2, "Rating": 1234.6}); page != expected {
+		t.Errorf("Expected %q, got %q", expected, page)
+	}
+	if page := renderPage(t, r, "about.html", nil); !strings.HasPrefix(page, "<title>About</title>") {
+		t.Errorf("Unexpected page %q", page)
+	}
+	if err := r.Render(&bytes.Buffer{}, "vote.html", nil, nil); err == nil {
+		t.Error("Expected an error rendering a missing template")
+	}
+	if err := r.Require("about.html", "rankings.html"); err != nil {
+		t.Error(err)
+	}
+	if err := r.Require("about.html", "vote.html", "error.html"); err == nil || err.Error() != "missing templates: vote.html, error.html" {
+		t.Errorf("Expected the missing templates, got %v", err)
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	invalid := testFS()
+	invalid["about.html"].Data = []byte(`{{define "body"}}{{unknownFunc}}{{end}}`)
+	if _, err := render.New(invalid, render.Funcs(nil), false); err == nil {
+		t.Error("Expected an error parsing an invalid template")
+	}
+	noLayouts := testFS()
+	delete(noLayouts, "layouts/base.html")
+	delete(noLayouts, "partials/nav.html")
+	if _, err := render.New(noLayouts, render.Funcs(nil), false); err == nil {
+		t.Error("Expected an error without layouts")
+	}
+}
+
+func TestRegistryReload(t *testing.T) {
+	for _, dev := range []bool{false, true} {
+		fsys := testFS()
+		r, err := render.New(fsys, render.Funcs(nil), dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys["about.html"] = &fstest.MapFile{Data: []byte(`{{define "title"}}Edited{{end}}{{define "body"}}{{end}}`), ModTime: time.Unix(2, 0)}
+		fsys["compare.html"] = &fstest.MapFile{Data: []byte(`{{define "title"}}Compare{{end}}{{define "body"}}{{end}}`), ModTime: time.Unix(2, 0)}
+		edited := strings.HasPrefix(renderPage(t, r, "about.html", nil), "<title>Edited</title>")
+		if edited != dev {
+			t.Errorf("Dev mode %v: expected the edited template to be reloaded only in dev mode", dev)
+		}
+		if added := r.Require("compare.html") == nil; added != dev {
+			t.Errorf("Dev mode %v: expected the added template to be discovered only in dev mode", dev)
+		}
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	numbers := map[interface{}]string{
+		0: "0", 999: "999", 1000: "1,000", int64(-1234567): "-1,234,567", uint64(12345): "12,345", 999.5: "1,000", float32(-0.4): "0",
+	}
+	for n, expected := range numbers {
+		if formatted, err := render.Number(n); err != nil || formatted != expected {
+			t.Errorf("Number(%v): expected %q, got %q (%v)", n, expected, formatted, err)
+		}
+	}
+	if _, err := render.Number("1"); err == nil {
+		t.Error("Expected an error formatting a string")
+	}
+	ordinals := map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th", 21: "21st", 102: "102nd", 111: "111th"}
+	for n, expected := range ordinals {
+		if formatted := render.Ordinal(n); formatted != expected {
+			t.Errorf("Ordinal(%d): expected %q, got %q", n, expected, formatted)
+		}
+	}
+	if asset := render.Funcs(nil)["asset"].(func(string) string)("css/style.css"); asset != "/css/style.css" {
+		t.Errorf("Expected the default asset URL /css/style.css, got %q", asset)
+	}
+	sri := render.Funcs(nil)["sri"].(func(string, string) (template.HTMLAttr, error))
+	if attr, err := sri("src", "js/vote.js"); err != nil || attr != `src="/js/vote.js"` {
+		t.Errorf("Expected the default sri attribute without a hash, got %q (%v)", attr, err)
+	}
+	if _, err := sri("onclick", "js/vote.js"); err == nil {
+		t.Error("Expected an error for attributes other than href and src")
+	}
+}
@@ -0,0 +1,58 @@
+package security
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CSRF token names: the cookie of the double-submit token, the header set by scripts and the form field.
+const (
+	csrfKey    = "csrf"
+	csrfCookie = "_csrf"
+	CSRFHeader = echo.HeaderXCSRFToken
+	CSRFField  = "_csrf"
+)
+
+// CSRFConfig configures the CSRF protection.
+type CSRFConfig struct {
+	// CookieSecure only sends the token cookie over HTTPS.
+	CookieSecure bool
+}
+
+// CSRF protects the POST, PUT, PATCH and DELETE requests from Cross-Site Request Forgery with double-submit
+// cookies: every response sets a random token in a cookie, which other sites cannot read, and state-changing
+// requests must send it back in the X-CSRF-Token header (scripts) or the _csrf field (forms). Pages get the
+// token as "csrf", see CSRFToken.
+//
+// Requests with an "Authorization: Bearer" header are exempt: browsers never add that header themselves,
+// and other sites cannot set it without a CORS preflight, which is not allowed.
+func CSRF(cfg CSRFConfig) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        bearer,
+		TokenLookup:    "header:" + CSRFHeader + ",form:" + CSRFField,
+		ContextKey:     csrfKey,
+		CookieName:     csrfCookie,
+		CookiePath:     "/",
+		CookieSecure:   cfg.CookieSecure,
+		CookieHTTPOnly: true, // pages get the token from the template instead
+		CookieSameSite: http.SameSiteLaxMode,
+		ErrorHandler: func(error, echo.Context) error {
+			// A missing token is as forbidden as an invalid one.
+			return echo.NewHTTPError(http.StatusForbidden, "invalid or missing CSRF token")
+		},
+	})
+}
+
+// CSRFToken returns the CSRF token of the request, to send back with state-changing requests,
+// empty outside CSRF.
+func CSRFToken(c echo.Context) string {
+	token, _ := c.Get(csrfKey).(string)
+	return token
+}
+
+func bearer(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+}
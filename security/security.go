@@ -0,0 +1,78 @@
+// Package security sets the security headers of every response, including a Content Security Policy
+// only allowing the scripts with the nonce of the request.
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// nonceKey is the context key of the request's nonce.
+const nonceKey = "csp_nonce"
+
+// permissionsPolicy disables the browser features the site doesn't use, for itself and any embedded content.
+const permissionsPolicy = "accelerometer=(), camera=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), payment=(), usb=(), interest-cohort=()"
+
+// Config configures the security headers.
+type Config struct {
+	// HSTSMaxAge is how long browsers should only connect with HTTPS, 0 to disable.
+	// Only sent over HTTPS, including behind a proxy setting X-Forwarded-Proto.
+	HSTSMaxAge time.Duration
+}
+
+// Middleware sets the security headers, and a Content Security Policy only allowing scripts with the
+// request's nonce, see Nonce, and the scripts they load ('strict-dynamic'). Inline event handlers,
+// javascript: URLs, style attributes and framing by other sites are blocked.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	secure := middleware.SecureWithConfig(middleware.SecureConfig{
+		XSSProtection:      "0", // the XSS auditors of old browsers introduced vulnerabilities of their own
+		ContentTypeNosniff: "nosniff",
+		XFrameOptions:      "DENY", // frame-ancestors for browsers without CSP
+		HSTSMaxAge:         int(cfg.HSTSMaxAge.Seconds()),
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return secure(func(c echo.Context) error {
+			nonce := newNonce()
+			c.Set(nonceKey, nonce)
+			header := c.Response().Header()
+			header.Set(echo.HeaderContentSecurityPolicy, policy(nonce))
+			header.Set("Permissions-Policy", permissionsPolicy)
+			return next(c)
+		})
+	}
+}
+
+// Nonce returns the nonce of the request for the nonce attribute of scripts, empty outside Middleware.
+func Nonce(c echo.Context) string {
+	nonce, _ := c.Get(nonceKey).(string)
+	return nonce
+}
+
+func policy(nonce string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'nonce-" + nonce + "' 'strict-dynamic'",
+		"style-src 'self' https://fonts.googleapis.com",
+		"font-src 'self' https://fonts.gstatic.com",
+		"img-src 'self'",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce) // unescaped in HTML attributes
+}
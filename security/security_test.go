@@ -0,0 +1,149 @@
+package security_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/render"
+	"github.com/cycraig/scpbattle/security"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(security.Middleware(security.Config{HSTSMaxAge: time.Hour}))
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, security.Nonce(c))
+	})
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(nil)
+	expected := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Strict-Transport-Security": "",
+	}
+	for name, value := range expected {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+	if !strings.Contains(rec.Header().Get("Permissions-Policy"), "camera=()") {
+		t.Errorf("Unexpected Permissions-Policy %q", rec.Header().Get("Permissions-Policy"))
+	}
+	csp := rec.Header().Get(echo.HeaderContentSecurityPolicy)
+	for _, directive := range []string{"default-src 'self'", "object-src 'none'", "frame-ancestors 'none'"} {
+		if !strings.Contains(csp, directive) {
+			t.Errorf("Expected %q in the Content Security Policy %q", directive, csp)
+		}
+	}
+	if strings.Contains(csp, "unsafe-inline") {
+		t.Errorf("Expected no 'unsafe-inline' in the Content Security Policy %q", csp)
+	}
+	nonce := rec.Body.String()
+	if !regexp.MustCompile(`^[A-Za-z0-9_-]{22}$`).MatchString(nonce) {
+		t.Fatalf("Unexpected nonce %q", nonce)
+	}
+	if !strings.Contains(csp, "script-src 'nonce-"+nonce+"'") {
+		t.Errorf("Expected the nonce %q in the Content Security Policy %q", nonce, csp)
+	}
+	if other := serve(nil).Body.String(); other == nonce {
+		t.Error("Expected a different nonce for every request")
+	}
+
+	// HSTS is only sent over HTTPS.
+	if hsts := serve(http.Header{echo.HeaderXForwardedProto: {"https"}}).Header().Get("Strict-Transport-Security"); hsts != "max-age=3600; includeSubdomains" {
+		t.Errorf("Unexpected Strict-Transport-Security %q", hsts)
+	}
+}
+
+func TestNonceRendered(t *testing.T) {
+	r, err := render.New(fstest.MapFS{
+		"layouts/base.html": {Data: []byte(`{{define "base"}}<script nonce="{{index . "nonce"}}"></script>{{index . "title"}}{{end}}`)},
+		"page.html":         {Data: []byte(``)},
+	}, render.Funcs(nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Renderer = r
+	e.Use(security.Middleware(security.Config{}))
+	e.GET("/", func(c echo.Context) error {
+		return c.Render(http.StatusOK, "page.html", echo.Map{"title": "Title"})
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	if nonce == nil {
+		t.Fatalf("Expected a nonce in the Content Security Policy, got %v", rec.Header())
+	}
+	if expected := `<script nonce="` + nonce[1] + `"></script>Title`; rec.Body.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, rec.Body.String())
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	e := echo.New()
+	e.Use(security.CSRF(security.CSRFConfig{}))
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, security.CSRFToken(c))
+	})
+	e.POST("/vote", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+	serve := func(method string, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/vote", strings.NewReader(body))
+		if method == http.MethodGet {
+			req.URL.Path = "/"
+		}
+		for k, v := range header {
+			req.Header.Set(k, v[0])
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "", nil)
+	token := rec.Body.String()
+	cookies := rec.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected the token %q in an HttpOnly SameSite=Lax cookie, got %v", token, cookies)
+	}
+	cookie := cookies[0].Name + "=" + token
+
+	tests := []struct {
+		name   string
+		body   string
+		header http.Header
+		code   int
+	}{
+		{"no token", "", http.Header{echo.HeaderCookie: {cookie}}, http.StatusForbidden},
+		{"no cookie", "", http.Header{security.CSRFHeader: {token}}, http.StatusForbidden},
+		{"wrong token", "", http.Header{echo.HeaderCookie: {cookie}, security.CSRFHeader: {"wrong"}}, http.StatusForbidden},
+		{"header", `{"winnerID":1}`, http.Header{echo.HeaderCookie: {cookie}, security.CSRFHeader: {token}, echo.HeaderContentType: {echo.MIMEApplicationJSON}}, http.StatusNoContent},
+		{"form", security.CSRFField + "=" + token, http.Header{echo.HeaderCookie: {cookie}, echo.HeaderContentType: {echo.MIMEApplicationForm}}, http.StatusNoContent},
+		{"bearer token", "", http.Header{echo.HeaderAuthorization: {"Bearer secret"}}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		if rec := serve(http.MethodPost, test.body, test.header); rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package session identifies anonymous voters with a signed cookie, so that votes can be attributed
+// to them without accounts.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/store"
+)
+
+const (
+	cookieName     = "session"
+	sessionKey     = "session"             // context key of the request's *model.Session
+	newSessionKey  = "session_new"         // context key of the ID of the session to start, see ID
+	unavailableKey = "session_unavailable" // context key set if the session couldn't be loaded
+)
+
+// Config configures the session cookies.
+type Config struct {
+	// Key signs the cookies, random if empty, in which case sessions end when the server restarts
+	// and are only recognised by the instance that started them. Changing the key ends every session.
+	Key string
+	// MaxAge is how long a session lasts after its first vote. Expired sessions are purged along with
+	// their votes, see Manager.Purge.
+	MaxAge time.Duration
+	// CookieSecure only sends the cookie over HTTPS.
+	CookieSecure bool
+}
+
+// Manager starts, recognises and ends the sessions of voters, stored in a SessionRepository.
+// The cookie holds a random session ID signed with HMAC-SHA256, so that forged cookies are rejected
+// without looking them up, and sessions are also checked against the repository so that they can be
+// revoked.
+type Manager struct {
+	repo   store.SessionRepository
+	key    []byte
+	maxAge time.Duration
+	secure bool
+
+	purgeLock sync.Mutex    // guards purgeStop and purgeDone
+	purgeStop chan struct{} // closed to stop purging, see StartPurging
+	purgeDone chan struct{} // closed once purging has stopped
+}
+
+// Logger is the subset of echo.Logger used by the Manager.
+type Logger interface {
+	Infoj(j log.JSON)
+	Errorj(j log.JSON)
+}
+
+// NewManager returns a Manager of the sessions in the repository.
+func NewManager(repo store.SessionRepository, cfg Config) *Manager {
+	m := &Manager{repo: repo, key: []byte(cfg.Key), maxAge: cfg.MaxAge, secure: cfg.CookieSecure}
+	if cfg.Key == "" {
+		m.key = make([]byte, 32)
+		if _, err := rand.Read(m.key); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// Middleware recognises the session of the request, see Current, if its cookie is valid and the session
+// hasn't expired or been revoked. Invalid cookies are removed. If the repository is unavailable the
+// request continues without a session, keeping the cookie, and no new session is started for it.
+func (m *Manager) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cookie, err := c.Cookie(cookieName)
+		if err != nil {
+			return next(c)
+		}
+		id, ok := m.verify(cookie.Value)
+		if !ok {
+			m.removeCookie(c)
+			return next(c)
+		}
+		session, err := m.repo.GetSession(id)
+		if err != nil {
+			c.Logger().Warnj(log.JSON{"message": "Error loading session", "error": err})
+			c.Set(unavailableKey, true)
+			return next(c)
+		}
+		if session == nil || session.RevokedAt != nil || time.Since(session.CreatedAt) > m.maxAge {
+			m.removeCookie(c)
+			return next(c)
+		}
+		c.Set(sessionKey, session)
+		return next(c)
+	}
+}
+
+// Current returns the session of the request, nil if it has none or outside Middleware.
+func Current(c echo.Context) *model.Session {
+	session, _ := c.Get(sessionKey).(*model.Session)
+	return session
+}
+
+// ID returns the ID to attribute the request's vote to: that of its session, or of the session that
+// Start would start if it has none. It is empty if the session couldn't be loaded, see Middleware.
+func (m *Manager) ID(c echo.Context) string {
+	if session := Current(c); session != nil {
+		return session.ID
+	}
+	if unavailable, _ := c.Get(unavailableKey).(bool); unavailable {
+		return ""
+	}
+	if id, ok := c.Get(newSessionKey).(string); ok {
+		return id
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(random)
+	c.Set(newSessionKey, id)
+	return id
+}
+
+// Start starts the session returned by ID, with its cookie, if the request has none. Call it once the
+// vote attributed to it is accepted, so that rejected votes don't start sessions. Votes are logged once
+// they are written back, which drops votes of sessions that don't exist, e.g. if Start fails.
+func (m *Manager) Start(c echo.Context) error {
+	id, ok := c.Get(newSessionKey).(string)
+	if !ok || Current(c) != nil {
+		return nil
+	}
+	session := &model.Session{ID: id, CreatedAt: time.Now()}
+	if err := m.repo.CreateSession(session); err != nil {
+		return err
+	}
+	c.Set(newSessionKey, nil)
+	c.Set(sessionKey, session)
+	c.SetCookie(m.cookie(session.ID+"."+m.sign(session.ID), int(m.maxAge.Seconds())))
+	return nil
+}
+
+// Revoke ends the request's session, if any, deleting its votes, and removes its cookie. The revoked
+// session is kept until it expires, see Purge.
+func (m *Manager) Revoke(c echo.Context) error {
+	session := Current(c)
+	if session == nil {
+		return nil
+	}
+	if err := m.repo.RevokeSession(session.ID, time.Now()); err != nil {
+		return err
+	}
+	c.Set(sessionKey, nil)
+	m.removeCookie(c)
+	return nil
+}
+
+// Delete deletes the request's session, if any, and its votes, and removes its cookie.
+func (m *Manager) Delete(c echo.Context) error {
+	session := Current(c)
+	if session == nil {
+		return nil
+	}
+	if err := m.repo.DeleteSession(session.ID); err != nil {
+		return err
+	}
+	c.Set(sessionKey, nil)
+	m.removeCookie(c)
+	return nil
+}
+
+// Purge deletes the sessions that have expired, revoked or not, and their votes, returning how many
+// sessions were deleted.
+func (m *Manager) Purge() (int64, error) {
+	return m.repo.PurgeSessions(time.Now().Add(-m.maxAge))
+}
+
+// StartPurging calls Purge every interval in a background goroutine until StopPurging.
+// Does nothing if purging has already started.
+func (m *Manager) StartPurging(interval time.Duration, logger Logger) {
+	m.purgeLock.Lock()
+	defer m.purgeLock.Unlock()
+	if m.purgeStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	m.purgeStop = stop
+	m.purgeDone = done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := m.Purge()
+				if err != nil {
+					logger.Errorj(log.JSON{"message": "Error purging expired sessions", "error": err})
+				} else if purged > 0 {
+					logger.Infoj(log.JSON{"message": "Purged expired sessions", "sessions": purged})
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopPurging stops purging and waits for any purge in progress to finish.
+func (m *Manager) StopPurging() {
+	m.purgeLock.Lock()
+	defer m.purgeLock.Unlock()
+	if m.purgeStop == nil {
+		return
+	}
+	close(m.purgeStop)
+	<-m.purgeDone
+	m.purgeStop = nil
+	m.purgeDone = nil
+}
+
+// History returns the votes cast by a session, oldest first.
+func (m *Manager) History(sessionID string) ([]*model.VoteLog, error) {
+	return m.repo.GetVoteLog(sessionID)
+}
+
+// verify returns the session ID of a signed cookie value.
+func (m *Manager) verify(value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	id, signature := value[:i], value[i+1:]
+	return id, hmac.Equal([]byte(signature), []byte(m.sign(id)))
+}
+
+func (m *Manager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (m *Manager) removeCookie(c echo.Context) {
+	c.SetCookie(m.cookie("", -1))
+}
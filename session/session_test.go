@@ -0,0 +1,188 @@
+package session_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/session"
+	"github.com/cycraig/scpbattle/store"
+)
+
+// unavailableStore simulates a database that is down.
+type unavailableStore struct {
+	*store.MemorySessionStore
+	down bool
+}
+
+func (s *unavailableStore) GetSession(id string) (*model.Session, error) {
+	if s.down {
+		return nil, errors.New("connection refused")
+	}
+	return s.MemorySessionStore.GetSession(id)
+}
+
+func (s *unavailableStore) CreateSession(session *model.Session) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return s.MemorySessionStore.CreateSession(session)
+}
+
+// vote serves a request attributing a vote to its session, starting one if it has none, and returns the
+// ID the vote was attributed to.
+func vote(m *session.Manager, cookies []*http.Cookie) (string, *httptest.ResponseRecorder) {
+	e := echo.New()
+	var id string
+	e.POST("/vote", func(c echo.Context) error {
+		id = m.ID(c)
+		if err := m.Start(c); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusAccepted)
+	}, m.Middleware)
+	req := httptest.NewRequest(http.MethodPost, "/vote", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return id, rec
+}
+
+// current serves a request with the cookie, returning its session and the cookies set by the response.
+func current(m *session.Manager, cookie *http.Cookie) (*model.Session, []*http.Cookie) {
+	e := echo.New()
+	var s *model.Session
+	e.GET("/me", func(c echo.Context) error {
+		s = session.Current(c)
+		return c.NoContent(http.StatusOK)
+	}, m.Middleware)
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return s, rec.Result().Cookies()
+}
+
+func TestManager(t *testing.T) {
+	repo := store.NewMemorySessionStore()
+	m := session.NewManager(repo, session.Config{Key: "key", MaxAge: time.Hour, CookieSecure: true})
+	id, rec := vote(m, nil)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a session cookie, got %v", cookies)
+	}
+	cookie := cookies[0]
+	if cookie.Name != "session" || !strings.HasPrefix(cookie.Value, id+".") || !cookie.Secure || !cookie.HttpOnly || cookie.MaxAge != 3600 {
+		t.Errorf("Unexpected session cookie %+v", cookie)
+	}
+	if s, set := current(m, cookie); s == nil || s.ID != id || len(set) != 0 {
+		t.Errorf("Expected session %s, got %+v %v", id, s, set)
+	}
+	if s, _ := current(session.NewManager(repo, session.Config{Key: "key", MaxAge: time.Hour}), cookie); s == nil {
+		t.Error("Expected cookies signed with the same key to be valid on other instances")
+	}
+	signature := cookie.Value[strings.LastIndexByte(cookie.Value, '.')+1:]
+
+	// Cookies that are forged or signed with another key are removed.
+	other, _ := vote(m, nil)
+	for name, value := range map[string]string{
+		"unsigned":       id,
+		"forged":         other + "." + signature,
+		"tampered":       cookie.Value + "x",
+		"other key":      cookie.Value,
+		"random key":     cookie.Value,
+		"empty":          "",
+		"empty ID":       "." + signature,
+		"unknown":        "unknown." + signature,
+		"signature only": signature,
+	} {
+		manager := m
+		switch name {
+		case "other key":
+			manager = session.NewManager(repo, session.Config{Key: "other", MaxAge: time.Hour})
+		case "random key":
+			manager = session.NewManager(repo, session.Config{MaxAge: time.Hour})
+		}
+		s, set := current(manager, &http.Cookie{Name: "session", Value: value})
+		if s != nil || (value != "" && (len(set) != 1 || set[0].MaxAge >= 0)) {
+			t.Errorf("%s: expected the cookie to be removed, got %+v %v", name, s, set)
+		}
+	}
+
+	// Sessions expire MaxAge after they started, and can be revoked.
+	expired, rec := vote(m, nil)
+	expiredCookie := rec.Result().Cookies()[0]
+	if err := repo.CreateSession(&model.Session{ID: expired, CreatedAt: time.Now().Add(-time.Hour - time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RevokeSession(id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for name, cookie := range map[string]*http.Cookie{"expired": expiredCookie, "revoked": cookie} {
+		if s, set := current(m, cookie); s != nil || len(set) != 1 || set[0].MaxAge >= 0 {
+			t.Errorf("%s: expected the cookie to be removed, got %+v %v", name, s, set)
+		}
+	}
+}
+
+func TestManagerUnavailable(t *testing.T) {
+	repo := &unavailableStore{MemorySessionStore: store.NewMemorySessionStore()}
+	m := session.NewManager(repo, session.Config{Key: "key", MaxAge: time.Hour})
+	id, rec := vote(m, nil)
+	cookies := rec.Result().Cookies()
+	if id == "" || len(cookies) != 1 {
+		t.Fatalf("Expected a session to start, got %q %v", id, cookies)
+	}
+
+	// While sessions can't be loaded votes are anonymous, and the cookie is kept rather than replaced.
+	repo.down = true
+	if id, rec := vote(m, cookies); rec.Code != http.StatusAccepted || id != "" || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected an anonymous vote keeping the cookie, got %d %q %v", rec.Code, id, rec.Result().Cookies())
+	}
+	repo.down = false
+	if again, rec := vote(m, cookies); again != id || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected the session %q to be kept, got %q %v", id, again, rec.Result().Cookies())
+	}
+
+	// A session that cannot be started sets no cookie.
+	repo.down = true
+	if _, rec := vote(m, nil); rec.Code != http.StatusInternalServerError || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected an error without a cookie, got %d %v", rec.Code, rec.Result().Cookies())
+	}
+}
+
+func TestManagerPurge(t *testing.T) {
+	repo := store.NewMemorySessionStore()
+	m := session.NewManager(repo, session.Config{Key: "key", MaxAge: time.Hour})
+	for _, s := range []*model.Session{
+		{ID: "expired", CreatedAt: time.Now().Add(-2 * time.Hour)},
+		{ID: "current", CreatedAt: time.Now().Add(-time.Minute)},
+	} {
+		if err := repo.CreateSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if purged, err := m.Purge(); err != nil || purged != 1 {
+		t.Errorf("Expected 1 expired session to be purged, got %d %v", purged, err)
+	}
+	for id, exists := range map[string]bool{"expired": false, "current": true} {
+		if s, err := repo.GetSession(id); err != nil || (s != nil) != exists {
+			t.Errorf("Expected session %s to exist: %t, got %+v %v", id, exists, s, err)
+		}
+	}
+
+	// Purging in the background stops when asked to.
+	m.StartPurging(time.Millisecond, echo.New().Logger)
+	m.StopPurging()
+	m.StopPurging()
+}
@@ -0,0 +1,27 @@
+// Shared by every page. Event handlers and styles are set here instead of inline, which the
+// Content Security Policy blocks.
+
+// setBackground sets the background image of an element with data-background="url", darkened
+// with data-background-shade.
+function setBackground(el) {
+  var image = 'url("' + el.dataset.background.replace(/["\\\n]/g, "\\$&") + '")';
+  if (el.hasAttribute("data-background-shade")) {
+    image = "linear-gradient(rgba(0,0,0,0.5), rgba(0,0,0,0.5)), " + image;
+  }
+  el.style.backgroundImage = image;
+}
+
+(function () {
+  var toggle = document.getElementById("navbar-toggle");
+  if (toggle) {
+    toggle.addEventListener("click", function (event) {
+      event.preventDefault();
+      document.getElementById("navbar").classList.toggle("responsive");
+    });
+  }
+
+  var elements = document.querySelectorAll("[data-background]");
+  for (var i = 0; i < elements.length; i++) {
+    setBackground(elements[i]);
+  }
+})();
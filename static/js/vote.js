@@ -0,0 +1,106 @@
+// Voting on vote.html: clicking an SCP's image votes for it against the other one, then the next
+// matchup returned with the vote is shown in place. Without JavaScript the image's form is submitted
+// instead, redirecting to the next matchup.
+var sides = ["left", "right"];
+var voting = false;
+
+function postVote(form) {
+  // Requires a polyfill for fetch if we decide to support IE
+  let data = {
+    winnerID: Number(form.elements.winnerID.value),
+    loserID: Number(form.elements.loserID.value),
+    ballot: form.elements.ballot.value
+  };
+  return fetch("/vote", {
+    method: "POST",
+    headers: {
+      'Content-Type': 'application/json',
+      'Accept': 'application/json',
+      // the token of the CSRF cookie, which other sites cannot read
+      'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
+    },
+    body: JSON.stringify(data)
+  }).then(response => {
+    if (!response.ok) {
+      throw new Error("vote rejected with status " + response.status);
+    }
+    return response.json();
+  });
+}
+
+// preload resolves once the images of the matchup have loaded (or failed to), so that they are
+// shown together with the names.
+function preload(matchup) {
+  return Promise.all(sides.map(function (side) {
+    return new Promise(function (resolve) {
+      var img = new Image();
+      img.onload = img.onerror = resolve;
+      img.src = matchup[side].image;
+    });
+  }));
+}
+
+// show replaces the SCPs on the page with the matchup.
+function show(matchup) {
+  sides.forEach(function (side) {
+    var scp = matchup[side];
+    var opponent = matchup[side == "left" ? "right" : "left"];
+
+    var name = document.getElementById("name-" + side);
+    name.querySelector(".name-link").href = scp.link;
+    name.querySelector(".name").firstChild.nodeValue = scp.name;
+    name.querySelector(".desc").textContent = scp.description;
+    name.hidden = false;
+
+    var form = document.getElementById("vote-" + side);
+    form.elements.winnerID.value = scp.id;
+    form.elements.loserID.value = opponent.id;
+    form.elements.ballot.value = matchup.ballot;
+    form.querySelector(".vote-button").setAttribute("aria-label", "Vote for " + scp.name);
+    form.querySelector(".vote-image").src = scp.image;
+    form.classList.remove("pure-u-1-1");
+    form.classList.add("pure-u-1-2");
+    form.hidden = false;
+  });
+}
+
+function vote(form, side) {
+  if (voting) {
+    // prevent clicks voting multiple times
+    return;
+  }
+  voting = true;
+  // show the winner alone until the next matchup
+  var loser = side == "left" ? "right" : "left";
+  document.getElementById("name-" + loser).hidden = true;
+  document.getElementById("vote-" + loser).hidden = true;
+  form.classList.remove("pure-u-1-2");
+  form.classList.add("pure-u-1-1");
+
+  var shown = new Promise(function (resolve) { setTimeout(resolve, 1000); });
+  var next = postVote(form).then(function (response) {
+    if (!response.next) {
+      throw new Error("no next matchup");
+    }
+    return preload(response.next).then(function () { return response.next; });
+  });
+  Promise.all([next, shown]).then(function (results) {
+    show(results[0]);
+    voting = false;
+  }).catch(function (err) {
+    console.error(err.message);
+    window.location = "/";
+  });
+}
+
+// Votes are sent in the background instead of submitting the forms, inline handlers are blocked
+// by the Content Security Policy.
+(function () {
+  sides.forEach(function (side) {
+    var form = document.getElementById("vote-" + side);
+    form.addEventListener("submit", function (event) {
+      event.preventDefault();
+      vote(form, side);
+    });
+  });
+})();
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// AdminStore persists Admin accounts. Unlike SCPs, admins are only stored in the database.
+type AdminStore struct {
+	db *gorm.DB
+}
+
+// NewAdminStore returns a new AdminStore backed by the given database instance.
+func NewAdminStore(db *gorm.DB) *AdminStore {
+	return &AdminStore{
+		db: db,
+	}
+}
+
+// GetByUsername returns the Admin with the given username if it exists in the database, otherwise nil.
+func (store *AdminStore) GetByUsername(username string) (*model.Admin, error) {
+	var admin model.Admin
+	if err := store.db.Where("username = ?", username).First(&admin).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &admin, nil
+}
+
+// Create persists the given Admin in the database.
+func (store *AdminStore) Create(admin *model.Admin) error {
+	return store.db.Create(admin).Error
+}
+
+// UpdatePassword replaces the password hash of the given Admin.
+func (store *AdminStore) UpdatePassword(admin *model.Admin) error {
+	return store.db.Model(admin).UpdateColumn("password_hash", admin.PasswordHash).Error
+}
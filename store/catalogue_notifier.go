@@ -0,0 +1,208 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// AllSCPs is sent on a CatalogueNotifier's Changes channel when it is unknown which SCPs changed,
+// e.g. after missing notifications, so the whole catalogue must be refreshed.
+const AllSCPs uint = 0
+
+// catalogueChannel is the Postgres notification channel for catalogue changes.
+const catalogueChannel = "scp_catalogue"
+
+// CatalogueNotifier publishes changes to the SCP catalogue (added or edited SCPs) to every app
+// instance sharing the database, so they can patch their SCPCache, see SCPCache.WatchCatalogue.
+type CatalogueNotifier interface {
+	// Notify publishes that the SCP with the given ID was added or edited.
+	Notify(id uint) error
+	// Changes receives the IDs of SCPs changed by any instance, including this one, or AllSCPs.
+	// The channel is closed by Close.
+	Changes() <-chan uint
+	// Close stops receiving changes.
+	Close() error
+}
+
+// NewCatalogueNotifier returns a PostgresNotifier for Postgres databases, otherwise a PollingNotifier
+// checking the catalogue version every pollInterval.
+func NewCatalogueNotifier(db *gorm.DB, dbType string, dbURL string, pollInterval time.Duration) (CatalogueNotifier, error) {
+	if dbType == "postgres" {
+		return NewPostgresNotifier(db, dbURL)
+	}
+	return NewPollingNotifier(db, pollInterval)
+}
+
+// PostgresNotifier publishes catalogue changes with Postgres NOTIFY and receives them with LISTEN.
+type PostgresNotifier struct {
+	db       *gorm.DB
+	listener *pq.Listener
+	changes  chan uint
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewPostgresNotifier listens for catalogue changes on a dedicated connection to dbURL.
+func NewPostgresNotifier(db *gorm.DB, dbURL string) (*PostgresNotifier, error) {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, nil)
+	if err := listener.Listen(catalogueChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	notifier := &PostgresNotifier{
+		db:       db,
+		listener: listener,
+		changes:  make(chan uint, 64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go notifier.run()
+	return notifier, nil
+}
+
+func (notifier *PostgresNotifier) run() {
+	defer close(notifier.done)
+	defer close(notifier.changes)
+	for {
+		var id uint
+		select {
+		case notification := <-notifier.listener.Notify:
+			if notification == nil {
+				// The connection was re-established, notifications may have been missed meanwhile.
+				id = AllSCPs
+			} else if parsed, err := strconv.ParseUint(notification.Extra, 10, 0); err == nil {
+				id = uint(parsed)
+			} else {
+				id = AllSCPs
+			}
+		case <-notifier.stop:
+			return
+		}
+		select {
+		case notifier.changes <- id:
+		case <-notifier.stop:
+			return
+		}
+	}
+}
+
+// Notify implements CatalogueNotifier.
+func (notifier *PostgresNotifier) Notify(id uint) error {
+	return notifier.db.Exec("SELECT pg_notify(?, ?)", catalogueChannel, strconv.FormatUint(uint64(id), 10)).Error
+}
+
+// Changes implements CatalogueNotifier.
+func (notifier *PostgresNotifier) Changes() <-chan uint {
+	return notifier.changes
+}
+
+// Close implements CatalogueNotifier.
+func (notifier *PostgresNotifier) Close() error {
+	var err error
+	notifier.once.Do(func() {
+		close(notifier.stop)
+		<-notifier.done
+		err = notifier.listener.Close()
+	})
+	return err
+}
+
+// PollingNotifier publishes catalogue changes by incrementing a version row in the database and
+// receives them by polling it, for databases without LISTEN/NOTIFY such as SQLite.
+// Since the version does not identify the changed SCPs, every change is received as AllSCPs.
+type PollingNotifier struct {
+	db      *gorm.DB
+	version uint64 // last version seen, only accessed by the polling goroutine
+	changes chan uint
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewPollingNotifier polls the catalogue version every interval.
+func NewPollingNotifier(db *gorm.DB, interval time.Duration) (*PollingNotifier, error) {
+	notifier := &PollingNotifier{
+		db:      db,
+		changes: make(chan uint, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	version, err := notifier.currentVersion()
+	if err != nil {
+		return nil, err
+	}
+	notifier.version = version
+	go notifier.run(interval)
+	return notifier, nil
+}
+
+func (notifier *PollingNotifier) currentVersion() (uint64, error) {
+	var row model.CatalogueVersion
+	if err := notifier.db.Where("id = ?", 1).First(&row).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return row.Version, nil
+}
+
+func (notifier *PollingNotifier) run(interval time.Duration) {
+	defer close(notifier.done)
+	defer close(notifier.changes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Errors are transient (e.g. the database is busy), just try again on the next tick.
+			version, err := notifier.currentVersion()
+			if err != nil || version == notifier.version {
+				continue
+			}
+			notifier.version = version
+			select {
+			case notifier.changes <- AllSCPs:
+			default:
+				// A refresh of all SCPs is already pending.
+			}
+		case <-notifier.stop:
+			return
+		}
+	}
+}
+
+// Notify implements CatalogueNotifier.
+func (notifier *PollingNotifier) Notify(id uint) error {
+	return notifier.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.CatalogueVersion{}).Where("id = ?", 1).UpdateColumn("version", gorm.Expr("version + ?", 1))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Create(&model.CatalogueVersion{ID: 1, Version: 1}).Error
+		}
+		return nil
+	})
+}
+
+// Changes implements CatalogueNotifier.
+func (notifier *PollingNotifier) Changes() <-chan uint {
+	return notifier.changes
+}
+
+// Close implements CatalogueNotifier.
+func (notifier *PollingNotifier) Close() error {
+	notifier.once.Do(func() {
+		close(notifier.stop)
+		<-notifier.done
+	})
+	return nil
+}
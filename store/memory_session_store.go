@@ -0,0 +1,136 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// MemorySessionStore is a SessionRepository keeping everything in memory, for tests and demos.
+// Nothing is persisted between runs. Votes are logged by MemorySCPStore, see MemorySCPStore.Sessions.
+type MemorySessionStore struct {
+	lock     sync.Mutex // guards everything below
+	sessions map[string]model.Session
+	votes    map[string][]model.VoteLog // by session ID, oldest first
+	logged   map[walSeq]bool            // votes logged from a write-ahead log
+	nextID   uint
+}
+
+type walSeq struct {
+	wal string
+	seq uint64
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]model.Session),
+		votes:    make(map[string][]model.VoteLog),
+		logged:   make(map[walSeq]bool),
+		nextID:   1,
+	}
+}
+
+// CreateSession stores a copy of the given session, setting its creation time like the database would.
+func (store *MemorySessionStore) CreateSession(session *model.Session) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+	store.sessions[session.ID] = *session
+	return nil
+}
+
+// GetSession returns a copy of the session with the given ID if it exists, otherwise nil.
+func (store *MemorySessionStore) GetSession(id string) (*model.Session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	session, ok := store.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// RevokeSession sets the revocation time of the session, if it exists and hasn't been revoked already,
+// and deletes its votes.
+func (store *MemorySessionStore) RevokeSession(id string, revokedAt time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	session, ok := store.sessions[id]
+	if ok && session.RevokedAt == nil {
+		session.RevokedAt = &revokedAt
+		store.sessions[id] = session
+	}
+	store.deleteVotes(id)
+	return nil
+}
+
+// DeleteSession deletes the session and its votes.
+func (store *MemorySessionStore) DeleteSession(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.sessions, id)
+	store.deleteVotes(id)
+	return nil
+}
+
+// PurgeSessions deletes the sessions created before the given time and their votes.
+func (store *MemorySessionStore) PurgeSessions(createdBefore time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var purged int64
+	for id, session := range store.sessions {
+		if session.CreatedAt.Before(createdBefore) {
+			delete(store.sessions, id)
+			store.deleteVotes(id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (store *MemorySessionStore) deleteVotes(sessionID string) {
+	// Must hold the lock.
+	for _, vote := range store.votes[sessionID] {
+		delete(store.logged, walSeq{vote.WAL, vote.Seq})
+	}
+	delete(store.votes, sessionID)
+}
+
+// logVotes stores copies of the votes whose sessions exist and haven't been revoked, ignoring votes
+// already logged, see MemorySCPStore.ApplyDeltas.
+func (store *MemorySessionStore) logVotes(votes []model.VoteLog) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, vote := range votes {
+		session, ok := store.sessions[vote.SessionID]
+		if !ok || session.RevokedAt != nil || (vote.WAL != "" && store.logged[walSeq{vote.WAL, vote.Seq}]) {
+			continue
+		}
+		if vote.WAL != "" {
+			store.logged[walSeq{vote.WAL, vote.Seq}] = true
+		}
+		vote.ID = store.nextID
+		store.nextID++
+		store.votes[vote.SessionID] = append(store.votes[vote.SessionID], vote)
+	}
+}
+
+// GetVoteLog returns copies of the votes of the session, oldest first.
+func (store *MemorySessionStore) GetVoteLog(sessionID string) ([]*model.VoteLog, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	logged := store.votes[sessionID]
+	votes := make([]*model.VoteLog, len(logged))
+	for i := range logged {
+		vote := logged[i]
+		votes[i] = &vote
+	}
+	// Votes are logged by concurrent workers, not necessarily in the order they were cast.
+	sort.SliceStable(votes, func(i, j int) bool { return votes[i].CreatedAt.Before(votes[j].CreatedAt) })
+	return votes, nil
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// ErrDuplicateSCP is returned by MemorySCPStore.Create when an SCP with the same name already exists.
+var ErrDuplicateSCP = errors.New("an SCP with that name already exists")
+
+type matchupKey struct {
+	firstID  uint
+	secondID uint
+}
+
+// MemorySCPStore is an SCPRepository keeping everything in memory, for tests and demos.
+// Nothing is persisted between runs.
+type MemorySCPStore struct {
+	lock     sync.Mutex // guards everything below
+	scps     map[uint]model.SCP
+	matchups map[matchupKey]model.Matchup
+	applied  map[string]map[uint64]bool // sequence numbers of applied votes by write-ahead log
+	nextID   uint
+	sessions *MemorySessionStore
+}
+
+// NewMemorySCPStore returns an empty MemorySCPStore.
+func NewMemorySCPStore() *MemorySCPStore {
+	return &MemorySCPStore{
+		scps:     make(map[uint]model.SCP),
+		matchups: make(map[matchupKey]model.Matchup),
+		applied:  make(map[string]map[uint64]bool),
+		nextID:   1,
+		sessions: NewMemorySessionStore(),
+	}
+}
+
+// Sessions returns the MemorySessionStore of the voters, whose votes are logged by ApplyDeltas.
+func (store *MemorySCPStore) Sessions() *MemorySessionStore {
+	return store.sessions
+}
+
+// GetByID returns a copy of the SCP with the given ID if it exists, otherwise nil.
+func (store *MemorySCPStore) GetByID(id uint) (*model.SCP, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	scp, ok := store.scps[id]
+	if !ok {
+		return nil, nil
+	}
+	return &scp, nil
+}
+
+// Create stores a copy of the given SCP, assigning its ID and timestamps like the database would.
+func (store *MemorySCPStore) Create(scp *model.SCP) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, existing := range store.scps {
+		if existing.Name == scp.Name {
+			return fmt.Errorf("cannot create %s: %w", scp.Name, ErrDuplicateSCP)
+		}
+	}
+	scp.ID = store.nextID
+	store.nextID++
+	now := time.Now()
+	scp.CreatedAt = now
+	scp.UpdatedAt = now
+	store.scps[scp.ID] = *scp
+	return nil
+}
+
+// UpdateDetails writes the name, description, image and link of the SCP with the same ID.
+func (store *MemorySCPStore) UpdateDetails(scp *model.SCP) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	existing, ok := store.scps[scp.ID]
+	if !ok {
+		return fmt.Errorf("cannot update details of SCP id %d: %w", scp.ID, ErrSCPNotFound)
+	}
+	existing.Name = scp.Name
+	existing.Description = scp.Description
+	existing.Image = scp.Image
+	existing.Link = scp.Link
+	existing.UpdatedAt = time.Now()
+	store.scps[scp.ID] = existing
+	return nil
+}
+
+// ApplyDeltas adds the deltas to the stored SCPs and matchups, creating matchups as needed, records
+// the votes applied and logs the votes of sessions in Sessions. Deltas of SCPs that do not exist are dropped, along with the deltas of their
+// matchups, and their IDs are returned.
+func (store *MemorySCPStore) ApplyDeltas(scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) (missing []uint, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	for _, delta := range scpDeltas {
+		scp, ok := store.scps[delta.ID]
+		if !ok {
+			missing = append(missing, delta.ID)
+			continue
+		}
+		scp.Rating += delta.Rating
+		scp.Wins = uint64(int64(scp.Wins) + delta.Wins)
+		scp.Losses = uint64(int64(scp.Losses) + delta.Losses)
+		scp.UpdatedAt = now
+		store.scps[delta.ID] = scp
+	}
+	for _, delta := range matchupDeltas {
+		if containsID(missing, delta.FirstID) || containsID(missing, delta.SecondID) {
+			continue
+		}
+		key := matchupKey{delta.FirstID, delta.SecondID}
+		matchup, ok := store.matchups[key]
+		if !ok {
+			matchup = model.Matchup{FirstID: delta.FirstID, SecondID: delta.SecondID}
+		}
+		matchup.FirstWins = uint64(int64(matchup.FirstWins) + delta.FirstWins)
+		matchup.SecondWins = uint64(int64(matchup.SecondWins) + delta.SecondWins)
+		store.matchups[key] = matchup
+	}
+	for _, vote := range applied {
+		if store.applied[vote.WAL] == nil {
+			store.applied[vote.WAL] = make(map[uint64]bool)
+		}
+		store.applied[vote.WAL][vote.Seq] = true
+	}
+	store.sessions.logVotes(logs)
+	return missing, nil
+}
+
+// GetAppliedVotes returns the sequence numbers of the votes of the write-ahead log recorded as applied,
+// in ascending order.
+func (store *MemorySCPStore) GetAppliedVotes(wal string) ([]uint64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	seqs := make([]uint64, 0, len(store.applied[wal]))
+	for seq := range store.applied[wal] {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// ForgetAppliedVotes deletes the records of the votes of the write-ahead log up to the sequence number.
+func (store *MemorySCPStore) ForgetAppliedVotes(wal string, seq uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for applied := range store.applied[wal] {
+		if applied <= seq {
+			delete(store.applied[wal], applied)
+		}
+	}
+	return nil
+}
+
+// GetAllSCPs returns copies of all SCPs, ordered by ID.
+func (store *MemorySCPStore) GetAllSCPs() ([]*model.SCP, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	allSCPs := make([]*model.SCP, 0, len(store.scps))
+	for _, scp := range store.scps {
+		scp := scp
+		allSCPs = append(allSCPs, &scp)
+	}
+	sort.Slice(allSCPs, func(i, j int) bool {
+		return allSCPs[i].ID < allSCPs[j].ID
+	})
+	return allSCPs, nil
+}
+
+// GetAllMatchups returns copies of all head-to-head records, ordered by their SCP IDs.
+func (store *MemorySCPStore) GetAllMatchups() ([]*model.Matchup, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	allMatchups := make([]*model.Matchup, 0, len(store.matchups))
+	for _, matchup := range store.matchups {
+		matchup := matchup
+		allMatchups = append(allMatchups, &matchup)
+	}
+	sort.Slice(allMatchups, func(i, j int) bool {
+		if allMatchups[i].FirstID != allMatchups[j].FirstID {
+			return allMatchups[i].FirstID < allMatchups[j].FirstID
+		}
+		return allMatchups[i].SecondID < allMatchups[j].SecondID
+	})
+	return allMatchups, nil
+}
+
+// Ping always succeeds, there is nothing to connect to.
+func (store *MemorySCPStore) Ping() error {
+	return nil
+}
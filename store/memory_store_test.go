@@ -0,0 +1,203 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/store"
+)
+
+func TestMemorySCPStore(t *testing.T) {
+	memoryStore := store.NewMemorySCPStore()
+	scp049 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	scp096 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	AssertNoError(t, memoryStore.Create(scp049))
+	AssertNoError(t, memoryStore.Create(scp096))
+	AssertEqual(t, scp049.ID, uint(1))
+	AssertEqual(t, scp096.ID, uint(2))
+	// Names are unique, like in the database.
+	AssertError(t, memoryStore.Create(model.NewSCP("SCP-049", "", "", "")))
+
+	// Returned SCPs are copies.
+	scp, err := memoryStore.GetByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertSCPEqual(t, scp, scp049)
+	scp.Rating = 0
+	scp, err = memoryStore.GetByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scp.Rating, 1000.0)
+	scp, err = memoryStore.GetByID(123)
+	AssertNoError(t, err)
+	AssertEqual(t, scp, (*model.SCP)(nil))
+
+	// Deltas are added, creating matchups as needed, dropping those of SCPs that do not exist.
+	deltas := []store.SCPDelta{
+		{ID: scp049.ID, Rating: 10, Wins: 2},
+		{ID: scp096.ID, Rating: -10, Losses: 2},
+	}
+	matchupDeltas := []store.MatchupDelta{{FirstID: scp049.ID, SecondID: scp096.ID, FirstWins: 2}}
+	missing, err := memoryStore.ApplyDeltas(deltas, matchupDeltas, nil, nil)
+	AssertNoError(t, err)
+	AssertEqual(t, len(missing), 0)
+	missing, err = memoryStore.ApplyDeltas(append(deltas, store.SCPDelta{ID: 123, Wins: 1}),
+		append(matchupDeltas, store.MatchupDelta{FirstID: scp049.ID, SecondID: 123, SecondWins: 1}), nil, nil)
+	AssertNoError(t, err)
+	AssertEqual(t, len(missing), 1)
+	AssertEqual(t, missing[0], uint(123))
+	allSCPs, err := memoryStore.GetAllSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, len(allSCPs), 2)
+	AssertEqual(t, allSCPs[0].Rating, 1020.0)
+	AssertEqual(t, allSCPs[0].Wins, uint64(4))
+	AssertEqual(t, allSCPs[1].Rating, 980.0)
+	AssertEqual(t, allSCPs[1].Losses, uint64(4))
+	allMatchups, err := memoryStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(allMatchups), 1)
+	AssertEqual(t, allMatchups[0].FirstWins, uint64(4))
+
+	// Votes are logged with the deltas for sessions that exist, once per vote of a write-ahead log.
+	sessions := memoryStore.Sessions()
+	AssertNoError(t, sessions.CreateSession(&model.Session{ID: "voter"}))
+	AssertNoError(t, sessions.CreateSession(&model.Session{ID: "revoked"}))
+	AssertNoError(t, sessions.RevokeSession("revoked", time.Now()))
+	logs := []model.VoteLog{
+		{SessionID: "voter", WinnerID: scp049.ID, LoserID: scp096.ID, WAL: "a", Seq: 1},
+		{SessionID: "voter", WinnerID: scp096.ID, LoserID: scp049.ID}, // the queue isn't durable
+		{SessionID: "voter", WinnerID: scp096.ID, LoserID: scp049.ID},
+		{SessionID: "deleted", WinnerID: scp049.ID, LoserID: scp096.ID, WAL: "a", Seq: 2},
+		{SessionID: "revoked", WinnerID: scp049.ID, LoserID: scp096.ID, WAL: "a", Seq: 3},
+	}
+	_, err = memoryStore.ApplyDeltas(nil, nil, nil, logs)
+	AssertNoError(t, err)
+	_, err = memoryStore.ApplyDeltas(nil, nil, nil, logs[:1])
+	AssertNoError(t, err)
+	logged, err := sessions.GetVoteLog("voter")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 3)
+	logged, err = sessions.GetVoteLog("deleted")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+	logged, err = sessions.GetVoteLog("revoked")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+
+	// Only the details are updated.
+	edited := *scp049
+	edited.Name = "SCP-049-J"
+	edited.Rating = 0
+	AssertNoError(t, memoryStore.UpdateDetails(&edited))
+	AssertError(t, memoryStore.UpdateDetails(&model.SCP{}))
+	scp, err = memoryStore.GetByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scp.Name, "SCP-049-J")
+	AssertEqual(t, scp.Rating, 1020.0)
+}
+
+func TestSCPCacheMemoryStore(t *testing.T) {
+	// The cache works the same without a database.
+	scpCache := store.NewSCPCache(store.NewMemorySCPStore())
+	scp049 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	scp096 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	AssertNoError(t, scpCache.Create(scp049))
+	AssertNoError(t, scpCache.Create(scp096))
+	for i := 0; i < 3; i++ {
+		AssertNoError(t, scpCache.Vote(scp049.ID, scp096.ID, func(winner *model.SCP, loser *model.SCP) {
+			winner.Rating++
+			loser.Rating--
+			winner.Wins++
+			loser.Losses++
+		}))
+	}
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+	scp, err := scpCache.GetSnapshotByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scp.Wins, uint64(3))
+	matchup, err := scpCache.GetMatchup(scp096.ID, scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, matchup.FirstWins, uint64(3))
+	rankedSCPs, err := scpCache.GetRankedSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, rankedSCPs[0].ID, scp049.ID)
+
+	// Every Create and the synchronisation invalidated the cache, each followed by a load.
+	counters := scpCache.Counters()
+	AssertEqual(t, counters.Invalidations, uint64(3))
+	AssertEqual(t, counters.Misses, uint64(2))
+	AssertTrue(t, counters.Hits > 0, "Expected cache hits")
+	AssertEqual(t, counters.RankingRecomputes, uint64(1))
+	AssertEqual(t, counters.Flushes, uint64(3))
+}
+
+// unavailableRepository simulates a database that can go down.
+type unavailableRepository struct {
+	*store.MemorySCPStore
+	down bool
+}
+
+func (repo *unavailableRepository) ApplyDeltas(scpDeltas []store.SCPDelta, matchupDeltas []store.MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) ([]uint, error) {
+	if repo.down {
+		return nil, errors.New("connection refused")
+	}
+	return repo.MemorySCPStore.ApplyDeltas(scpDeltas, matchupDeltas, applied, logs)
+}
+
+func (repo *unavailableRepository) Ping() error {
+	if repo.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestSCPCacheDegraded(t *testing.T) {
+	repo := &unavailableRepository{MemorySCPStore: store.NewMemorySCPStore()}
+	scpCache := store.NewSCPCache(repo)
+	scp049 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	scp096 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	AssertNoError(t, scpCache.Create(scp049))
+	AssertNoError(t, scpCache.Create(scp096))
+	AssertNoError(t, repo.Sessions().CreateSession(&model.Session{ID: "voter"}))
+	seq := uint64(0)
+	vote := func() {
+		seq++
+		applied := model.AppliedVote{WAL: "a", Seq: seq}
+		voteLog := &model.VoteLog{SessionID: "voter", WinnerID: scp049.ID, LoserID: scp096.ID, WAL: "a", Seq: seq}
+		AssertNoError(t, scpCache.VoteOnce(applied, voteLog, scp049.ID, scp096.ID, func(winner *model.SCP, loser *model.SCP) {
+			winner.Wins++
+			loser.Losses++
+		}))
+	}
+
+	// While the database is down votes are still applied to the cache, but the catalogue is read-only.
+	repo.down = true
+	vote()
+	AssertError(t, scpCache.Flush())
+	AssertTrue(t, scpCache.Degraded(), "Expected the cache to be degraded")
+	AssertTrue(t, !scpCache.Stats().DegradedSince.IsZero(), "Expected the time the cache was degraded")
+	AssertError(t, scpCache.Ping())
+	vote()
+	scp, err := scpCache.GetSnapshotByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scp.Wins, uint64(2))
+	err = scpCache.Create(model.NewSCP("SCP-173", "The Sculpture", "scp_173.jpg", "http://www.scp-wiki.net/scp-173"))
+	AssertTrue(t, errors.Is(err, store.ErrReadOnly), "Expected catalogue changes to be refused")
+	AssertError(t, scpCache.SynchroniseThenInvalidate())
+
+	// Once the database is back the votes are written and the cache recovers.
+	repo.down = false
+	AssertNoError(t, scpCache.Flush())
+	AssertTrue(t, !scpCache.Degraded(), "Expected the cache to recover")
+	AssertTrue(t, scpCache.Stats().DegradedSince.IsZero(), "Expected the degraded time to be reset")
+	stored, err := repo.GetByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, stored.Wins, uint64(2))
+	logged, err := repo.Sessions().GetVoteLog("voter")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 2)
+	seqs, err := repo.GetAppliedVotes("a")
+	AssertNoError(t, err)
+	AssertEqual(t, len(seqs), 2)
+	AssertNoError(t, scpCache.Create(model.NewSCP("SCP-173", "The Sculpture", "scp_173.jpg", "http://www.scp-wiki.net/scp-173")))
+}
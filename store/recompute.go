@@ -0,0 +1,76 @@
+package store
+
+import (
+	"math"
+	"sort"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// Recompute rebuilds every SCP's rating, wins and losses from the head-to-head matchups, replaying their
+// results from the initial rating with the Elo K-factor k, e.g. after changing k. Returns the deltas that
+// bring the SCPs to the recomputed values, for ApplyDeltas, omitting SCPs that are unchanged.
+//
+// Individual votes are not stored, so their order is approximated: the matchups are replayed in rounds
+// of one result each, with each matchup's wins interleaved evenly between the two SCPs.
+// Votes cast before matchups were recorded are lost.
+func Recompute(scps []*model.SCP, matchups []*model.Matchup, k float64) []SCPDelta {
+	replayed := make(map[uint]*model.SCP, len(scps))
+	for _, scp := range scps {
+		replayed[scp.ID] = &model.SCP{Rating: model.InitialRating}
+	}
+	sorted := make([]*model.Matchup, 0, len(matchups))
+	for _, matchup := range matchups {
+		// Matchups of deleted SCPs are ignored.
+		if replayed[matchup.FirstID] != nil && replayed[matchup.SecondID] != nil {
+			sorted = append(sorted, matchup)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].FirstID != sorted[j].FirstID {
+			return sorted[i].FirstID < sorted[j].FirstID
+		}
+		return sorted[i].SecondID < sorted[j].SecondID
+	})
+
+	played := make([]uint64, len(sorted))
+	firstWins := make([]uint64, len(sorted))
+	for remaining := true; remaining; {
+		remaining = false
+		for i, matchup := range sorted {
+			total := matchup.FirstWins + matchup.SecondWins
+			if played[i] == total {
+				continue
+			}
+			remaining = true
+			first, second := replayed[matchup.FirstID], replayed[matchup.SecondID]
+			// The first SCP wins whenever it is behind its share of the results played so far.
+			if firstWins[i]*total < matchup.FirstWins*(played[i]+1) {
+				model.UpdateEloRatings(first, second, k)
+				firstWins[i]++
+			} else {
+				model.UpdateEloRatings(second, first, k)
+			}
+			played[i]++
+		}
+	}
+
+	var deltas []SCPDelta
+	for _, scp := range scps {
+		target := replayed[scp.ID]
+		delta := SCPDelta{
+			ID:     scp.ID,
+			Rating: target.Rating - scp.Rating,
+			Wins:   int64(target.Wins) - int64(scp.Wins),
+			Losses: int64(target.Losses) - int64(scp.Losses),
+		}
+		if math.Abs(delta.Rating) < 1e-9 {
+			// Rounding error, e.g. from ratings stored as numeric in Postgres.
+			delta.Rating = 0
+		}
+		if delta.Rating != 0 || delta.Wins != 0 || delta.Losses != 0 {
+			deltas = append(deltas, delta)
+		}
+	}
+	return deltas
+}
@@ -0,0 +1,91 @@
+package store_test
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/cycraig/scpbattle/db"
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/store"
+)
+
+func TestRecompute(t *testing.T) {
+	newSCP := func(id uint) *model.SCP {
+		scp := model.NewSCP(fmt.Sprint("SCP-", id), "", "", "")
+		scp.ID = id
+		return scp
+	}
+	scps := []*model.SCP{newSCP(1), newSCP(2), newSCP(3), newSCP(4)}
+	// SCP 1 beat SCP 2 twice and lost once, and lost to SCP 3. The stored records have drifted.
+	scps[0].Wins = 5
+	matchups := []*model.Matchup{
+		{FirstID: 1, SecondID: 3, FirstWins: 0, SecondWins: 1},
+		{FirstID: 1, SecondID: 2, FirstWins: 2, SecondWins: 1},
+		{FirstID: 2, SecondID: 99, FirstWins: 7, SecondWins: 0}, // deleted SCP
+	}
+
+	// The results are replayed in rounds of one result per matchup, in order of their IDs.
+	expected := []*model.SCP{newSCP(1), newSCP(2), newSCP(3), newSCP(4)}
+	k := 32.0
+	model.UpdateEloRatings(expected[0], expected[1], k) // round 1
+	model.UpdateEloRatings(expected[2], expected[0], k)
+	model.UpdateEloRatings(expected[0], expected[1], k) // round 2
+	model.UpdateEloRatings(expected[1], expected[0], k) // round 3
+
+	deltas := store.Recompute(scps, matchups, k)
+	AssertEqual(t, 3, len(deltas)) // SCP 4 is unchanged
+	for _, delta := range deltas {
+		scp, want := scps[delta.ID-1], expected[delta.ID-1]
+		AssertTrue(t, math.Abs(scp.Rating+delta.Rating-want.Rating) < 1e-9, "recomputed rating")
+		AssertEqual(t, int64(want.Wins), int64(scp.Wins)+delta.Wins)
+		AssertEqual(t, int64(want.Losses), int64(scp.Losses)+delta.Losses)
+	}
+
+	// Applying the deltas brings the SCPs up to date.
+	memoryStore := store.NewMemorySCPStore()
+	for _, scp := range scps {
+		scp.ID = 0
+		AssertNoError(t, memoryStore.Create(scp))
+	}
+	_, err := memoryStore.ApplyDeltas(deltas, nil, nil, nil)
+	AssertNoError(t, err)
+	recomputed, err := memoryStore.GetAllSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, 0, len(store.Recompute(recomputed, matchups, k)))
+}
+
+func TestAdminStore(t *testing.T) {
+	fdb := "TestAdminStore.db"
+	os.Remove(fdb)
+	d := db.NewDB("sqlite3", fdb, false)
+	defer func() {
+		d.Close()
+		os.Remove(fdb)
+	}()
+	admins := store.NewAdminStore(d)
+
+	admin, err := model.NewAdmin("alice", "correct horse battery")
+	AssertNoError(t, err)
+	AssertNotEqual(t, "correct horse battery", admin.PasswordHash)
+	AssertNoError(t, admins.Create(admin))
+	other, err := model.NewAdmin("alice", "another password")
+	AssertNoError(t, err)
+	AssertError(t, admins.Create(other)) // unique username
+
+	stored, err := admins.GetByUsername("alice")
+	AssertNoError(t, err)
+	AssertTrue(t, stored != nil && stored.CheckPassword("correct horse battery"), "password matches")
+	AssertTrue(t, !stored.CheckPassword("correct horse"), "wrong password")
+
+	stored.PasswordHash = other.PasswordHash
+	AssertNoError(t, admins.UpdatePassword(stored))
+	stored, err = admins.GetByUsername("alice")
+	AssertNoError(t, err)
+	AssertTrue(t, stored.CheckPassword("another password"), "password changed")
+
+	missing, err := admins.GetByUsername("bob")
+	AssertNoError(t, err)
+	AssertTrue(t, missing == nil, "unknown admin")
+}
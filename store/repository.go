@@ -0,0 +1,63 @@
+package store
+
+import (
+	"time"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// SCPRepository persists SCPs and their head-to-head records for the SCPCache.
+// SCPStore is the default, database-backed implementation; MemorySCPStore keeps everything in memory.
+//
+// SCPs and matchups returned by a repository belong to the caller, which may change them freely.
+type SCPRepository interface {
+	// GetByID returns the SCP with the given ID if it exists, otherwise nil.
+	GetByID(id uint) (*model.SCP, error)
+	// Create persists the given SCP, assigning its ID. SCP names are unique.
+	Create(scp *model.SCP) error
+	// UpdateDetails writes the name, description, image and link of an existing SCP.
+	UpdateDetails(scp *model.SCP) error
+	// ApplyDeltas atomically adds the deltas to the ratings, records and matchups, all or none of them,
+	// recording the votes they include as applied and logging the votes of sessions, see SessionRepository.
+	// Deltas of SCPs that no longer exist are dropped, along with the deltas of their matchups, and their
+	// IDs are returned. Votes of sessions that were revoked or deleted, or already logged, are dropped.
+	ApplyDeltas(scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) (missing []uint, err error)
+	// GetAppliedVotes returns the sequence numbers of the votes of a write-ahead log recorded as applied.
+	GetAppliedVotes(wal string) ([]uint64, error)
+	// ForgetAppliedVotes deletes the records of the votes of a write-ahead log up to a sequence number,
+	// once the log no longer holds them.
+	ForgetAppliedVotes(wal string, seq uint64) error
+	// GetAllSCPs returns every SCP.
+	GetAllSCPs() ([]*model.SCP, error)
+	// GetAllMatchups returns every head-to-head record.
+	GetAllMatchups() ([]*model.Matchup, error)
+	// Ping checks whether the repository is reachable.
+	Ping() error
+}
+
+// SessionRepository persists anonymous voter sessions and the votes they cast.
+// SessionStore is the default, database-backed implementation; MemorySessionStore keeps everything in memory.
+type SessionRepository interface {
+	// CreateSession persists a new session.
+	CreateSession(session *model.Session) error
+	// GetSession returns the session with the given ID if it exists, otherwise nil.
+	GetSession(id string) (*model.Session, error)
+	// RevokeSession marks the session as revoked and deletes every vote it cast. The session is kept until
+	// it is purged, see PurgeSessions.
+	RevokeSession(id string, revokedAt time.Time) error
+	// DeleteSession deletes the session and every vote it cast.
+	DeleteSession(id string) error
+	// PurgeSessions deletes the sessions created before the given time, revoked or not, and every vote
+	// they cast, returning how many sessions were deleted.
+	PurgeSessions(createdBefore time.Time) (int64, error)
+	// GetVoteLog returns the votes cast by the session, oldest first.
+	GetVoteLog(sessionID string) ([]*model.VoteLog, error)
+}
+
+// Ensure the implementations satisfy the interfaces.
+var (
+	_ SCPRepository     = (*SCPStore)(nil)
+	_ SCPRepository     = (*MemorySCPStore)(nil)
+	_ SessionRepository = (*SessionStore)(nil)
+	_ SessionRepository = (*MemorySessionStore)(nil)
+)
@@ -6,163 +6,834 @@ import (
 	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/labstack/gommon/log"
+
 	"github.com/cycraig/scpbattle/model"
 )
 
+// ErrSCPNotFound is returned when an operation refers to an SCP ID that is not in the cache.
+var ErrSCPNotFound = errors.New("SCP not found")
+
+// ErrReadOnly is returned by catalogue changes while the cache is degraded, i.e. the database is unavailable.
+var ErrReadOnly = errors.New("the database is unavailable, SCPs cannot be added or edited")
+
+// Logger is the subset of echo.Logger used by the cache.
+type Logger interface {
+	Warnj(j log.JSON)
+}
+
 // SCPCache caches SCP instances from the database in memory to avoid slow calls on every request.
+//
+// All cached SCPs and matchups are owned by the cache and guarded by its lock: votes are applied
+// through Vote while holding the lock, and readers receive copies (GetSnapshotByID, GetRandomSCPs,
+// GetRankedSCPs, GetMatchup) so they never observe a partially applied vote.
+//
+// Changes are written back as deltas relative to the values last read from the database, so that
+// multiple app instances sharing a database do not overwrite each other's votes. See Refresh.
+// Catalogue changes (added or edited SCPs) are exchanged between instances, see WatchCatalogue.
+//
+// If the database becomes unavailable the cache is degraded: votes are still applied and served from
+// memory and written back once the database is available again, but the catalogue is read-only.
 type SCPCache struct {
+	// 64-bit counters accessed atomically come first, to be aligned on 32-bit platforms
+	hits              uint64
+	misses            uint64
+	invalidations     uint64
+	rankingRecomputes uint64
 	// lowercase => do not expose/export these variables
-	scpStore           *SCPStore
-	scpMap             map[uint]*model.SCP // use getSCPMap() exclusively
-	scpIDs             []uint              // holds the keys of the scpMap to simplify random lookups
+	scpStore           SCPRepository
+	scpMap             map[uint]*model.SCP              // guarded by lock, use rlock()/wlock() exclusively
+	scpIDs             []uint                           // holds the keys of the scpMap to simplify random lookups
+	matchups           map[uint]map[uint]*model.Matchup // head-to-head records indexed by both SCP IDs
+	dirty              map[uint]bool                    // which SCPs need to be written back to the database
+	dirtyMatchups      map[*model.Matchup]bool          // which matchups need to be written back to the database
+	persisted          map[uint]scpCounters             // SCP ratings and records as last read from or written to the database
+	persistedMatchups  map[*model.Matchup]model.Matchup // matchups as last read from or written to the database
+	applied            []model.AppliedVote              // votes applied since the last write back, see VoteOnce
+	logs               []model.VoteLog                  // votes of sessions applied since the last write back
+	lock               sync.RWMutex                     // guards all of the above
 	scpListRanked      []model.SCP
-	lastUpdated        time.Time
-	updateTTL          time.Duration // default 10 seconds
 	rankingLastUpdated time.Time
 	rankingTTL         time.Duration // default 5 seconds
-	dirty              map[uint]bool // which SCPs need to be written back to the database
-	lock               sync.Mutex
-	updateLock         sync.Mutex
-	rankingsLock       sync.Mutex
+	rankingsLock       sync.Mutex    // guards scpListRanked and rankingLastUpdated
+	lastUpdated        int64         // unix nanoseconds of the last write back, accessed atomically
+	updateTTL          time.Duration // default 10 seconds
+	updateLock         sync.Mutex    // serialises writes back to the database
+	flusherRunning     int32         // accessed atomically, 1 while the background flusher is running
+	flusherStop        chan struct{} // closed to stop the background flusher
+	flusherDone        chan struct{} // closed once the background flusher has stopped
+	flusherLock        sync.Mutex
+	stats              FlushStats
+	flushes            uint64  // guarded by statsLock, see CacheCounters
+	flushSeconds       float64 // guarded by statsLock
+	statsLock          sync.Mutex
+	notifier           CatalogueNotifier // nil unless watching the catalogue
+	notifierLock       sync.Mutex        // guards notifier
+	logger             Logger            // nil unless set, guarded by statsLock, see SetLogger
 }
 
-// NewSCPCache instantiates a new SCPCache with the default cache TTL durations.
-func NewSCPCache(scpStore *SCPStore) *SCPCache {
+// FlushStats describes how recently the cache was written back to the database, e.g. for health checks.
+type FlushStats struct {
+	LastFlush         time.Time     `json:"lastFlush"` // zero if never flushed successfully
+	LastFlushDuration time.Duration `json:"lastFlushDuration"`
+	LastError         string        `json:"lastError,omitempty"`
+	Failures          uint64        `json:"failures"` // total number of failed flushes, after retries
+	DirtySCPs         int           `json:"dirtySCPs"`
+	DirtyMatchups     int           `json:"dirtyMatchups"`
+	FlushInterval     time.Duration `json:"flushInterval"` // of the background flusher, zero if not running
+	Degraded          bool          `json:"degraded"`      // the last flush failed, catalogue changes are refused
+	DegradedSince     time.Time     `json:"degradedSince"` // zero if not degraded
+}
+
+// CacheCounters are totals since the cache was created, e.g. for metrics.
+type CacheCounters struct {
+	Hits              uint64  // accesses served by the loaded cache
+	Misses            uint64  // accesses that had to load the cache from the database
+	Invalidations     uint64  // successful calls to SynchroniseThenInvalidate
+	RankingRecomputes uint64  // times the ranked list was sorted again, see GetRankedSCPs
+	Flushes           uint64  // writes back to the database, successful or not
+	FlushSeconds      float64 // total time spent writing back to the database, including retries
+}
+
+// scpCounters holds the fields of an SCP that votes change.
+type scpCounters struct {
+	rating float64
+	wins   uint64
+	losses uint64
+}
+
+func countersOf(scp *model.SCP) scpCounters {
+	return scpCounters{
+		rating: scp.Rating,
+		wins:   scp.Wins,
+		losses: scp.Losses,
+	}
+}
+
+const (
+	// flushRetries is the number of times a failed flush is retried before giving up until the next flush.
+	flushRetries = 3
+	// flushRetryDelay is the delay before the first retry, doubling on every subsequent retry.
+	flushRetryDelay = 100 * time.Millisecond
+)
+
+// NewSCPCache instantiates a new SCPCache backed by the repository with the default cache TTL durations.
+func NewSCPCache(scpStore SCPRepository) *SCPCache {
 	return NewSCPCacheWithDuration(scpStore, 10*time.Second, 5*time.Second)
 }
 
 // NewSCPCacheWithDuration instantiates a new SCPCache with the specified cache TTL durations.
-func NewSCPCacheWithDuration(scpStore *SCPStore, updateTTL time.Duration, rankingTTL time.Duration) *SCPCache {
+func NewSCPCacheWithDuration(scpStore SCPRepository, updateTTL time.Duration, rankingTTL time.Duration) *SCPCache {
 	return &SCPCache{
-		scpStore:   scpStore,
-		updateTTL:  updateTTL,
-		rankingTTL: rankingTTL,
-		dirty:      make(map[uint]bool),
+		scpStore:      scpStore,
+		updateTTL:     updateTTL,
+		rankingTTL:    rankingTTL,
+		dirty:         make(map[uint]bool),
+		dirtyMatchups: make(map[*model.Matchup]bool),
 	}
 }
 
-func (cache *SCPCache) getSCPMap() (*map[uint]*model.SCP, error) {
-	if cache.scpMap == nil {
-		cache.lock.Lock()
-		defer cache.lock.Unlock()
-		if cache.scpMap == nil {
-			allSCPs, err := cache.scpStore.GetAllSCPs()
-			if err != nil {
-				return nil, err
-			}
-			scpMap := make(map[uint]*model.SCP)
-			scpIDs := make([]uint, len(allSCPs))
-			for i, scp := range allSCPs {
-				scpMap[scp.ID] = scp
-				scpIDs[i] = scp.ID
+// SetLogger sets the logger warning about votes for SCPs deleted from the database, which are dropped
+// when writing back.
+func (cache *SCPCache) SetLogger(logger Logger) {
+	cache.statsLock.Lock()
+	cache.logger = logger
+	cache.statsLock.Unlock()
+}
+
+func (cache *SCPCache) rlock() error {
+	// Acquires the read lock with the SCPs loaded from the database, the caller must RUnlock.
+	for first := true; ; first = false {
+		cache.lock.RLock()
+		if cache.scpMap != nil {
+			if first {
+				atomic.AddUint64(&cache.hits, 1)
 			}
-			cache.scpMap = scpMap
-			cache.scpIDs = scpIDs
+			return nil
+		}
+		cache.lock.RUnlock()
+		if err := cache.wlock(); err != nil {
+			return err
+		}
+		cache.lock.Unlock()
+	}
+}
+
+func (cache *SCPCache) wlock() error {
+	// Acquires the write lock with the SCPs loaded from the database, the caller must Unlock.
+	cache.lock.Lock()
+	if cache.scpMap == nil {
+		atomic.AddUint64(&cache.misses, 1)
+		if err := cache.load(); err != nil {
+			cache.lock.Unlock()
+			return err
 		}
 	}
-	return &cache.scpMap, nil
+	return nil
+}
+
+func (cache *SCPCache) load() error {
+	// Populates the cache from the database, must hold the write lock.
+	allSCPs, err := cache.scpStore.GetAllSCPs()
+	if err != nil {
+		return err
+	}
+	allMatchups, err := cache.scpStore.GetAllMatchups()
+	if err != nil {
+		return err
+	}
+	scpMap := make(map[uint]*model.SCP)
+	scpIDs := make([]uint, len(allSCPs))
+	cache.persisted = make(map[uint]scpCounters)
+	for i, scp := range allSCPs {
+		scpMap[scp.ID] = scp
+		scpIDs[i] = scp.ID
+		cache.persisted[scp.ID] = countersOf(scp)
+	}
+	cache.matchups = make(map[uint]map[uint]*model.Matchup)
+	cache.persistedMatchups = make(map[*model.Matchup]model.Matchup)
+	for _, matchup := range allMatchups {
+		cache.indexMatchup(matchup)
+		cache.persistedMatchups[matchup] = *matchup
+	}
+	cache.scpMap = scpMap
+	cache.scpIDs = scpIDs
+	return nil
 }
 
 // GetByID returns a reference to the SCP with the given ID if it exists, otherwise nil.
+// The reference is managed by the cache and changes while votes and catalogue changes are applied,
+// use GetSnapshotByID to read its fields concurrently.
 func (cache *SCPCache) GetByID(id uint) (*model.SCP, error) {
-	scpMap, err := cache.getSCPMap()
-	if err != nil {
+	if err := cache.rlock(); err != nil {
 		return nil, err
 	}
-	scpRef := (*scpMap)[id]
-	return scpRef, nil
+	defer cache.lock.RUnlock()
+	return cache.scpMap[id], nil
+}
+
+// GetSnapshotByID returns a copy of the SCP with the given ID if it exists, otherwise nil.
+func (cache *SCPCache) GetSnapshotByID(id uint) (*model.SCP, error) {
+	if err := cache.rlock(); err != nil {
+		return nil, err
+	}
+	defer cache.lock.RUnlock()
+	scpRef, ok := cache.scpMap[id]
+	if !ok {
+		return nil, nil
+	}
+	scp := *scpRef
+	return &scp, nil
 }
 
 // Create adds the SCP reference to the database immediately, unless the database already contains the entry.
+// Other app instances are notified if the cache is watching the catalogue.
+// Returns ErrReadOnly if the cache is degraded.
 func (cache *SCPCache) Create(scp *model.SCP) error {
+	if cache.Degraded() {
+		return ErrReadOnly
+	}
 	// Creating a new SCP requires synchronising the map and database, since a new entry is added
 	if err := cache.scpStore.Create(scp); err != nil {
 		return err
 	}
 	cache.SynchroniseThenInvalidate()
+	return cache.notify(scp.ID)
+}
+
+// UpdateDetails writes the catalogue details (name, description, image and link) of the given SCP to
+// the database immediately and updates the cached SCP with the same ID. Its rating and record are ignored.
+// Other app instances are notified if the cache is watching the catalogue.
+// Returns ErrReadOnly if the cache is degraded.
+func (cache *SCPCache) UpdateDetails(scp *model.SCP) error {
+	if cache.Degraded() {
+		return ErrReadOnly
+	}
+	if err := cache.scpStore.UpdateDetails(scp); err != nil {
+		return err
+	}
+	if err := cache.wlock(); err != nil {
+		return err
+	}
+	if cached, ok := cache.scpMap[scp.ID]; ok {
+		copyDetails(cached, scp)
+	}
+	cache.lock.Unlock()
+	cache.invalidateRankings()
+	return cache.notify(scp.ID)
+}
+
+func copyDetails(dst *model.SCP, src *model.SCP) {
+	dst.Name = src.Name
+	dst.Description = src.Description
+	dst.Image = src.Image
+	dst.Link = src.Link
+}
+
+func (cache *SCPCache) invalidateRankings() {
+	cache.rankingsLock.Lock()
+	cache.scpListRanked = nil
+	cache.rankingsLock.Unlock()
+}
+
+func (cache *SCPCache) notify(id uint) error {
+	cache.notifierLock.Lock()
+	notifier := cache.notifier
+	cache.notifierLock.Unlock()
+	if notifier == nil {
+		return nil
+	}
+	if err := notifier.Notify(id); err != nil {
+		return fmt.Errorf("SCP id %d was saved but other instances were not notified: %w", id, err)
+	}
 	return nil
 }
 
+// WatchCatalogue publishes catalogue changes made through this cache with the notifier, and patches
+// the cache with changes received from it in a background goroutine, until the notifier is closed.
+// If a change cannot be applied the whole cache is invalidated instead.
+func (cache *SCPCache) WatchCatalogue(notifier CatalogueNotifier) {
+	cache.notifierLock.Lock()
+	cache.notifier = notifier
+	cache.notifierLock.Unlock()
+	go func() {
+		for id := range notifier.Changes() {
+			if err := cache.applyCatalogueChange(id); err != nil {
+				cache.SynchroniseThenInvalidate()
+			}
+		}
+	}()
+}
+
+func (cache *SCPCache) applyCatalogueChange(id uint) error {
+	defer cache.invalidateRankings()
+	if id == AllSCPs {
+		return cache.Refresh()
+	}
+	// Holding updateLock ensures no write back is in progress, so the baseline for a new SCP is consistent.
+	cache.updateLock.Lock()
+	defer cache.updateLock.Unlock()
+	dbSCP, err := cache.scpStore.GetByID(id)
+	if err != nil || dbSCP == nil {
+		return err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.scpMap == nil {
+		// Invalidated, the next access loads everything anyway.
+		return nil
+	}
+	if scp, ok := cache.scpMap[id]; ok {
+		copyDetails(scp, dbSCP)
+	} else {
+		cache.addSCP(dbSCP)
+	}
+	return nil
+}
+
+func (cache *SCPCache) addSCP(scp *model.SCP) {
+	// Adds an SCP read from the database, must hold the write lock.
+	cache.scpMap[scp.ID] = scp
+	cache.scpIDs = append(cache.scpIDs, scp.ID)
+	cache.persisted[scp.ID] = countersOf(scp)
+}
+
+func (cache *SCPCache) removeSCPs(ids []uint) {
+	// Removes SCPs deleted from the database, along with their matchups and changes, must hold the write
+	// lock. Call invalidateRankings once the lock is released.
+	if cache.scpMap == nil {
+		return
+	}
+	for _, id := range ids {
+		if _, ok := cache.scpMap[id]; !ok {
+			continue
+		}
+		delete(cache.scpMap, id)
+		delete(cache.dirty, id)
+		delete(cache.persisted, id)
+		for opponent, matchup := range cache.matchups[id] {
+			delete(cache.matchups[opponent], id)
+			delete(cache.dirtyMatchups, matchup)
+			delete(cache.persistedMatchups, matchup)
+		}
+		delete(cache.matchups, id)
+		for i, other := range cache.scpIDs {
+			if other == id {
+				// Copied, readers may still hold the old slice.
+				cache.scpIDs = append(cache.scpIDs[:i:i], cache.scpIDs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
 // SynchroniseThenInvalidate writes changes back to the database and invalidates the cache.
-func (cache *SCPCache) SynchroniseThenInvalidate() (err error) {
+// The cache is left intact if the changes could not be written.
+func (cache *SCPCache) SynchroniseThenInvalidate() error {
 	// Write changes back to the database then invalidate cached SCP collections,
 	// causing us to re-fetch the database contents.
+	// The write lock is held throughout so no vote can land between writing and invalidating.
 	cache.updateLock.Lock()
 	defer cache.updateLock.Unlock()
-	err = cache.synchroniseDatabase()
 	cache.lock.Lock()
-	defer cache.lock.Unlock()
+	scpDeltas, matchupDeltas, applied, logs := cache.takeDirty()
+	// SCPs deleted from the database are dropped along with the rest of the cache.
+	if _, err := cache.writeBack(scpDeltas, matchupDeltas, applied, logs); err != nil {
+		cache.restoreDirty(scpDeltas, matchupDeltas, applied, logs)
+		cache.lock.Unlock()
+		return err
+	}
 	cache.scpMap = nil
-	cache.scpListRanked = nil
 	cache.scpIDs = nil
-	return err
+	cache.matchups = nil
+	cache.persisted = nil
+	cache.persistedMatchups = nil
+	cache.lock.Unlock()
+	atomic.AddUint64(&cache.invalidations, 1)
+
+	cache.invalidateRankings()
+	return nil
+}
+
+// DirtyCount returns the number of SCPs and matchups with changes not yet written to the database.
+func (cache *SCPCache) DirtyCount() (scps int, matchups int) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return len(cache.dirty), len(cache.dirtyMatchups)
+}
+
+// StartFlusher starts a background goroutine writing changes back to the database every interval,
+// instead of during calls to Update, then refreshing the cache with changes from other app instances.
+// Does nothing if the flusher is already running.
+func (cache *SCPCache) StartFlusher(interval time.Duration) {
+	cache.flusherLock.Lock()
+	defer cache.flusherLock.Unlock()
+	if cache.flusherStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	cache.flusherStop = stop
+	cache.flusherDone = done
+	atomic.StoreInt32(&cache.flusherRunning, 1)
+	cache.statsLock.Lock()
+	cache.stats.FlushInterval = interval
+	cache.statsLock.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Failures are recorded in the stats and retried on the next tick.
+				if cache.Flush() == nil {
+					cache.Refresh()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopFlusher stops the background flusher and waits for any flush in progress to finish.
+// Changes made afterwards are written during calls to Update again.
+func (cache *SCPCache) StopFlusher() {
+	cache.flusherLock.Lock()
+	defer cache.flusherLock.Unlock()
+	if cache.flusherStop == nil {
+		return
+	}
+	close(cache.flusherStop)
+	<-cache.flusherDone
+	cache.flusherStop = nil
+	cache.flusherDone = nil
+	atomic.StoreInt32(&cache.flusherRunning, 0)
+	cache.statsLock.Lock()
+	cache.stats.FlushInterval = 0
+	cache.statsLock.Unlock()
+}
+
+// Stats returns the current FlushStats of the cache.
+func (cache *SCPCache) Stats() FlushStats {
+	cache.statsLock.Lock()
+	stats := cache.stats
+	cache.statsLock.Unlock()
+	stats.DirtySCPs, stats.DirtyMatchups = cache.DirtyCount()
+	return stats
+}
+
+// Counters returns the CacheCounters of the cache.
+func (cache *SCPCache) Counters() CacheCounters {
+	cache.statsLock.Lock()
+	flushes, flushSeconds := cache.flushes, cache.flushSeconds
+	cache.statsLock.Unlock()
+	return CacheCounters{
+		Hits:              atomic.LoadUint64(&cache.hits),
+		Misses:            atomic.LoadUint64(&cache.misses),
+		Invalidations:     atomic.LoadUint64(&cache.invalidations),
+		RankingRecomputes: atomic.LoadUint64(&cache.rankingRecomputes),
+		Flushes:           flushes,
+		FlushSeconds:      flushSeconds,
+	}
+}
+
+// Degraded returns whether the last write back to the database failed. Votes are kept in memory
+// meanwhile and catalogue changes are refused, until a flush succeeds again.
+func (cache *SCPCache) Degraded() bool {
+	cache.statsLock.Lock()
+	defer cache.statsLock.Unlock()
+	return cache.stats.Degraded
+}
+
+// Ping checks whether the underlying store is reachable.
+func (cache *SCPCache) Ping() error {
+	return cache.scpStore.Ping()
 }
 
 // Update marks SCP references as changed.
-// Changes are written to the database whenever this function is called at least updateTTL seconds apart.
+// Changes are written to the database by the background flusher if it is running, see StartFlusher.
+// Otherwise they are written whenever this function is called at least updateTTL seconds apart.
+//
+// The caller must be the only goroutine changing the references, use Vote to apply concurrent changes.
 func (cache *SCPCache) Update(scpRef ...*model.SCP) error {
-	scpMap, err := cache.getSCPMap()
-	if err != nil {
+	if err := cache.wlock(); err != nil {
 		return err
 	}
 	// The reference to the SCP object already has the changes, just mark it as dirty.
 	for _, scp := range scpRef {
 		// Ensure the scpRef is in the map, otherwise the changes are in an instance not managed by the cache!
-		if mapSCP, ok := (*scpMap)[scp.ID]; !ok || mapSCP != scp {
-			return errors.New("cannot update SCP instance not from the cache; use GetByID/GetRandomSCPs")
+		if mapSCP, ok := cache.scpMap[scp.ID]; !ok || mapSCP != scp {
+			cache.lock.Unlock()
+			return errors.New("cannot update SCP instance not from the cache; use GetByID")
 		}
 		cache.dirty[scp.ID] = true
 	}
-	if cache.lastUpdated.IsZero() || time.Now().After(cache.lastUpdated.Add(cache.updateTTL)) {
+	cache.lock.Unlock()
+	return cache.synchroniseIfExpired()
+}
+
+// Vote applies the outcome of a single vote between two SCPs.
+// The apply function updates the ratings and records of the given references while the cache is
+// locked, so it must not call back into the cache. The head-to-head record is updated as well.
+func (cache *SCPCache) Vote(winnerID uint, loserID uint, apply func(winner *model.SCP, loser *model.SCP)) error {
+	return cache.VoteOnce(model.AppliedVote{}, nil, winnerID, loserID, apply)
+}
+
+// VoteOnce is Vote for a vote from the write-ahead log of a vote queue: the vote is recorded as applied
+// in the same transaction as its changes, so that it can be skipped if the log is replayed after a
+// crash, see SCPRepository.GetAppliedVotes. Nothing is recorded if applied.WAL is empty.
+// The vote is logged for its session in the same transaction, unless voteLog is nil.
+func (cache *SCPCache) VoteOnce(applied model.AppliedVote, voteLog *model.VoteLog, winnerID uint, loserID uint, apply func(winner *model.SCP, loser *model.SCP)) error {
+	if winnerID == loserID {
+		return fmt.Errorf("cannot vote for SCP id %d against itself", winnerID)
+	}
+	if err := cache.wlock(); err != nil {
+		return err
+	}
+	winner, ok := cache.scpMap[winnerID]
+	if !ok {
+		cache.lock.Unlock()
+		return fmt.Errorf("%w: id %d", ErrSCPNotFound, winnerID)
+	}
+	loser, ok := cache.scpMap[loserID]
+	if !ok {
+		cache.lock.Unlock()
+		return fmt.Errorf("%w: id %d", ErrSCPNotFound, loserID)
+	}
+	apply(winner, loser)
+	cache.dirty[winnerID] = true
+	cache.dirty[loserID] = true
+	cache.recordMatchup(winnerID, loserID)
+	if applied.WAL != "" {
+		cache.applied = append(cache.applied, applied)
+	}
+	if voteLog != nil {
+		cache.logs = append(cache.logs, *voteLog)
+	}
+	cache.lock.Unlock()
+	return cache.synchroniseIfExpired()
+}
+
+func (cache *SCPCache) synchroniseIfExpired() error {
+	if atomic.LoadInt32(&cache.flusherRunning) == 1 {
+		// The background flusher takes care of writing changes back.
+		return nil
+	}
+	if cache.updateExpired() {
 		cache.updateLock.Lock()
 		defer cache.updateLock.Unlock()
 		// Double check in case another goroutine already updated and this one was waiting.
-		if cache.lastUpdated.IsZero() || time.Now().After(cache.lastUpdated.Add(cache.updateTTL)) {
+		if cache.updateExpired() {
 			return cache.synchroniseDatabase()
 		}
 	}
 	return nil
 }
 
-func (cache *SCPCache) forceUpdate(scpRef *model.SCP) error {
-	// Writes the object back to the database immediately.
-	cache.dirty[scpRef.ID] = false
-	return cache.scpStore.Update(scpRef)
+func (cache *SCPCache) updateExpired() bool {
+	lastUpdated := atomic.LoadInt64(&cache.lastUpdated)
+	return lastUpdated == 0 || time.Now().After(time.Unix(0, lastUpdated).Add(cache.updateTTL))
 }
 
-func (cache *SCPCache) synchroniseDatabase() (err error) {
-	// Check which SCP objects are invalid and write them back to the database.
-	scpMap, err := cache.getSCPMap()
+// Flush writes all changes back to the database immediately, without invalidating the cache.
+func (cache *SCPCache) Flush() error {
+	cache.updateLock.Lock()
+	defer cache.updateLock.Unlock()
+	return cache.synchroniseDatabase()
+}
+
+func (cache *SCPCache) synchroniseDatabase() error {
+	// Write the changes since the last write back to the database in a single transaction,
+	// must hold updateLock. Votes can continue while the changes are being written.
+	cache.lock.Lock()
+	scpDeltas, matchupDeltas, applied, logs := cache.takeDirty()
+	cache.lock.Unlock()
+	missing, err := cache.writeBack(scpDeltas, matchupDeltas, applied, logs)
 	if err != nil {
+		cache.lock.Lock()
+		cache.restoreDirty(scpDeltas, matchupDeltas, applied, logs)
+		cache.lock.Unlock()
 		return err
 	}
-	// Batch update (gorm doesn't seem to support real batch SQL updates...)
-	for id, needsUpdate := range cache.dirty {
-		if needsUpdate {
-			if scp, ok := (*scpMap)[id]; ok {
-				err = cache.forceUpdate(scp)
-				if err != nil {
-					break
-				}
-			} else {
-				delete(cache.dirty, id)
-			}
+	if len(missing) > 0 {
+		// Deleted from the database, e.g. by another instance, so their votes can no longer be written.
+		cache.lock.Lock()
+		cache.removeSCPs(missing)
+		cache.lock.Unlock()
+		cache.invalidateRankings()
+	}
+	return nil
+}
+
+func (cache *SCPCache) takeDirty() (scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) {
+	// Computes the changes to dirty SCPs and matchups since they were last persisted and clears their
+	// dirty flags, along with the votes applied and logged, must hold the write lock. The flags are cleared and
+	// the changes are assumed to be persisted before writing, so changes made during the write are not lost.
+	for id := range cache.dirty {
+		delete(cache.dirty, id)
+		scp, ok := cache.scpMap[id]
+		if !ok {
+			continue
+		}
+		current, persisted := countersOf(scp), cache.persisted[id]
+		delta := SCPDelta{
+			ID:     id,
+			Rating: current.rating - persisted.rating,
+			Wins:   int64(current.wins - persisted.wins),
+			Losses: int64(current.losses - persisted.losses),
 		}
+		cache.persisted[id] = current
+		if delta.Rating != 0 || delta.Wins != 0 || delta.Losses != 0 {
+			scpDeltas = append(scpDeltas, delta)
+		}
+	}
+	for matchup := range cache.dirtyMatchups {
+		delete(cache.dirtyMatchups, matchup)
+		persisted := cache.persistedMatchups[matchup] // zero if the matchup is not in the database yet
+		matchupDeltas = append(matchupDeltas, MatchupDelta{
+			FirstID:    matchup.FirstID,
+			SecondID:   matchup.SecondID,
+			FirstWins:  int64(matchup.FirstWins - persisted.FirstWins),
+			SecondWins: int64(matchup.SecondWins - persisted.SecondWins),
+		})
+		cache.persistedMatchups[matchup] = *matchup
 	}
-	cache.lastUpdated = time.Now()
-	return err
+	applied, cache.applied = cache.applied, nil
+	logs, cache.logs = cache.logs, nil
+	return scpDeltas, matchupDeltas, applied, logs
 }
 
-// GetRandomSCPs returns a slice of n unique, pseudo-uniformly-randomly selected SCP instances.
-func (cache *SCPCache) GetRandomSCPs(n int) ([]*model.SCP, error) {
-	scpMap, err := cache.getSCPMap()
+func (cache *SCPCache) restoreDirty(scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) {
+	// Reverts takeDirty after a failed write so the next flush retries the changes, must hold the write lock.
+	for _, delta := range scpDeltas {
+		persisted := cache.persisted[delta.ID]
+		persisted.rating -= delta.Rating
+		persisted.wins -= uint64(delta.Wins)
+		persisted.losses -= uint64(delta.Losses)
+		cache.persisted[delta.ID] = persisted
+		cache.dirty[delta.ID] = true
+	}
+	for _, delta := range matchupDeltas {
+		matchup, ok := cache.matchups[delta.FirstID][delta.SecondID]
+		if !ok {
+			continue
+		}
+		persisted := cache.persistedMatchups[matchup]
+		persisted.FirstWins -= uint64(delta.FirstWins)
+		persisted.SecondWins -= uint64(delta.SecondWins)
+		cache.persistedMatchups[matchup] = persisted
+		cache.dirtyMatchups[matchup] = true
+	}
+	cache.applied = append(applied, cache.applied...)
+	cache.logs = append(logs, cache.logs...)
+}
+
+// writeBack writes the changes to the database with bounded retries and records the outcome, returning
+// the IDs of SCPs deleted from the database, whose changes were dropped. The caller must hold updateLock,
+// and remove the missing SCPs from the cache; it may hold the write lock.
+func (cache *SCPCache) writeBack(scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) (missing []uint, err error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		missing, err = cache.scpStore.ApplyDeltas(scpDeltas, matchupDeltas, applied, logs)
+		if err == nil || attempt >= flushRetries {
+			break
+		}
+		time.Sleep(flushRetryDelay << uint(attempt))
+	}
+	now := time.Now()
+	atomic.StoreInt64(&cache.lastUpdated, now.UnixNano())
+	cache.statsLock.Lock()
+	defer cache.statsLock.Unlock()
+	cache.flushes++
+	cache.flushSeconds += now.Sub(start).Seconds()
+	if len(missing) > 0 && cache.logger != nil {
+		cache.logger.Warnj(log.JSON{"message": "Dropped votes for SCPs deleted from the database", "scps": missing})
+	}
 	if err != nil {
+		cache.stats.Failures++
+		cache.stats.LastError = err.Error()
+		if !cache.stats.Degraded {
+			cache.stats.Degraded = true
+			cache.stats.DegradedSince = now
+		}
+		return missing, err
+	}
+	cache.stats.LastFlush = now
+	cache.stats.LastFlushDuration = now.Sub(start)
+	cache.stats.LastError = ""
+	cache.stats.Degraded = false
+	cache.stats.DegradedSince = time.Time{}
+	return missing, nil
+}
+
+// Refresh re-reads the ratings and records from the database to pick up changes persisted by other
+// app instances, keeping local changes that have not been written back yet.
+// SCPs added or edited by other instances are included.
+func (cache *SCPCache) Refresh() error {
+	// Holding updateLock ensures no write back is in progress, so the database contains
+	// exactly the persisted values plus changes from other instances.
+	cache.updateLock.Lock()
+	defer cache.updateLock.Unlock()
+	allSCPs, err := cache.scpStore.GetAllSCPs()
+	if err != nil {
+		return err
+	}
+	allMatchups, err := cache.scpStore.GetAllMatchups()
+	if err != nil {
+		return err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.scpMap == nil {
+		// Invalidated, the next access loads everything anyway.
+		return nil
+	}
+	for _, dbSCP := range allSCPs {
+		scp, ok := cache.scpMap[dbSCP.ID]
+		if !ok {
+			cache.addSCP(dbSCP)
+			continue
+		}
+		copyDetails(scp, dbSCP)
+		// current = database + local changes not yet written back (current - persisted)
+		persisted := cache.persisted[dbSCP.ID]
+		scp.Rating = dbSCP.Rating + (scp.Rating - persisted.rating)
+		scp.Wins = dbSCP.Wins + (scp.Wins - persisted.wins)
+		scp.Losses = dbSCP.Losses + (scp.Losses - persisted.losses)
+		cache.persisted[dbSCP.ID] = countersOf(dbSCP)
+	}
+	for _, dbMatchup := range allMatchups {
+		matchup, ok := cache.matchups[dbMatchup.FirstID][dbMatchup.SecondID]
+		if !ok {
+			cache.indexMatchup(dbMatchup)
+			cache.persistedMatchups[dbMatchup] = *dbMatchup
+			continue
+		}
+		persisted := cache.persistedMatchups[matchup]
+		matchup.FirstWins = dbMatchup.FirstWins + (matchup.FirstWins - persisted.FirstWins)
+		matchup.SecondWins = dbMatchup.SecondWins + (matchup.SecondWins - persisted.SecondWins)
+		cache.persistedMatchups[matchup] = *dbMatchup
+	}
+	return nil
+}
+
+func (cache *SCPCache) indexMatchup(matchup *model.Matchup) {
+	// Index the matchup under both SCPs so it can be found from either side, must hold the write lock.
+	for _, id := range []uint{matchup.FirstID, matchup.SecondID} {
+		opponents, ok := cache.matchups[id]
+		if !ok {
+			opponents = make(map[uint]*model.Matchup)
+			cache.matchups[id] = opponents
+		}
+		opponents[matchup.Opponent(id)] = matchup
+	}
+}
+
+func (cache *SCPCache) recordMatchup(winnerID uint, loserID uint) {
+	// Must hold the write lock.
+	matchup, ok := cache.matchups[winnerID][loserID]
+	if !ok {
+		matchup = model.NewMatchup(winnerID, loserID)
+		cache.indexMatchup(matchup)
+	}
+	matchup.AddWin(winnerID)
+	cache.dirtyMatchups[matchup] = true
+}
+
+// RecordMatchup adds a win for winnerID over loserID to their head-to-head record.
+// Like Update, the change is only written to the database when the cache is synchronised.
+// Vote records the matchup already, this is only needed to change the record on its own.
+func (cache *SCPCache) RecordMatchup(winnerID uint, loserID uint) error {
+	if winnerID == loserID {
+		return fmt.Errorf("cannot record a matchup of SCP id %d against itself", winnerID)
+	}
+	if err := cache.wlock(); err != nil {
+		return err
+	}
+	cache.recordMatchup(winnerID, loserID)
+	cache.lock.Unlock()
+	return nil
+}
+
+// GetMatchup returns a copy of the head-to-head record between the two SCPs.
+// An empty record is returned if they have never been matched against each other.
+func (cache *SCPCache) GetMatchup(id1 uint, id2 uint) (model.Matchup, error) {
+	if err := cache.rlock(); err != nil {
+		return model.Matchup{}, err
+	}
+	defer cache.lock.RUnlock()
+	if matchup, ok := cache.matchups[id1][id2]; ok {
+		return *matchup, nil
+	}
+	return *model.NewMatchup(id1, id2), nil
+}
+
+// GetOpponents returns copies of every head-to-head record of the given SCP, keyed by opponent ID.
+func (cache *SCPCache) GetOpponents(id uint) (map[uint]model.Matchup, error) {
+	if err := cache.rlock(); err != nil {
 		return nil, err
 	}
-	numSCPs := len(*scpMap)
-	if n < 1 || n > len(*scpMap) {
+	defer cache.lock.RUnlock()
+	opponents := make(map[uint]model.Matchup, len(cache.matchups[id]))
+	for opponentID, matchup := range cache.matchups[id] {
+		opponents[opponentID] = *matchup
+	}
+	return opponents, nil
+}
+
+// GetRandomSCPs returns a slice of copies of n unique, pseudo-uniformly-randomly selected SCP instances.
+func (cache *SCPCache) GetRandomSCPs(n int) ([]*model.SCP, error) {
+	if err := cache.rlock(); err != nil {
+		return nil, err
+	}
+	defer cache.lock.RUnlock()
+	numSCPs := len(cache.scpMap)
+	if n < 1 || n > numSCPs {
 		return nil, fmt.Errorf("invalid length argument: %d. #SCPs = %d", n, numSCPs)
 	}
 	randomSCPs := make([]*model.SCP, n)
@@ -180,7 +851,8 @@ func (cache *SCPCache) GetRandomSCPs(n int) ([]*model.SCP, error) {
 			i--
 		} else {
 			set[r] = struct{}{} // use 0-byte structs instead of bools to save memory
-			randomSCPs[i] = (*scpMap)[scpIDs[r]]
+			scp := *cache.scpMap[scpIDs[r]]
+			randomSCPs[i] = &scp
 		}
 		totalIterations++
 	}
@@ -194,33 +866,28 @@ func (cache *SCPCache) GetRandomSCPs(n int) ([]*model.SCP, error) {
 func (cache *SCPCache) GetRankedSCPs() ([]model.SCP, error) {
 	// Avoid too many expensive calls to get SCPs sorted by rating by caching the last calculated result for a period of time.
 	// The returned SCP objects should be treated as read-only, as they are intentionally not in sync with the map.
+	cache.rankingsLock.Lock()
+	defer cache.rankingsLock.Unlock()
 	if cache.scpListRanked == nil || cache.rankingLastUpdated.IsZero() || time.Now().After(cache.rankingLastUpdated.Add(cache.rankingTTL)) {
-		cache.rankingsLock.Lock()
-		defer cache.rankingsLock.Unlock()
-		// Double check in case another goroutine already updated and this one was waiting.
-		if cache.scpListRanked == nil || cache.rankingLastUpdated.IsZero() || time.Now().After(cache.rankingLastUpdated.Add(cache.rankingTTL)) {
-
-			scpMap, err := cache.getSCPMap()
-			if err != nil {
-				return nil, err
-			}
-			rankedSCPs := make([]model.SCP, len(*scpMap))
-			i := 0
-			for _, scpRef := range *scpMap {
-				rankedSCPs[i] = *scpRef
-				i++
-			}
-			// Sort SCPs by ELO rating in descending order.
-			sort.Slice(rankedSCPs, func(i, j int) bool {
-				if rankedSCPs[i].Rating == rankedSCPs[j].Rating {
-					// break ties by ID
-					return rankedSCPs[i].ID < rankedSCPs[j].ID
-				}
-				return rankedSCPs[i].Rating > rankedSCPs[j].Rating
-			})
-			cache.scpListRanked = rankedSCPs
-			cache.rankingLastUpdated = time.Now()
+		if err := cache.rlock(); err != nil {
+			return nil, err
+		}
+		rankedSCPs := make([]model.SCP, 0, len(cache.scpMap))
+		for _, scpRef := range cache.scpMap {
+			rankedSCPs = append(rankedSCPs, *scpRef)
 		}
+		cache.lock.RUnlock()
+		// Sort SCPs by ELO rating in descending order.
+		sort.Slice(rankedSCPs, func(i, j int) bool {
+			if rankedSCPs[i].Rating == rankedSCPs[j].Rating {
+				// break ties by ID
+				return rankedSCPs[i].ID < rankedSCPs[j].ID
+			}
+			return rankedSCPs[i].Rating > rankedSCPs[j].Rating
+		})
+		cache.scpListRanked = rankedSCPs
+		cache.rankingLastUpdated = time.Now()
+		atomic.AddUint64(&cache.rankingRecomputes, 1)
 	}
 	// Can re-use cached result otherwise.
 	return cache.scpListRanked, nil
@@ -1,10 +1,15 @@
 package store_test
 
 import (
+	"math/rand"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/gommon/log"
+
 	"github.com/cycraig/scpbattle/db"
 	"github.com/cycraig/scpbattle/model"
 	"github.com/cycraig/scpbattle/store"
@@ -177,3 +182,528 @@ func TestSCPCache(t *testing.T) {
 		AssertTrue(t, rankedSCPsAfterRealUpdate[i].Rating >= rankedSCPsAfterRealUpdate[i+1].Rating, "Ranked SCPs not in descending order after update!")
 	}
 }
+
+func TestSCPCacheFlusher(t *testing.T) {
+
+	// Initialise database.
+	fdb := "TestSCPCacheFlusher.db"
+	os.Remove(fdb)
+	d := db.NewDB("sqlite3", fdb, false)
+	scpStore := store.NewSCPStore(d)
+	scpCache := store.NewSCPCacheWithDuration(scpStore, 100000*time.Second, 100000*time.Second)
+	defer func() {
+		scpCache.StopFlusher()
+		if err := d.Close(); err != nil {
+			t.Log(err)
+		}
+		if err := os.Remove(fdb); err != nil {
+			t.Log(err)
+		}
+	}()
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+
+	s1 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	s2 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	AssertNoError(t, scpCache.Create(s1))
+	AssertNoError(t, scpCache.Create(s2))
+	lastFlush := scpCache.Stats().LastFlush
+
+	scpCache.StartFlusher(10 * time.Millisecond)
+	scpCache.StartFlusher(10 * time.Millisecond) // starting twice is harmless
+	cacheSCP, err := scpCache.GetByID(s1.ID)
+	AssertNoError(t, err)
+	cacheSCP.Wins = 5
+	AssertNoError(t, scpCache.Update(cacheSCP))
+	AssertNoError(t, scpCache.RecordMatchup(s1.ID, s2.ID))
+
+	// The changes should be written back without any further calls to Update.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := scpCache.Stats(); stats.LastFlush.After(lastFlush) && stats.DirtySCPs+stats.DirtyMatchups == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	scpCache.StopFlusher()
+	stats := scpCache.Stats()
+	AssertTrue(t, stats.LastFlush.After(lastFlush), "Flusher did not flush the cache")
+	AssertEqual(t, stats.Failures, uint64(0))
+	AssertEqual(t, stats.DirtySCPs, 0)
+	AssertEqual(t, stats.DirtyMatchups, 0)
+	dbSCP, err := scpStore.GetByID(s1.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, dbSCP.Wins, uint64(5))
+	storeMatchups, err := scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 1)
+
+	// Failed flushes are counted and the changes stay dirty.
+	cacheSCP.Wins = 6
+	AssertNoError(t, scpCache.Update(cacheSCP))
+	AssertNoError(t, d.Close())
+	AssertError(t, scpCache.Flush())
+	stats = scpCache.Stats()
+	AssertEqual(t, stats.Failures, uint64(1))
+	AssertEqual(t, stats.DirtySCPs, 1)
+	AssertTrue(t, stats.LastError != "", "Expected the flush error to be recorded")
+}
+
+func TestSCPCacheMatchups(t *testing.T) {
+
+	// Initialise database.
+	fdb := "TestSCPCacheMatchups.db"
+	os.Remove(fdb)
+	d := db.NewDB("sqlite3", fdb, false)
+	scpStore := store.NewSCPStore(d)
+	scpCache := store.NewSCPCacheWithDuration(scpStore, 100000*time.Second, 100000*time.Second)
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Log(err)
+		}
+		if err := os.Remove(fdb); err != nil {
+			t.Log(err)
+		}
+	}()
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+
+	s1 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	s2 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	s3 := model.NewSCP("SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106")
+	AssertNoError(t, scpCache.Create(s1))
+	AssertNoError(t, scpCache.Create(s2))
+	AssertNoError(t, scpCache.Create(s3))
+
+	// Pairs that have never met have an empty record.
+	matchup, err := scpCache.GetMatchup(s1.ID, s2.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, matchup.FirstWins, uint64(0))
+	AssertEqual(t, matchup.SecondWins, uint64(0))
+
+	// Matchups against yourself are rejected.
+	AssertError(t, scpCache.RecordMatchup(s1.ID, s1.ID))
+
+	// Record results in both orientations.
+	AssertNoError(t, scpCache.RecordMatchup(s2.ID, s1.ID))
+	AssertNoError(t, scpCache.RecordMatchup(s2.ID, s1.ID))
+	AssertNoError(t, scpCache.RecordMatchup(s1.ID, s2.ID))
+	AssertNoError(t, scpCache.RecordMatchup(s3.ID, s1.ID))
+
+	matchup, err = scpCache.GetMatchup(s2.ID, s1.ID)
+	AssertNoError(t, err)
+	wins, losses := matchup.RecordFor(s2.ID)
+	AssertEqual(t, wins, uint64(2))
+	AssertEqual(t, losses, uint64(1))
+	wins, losses = matchup.RecordFor(s1.ID)
+	AssertEqual(t, wins, uint64(1))
+	AssertEqual(t, losses, uint64(2))
+
+	opponents, err := scpCache.GetOpponents(s1.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, len(opponents), 2)
+	opponents, err = scpCache.GetOpponents(s3.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, len(opponents), 1)
+
+	// Nothing is written to the database until synchronised.
+	storeMatchups, err := scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 0)
+
+	// Records survive synchronising and re-reading from the database.
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+	storeMatchups, err = scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 2)
+	AssertNoError(t, scpCache.RecordMatchup(s1.ID, s2.ID))
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+	matchup, err = scpCache.GetMatchup(s1.ID, s2.ID)
+	AssertNoError(t, err)
+	wins, losses = matchup.RecordFor(s1.ID)
+	AssertEqual(t, wins, uint64(2))
+	AssertEqual(t, losses, uint64(2))
+}
+
+func TestSCPCacheConcurrentVotes(t *testing.T) {
+
+	// Initialise database.
+	fdb := "TestSCPCacheConcurrentVotes.db"
+	os.Remove(fdb)
+	d := db.NewDB("sqlite3", fdb, false)
+	scpStore := store.NewSCPStore(d)
+	scpCache := store.NewSCPCacheWithDuration(scpStore, time.Millisecond, time.Millisecond)
+	defer func() {
+		scpCache.StopFlusher()
+		if err := d.Close(); err != nil {
+			t.Log(err)
+		}
+		if err := os.Remove(fdb); err != nil {
+			t.Log(err)
+		}
+	}()
+
+	scps := []*model.SCP{
+		model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"),
+		model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"),
+		model.NewSCP("SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106"),
+		model.NewSCP("SCP-173", "The Sculpture", "scp_173.jpg", "http://www.scp-wiki.net/scp-173"),
+	}
+	for _, scp := range scps {
+		AssertNoError(t, scpCache.Create(scp))
+	}
+
+	// Pre-generate the votes so the expected records are known.
+	const voters = 8
+	const votesPerVoter = 250
+	votes := make([][][2]uint, voters)
+	expectedWins := make(map[uint]uint64)
+	expectedLosses := make(map[uint]uint64)
+	expectedMatchups := make(map[[2]uint]uint64)
+	r := rand.New(rand.NewSource(1))
+	for v := range votes {
+		votes[v] = make([][2]uint, votesPerVoter)
+		for i := range votes[v] {
+			perm := r.Perm(len(scps))
+			winnerID, loserID := scps[perm[0]].ID, scps[perm[1]].ID
+			votes[v][i] = [2]uint{winnerID, loserID}
+			expectedWins[winnerID]++
+			expectedLosses[loserID]++
+			expectedMatchups[[2]uint{winnerID, loserID}]++
+		}
+	}
+
+	// Vote concurrently while reading, flushing and invalidating the cache.
+	scpCache.StartFlusher(time.Millisecond)
+	var wg sync.WaitGroup
+	for v := range votes {
+		wg.Add(1)
+		go func(votes [][2]uint) {
+			defer wg.Done()
+			for _, vote := range votes {
+				if !CheckNoError(t, scpCache.Vote(vote[0], vote[1], func(winner *model.SCP, loser *model.SCP) {
+					winner.Rating += 10
+					loser.Rating -= 10
+					winner.Wins++
+					loser.Losses++
+				})) {
+					return
+				}
+			}
+		}(votes[v])
+	}
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := scpCache.GetRankedSCPs()
+			if !CheckNoError(t, err) {
+				return
+			}
+			randomSCPs, err := scpCache.GetRandomSCPs(2)
+			if !CheckNoError(t, err) {
+				return
+			}
+			_, err = scpCache.GetSnapshotByID(randomSCPs[0].ID)
+			if !CheckNoError(t, err) {
+				return
+			}
+			_, err = scpCache.GetMatchup(randomSCPs[0].ID, randomSCPs[1].ID)
+			if !CheckNoError(t, err) {
+				return
+			}
+			_, err = scpCache.GetOpponents(randomSCPs[0].ID)
+			if !CheckNoError(t, err) {
+				return
+			}
+			scpCache.Stats()
+		}
+	}()
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for i := 0; i < 5; i++ {
+			if !CheckNoError(t, scpCache.SynchroniseThenInvalidate()) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	scpCache.StopFlusher()
+	AssertNoError(t, scpCache.SynchroniseThenInvalidate())
+	scpCount, matchupCount := scpCache.DirtyCount()
+	AssertEqual(t, scpCount, 0)
+	AssertEqual(t, matchupCount, 0)
+
+	// No votes should have been lost, in the cache or the database.
+	storeSCPs, err := scpStore.GetAllSCPs()
+	AssertNoError(t, err)
+	totalRating := 0.0
+	for _, storeSCP := range storeSCPs {
+		AssertEqual(t, storeSCP.Wins, expectedWins[storeSCP.ID])
+		AssertEqual(t, storeSCP.Losses, expectedLosses[storeSCP.ID])
+		cacheSCP, err := scpCache.GetSnapshotByID(storeSCP.ID)
+		AssertNoError(t, err)
+		AssertSCPEqual(t, storeSCP, cacheSCP)
+		totalRating += storeSCP.Rating
+	}
+	AssertEqual(t, totalRating, 1000.0*float64(len(scps)))
+	storeMatchups, err := scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	for _, matchup := range storeMatchups {
+		AssertEqual(t, matchup.FirstWins, expectedMatchups[[2]uint{matchup.FirstID, matchup.SecondID}])
+		AssertEqual(t, matchup.SecondWins, expectedMatchups[[2]uint{matchup.SecondID, matchup.FirstID}])
+	}
+}
+
+// openSharedDB opens two connections to an empty database shared by two app instances.
+// This is a fresh SQLite file unless TEST_POSTGRES_URL is set, in which case its tables are emptied.
+func openSharedDB(t *testing.T, fdb string) (dialect string, dbURL string, d1 *gorm.DB, d2 *gorm.DB, cleanup func()) {
+	dialect, dbURL = "sqlite3", fdb
+	if url := os.Getenv("TEST_POSTGRES_URL"); url != "" {
+		dialect, dbURL = "postgres", url
+	} else {
+		os.Remove(fdb)
+	}
+	d1 = db.NewDB(dialect, dbURL, false)
+	AssertNoError(t, d1.Delete(&model.Matchup{}).Error)
+	AssertNoError(t, d1.Unscoped().Delete(&model.SCP{}).Error)
+	AssertNoError(t, d1.Delete(&model.CatalogueVersion{}).Error)
+	d2 = db.NewDB(dialect, dbURL, false)
+	return dialect, dbURL, d1, d2, func() {
+		d1.Close()
+		d2.Close()
+		if dialect == "sqlite3" {
+			os.Remove(fdb)
+		}
+	}
+}
+
+func TestSCPCacheMultipleInstances(t *testing.T) {
+	// Two app instances sharing one database, each with their own cache and connection.
+	_, _, d1, d2, cleanup := openSharedDB(t, "TestSCPCacheMultipleInstances.db")
+	defer cleanup()
+	store1 := store.NewSCPStore(d1)
+	store2 := store.NewSCPStore(d2)
+	cache1 := store.NewSCPCacheWithDuration(store1, time.Millisecond, time.Millisecond)
+	cache2 := store.NewSCPCacheWithDuration(store2, time.Millisecond, time.Millisecond)
+
+	scps := []*model.SCP{
+		model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"),
+		model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"),
+		model.NewSCP("SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106"),
+	}
+	for _, scp := range scps {
+		AssertNoError(t, cache1.Create(scp))
+	}
+
+	// Both instances vote on the same SCPs while flushing and refreshing concurrently.
+	const votesPerInstance = 300
+	cache1.StartFlusher(2 * time.Millisecond)
+	cache2.StartFlusher(3 * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, cache := range []*store.SCPCache{cache1, cache2} {
+		wg.Add(1)
+		go func(cache *store.SCPCache) {
+			defer wg.Done()
+			for i := 0; i < votesPerInstance; i++ {
+				winner, loser := scps[i%len(scps)], scps[(i+1)%len(scps)]
+				if !CheckNoError(t, cache.Vote(winner.ID, loser.ID, func(winner *model.SCP, loser *model.SCP) {
+					winner.Rating++
+					loser.Rating--
+					winner.Wins++
+					loser.Losses++
+				})) {
+					return
+				}
+			}
+		}(cache)
+	}
+	wg.Wait()
+	cache1.StopFlusher()
+	cache2.StopFlusher()
+	AssertNoError(t, cache1.Flush())
+	AssertNoError(t, cache2.Flush())
+
+	// No votes were lost: every SCP won and lost exactly 2*votesPerInstance/3 times.
+	expected := uint64(2 * votesPerInstance / len(scps))
+	storeSCPs, err := store1.GetAllSCPs()
+	AssertNoError(t, err)
+	for _, storeSCP := range storeSCPs {
+		AssertEqual(t, storeSCP.Wins, expected)
+		AssertEqual(t, storeSCP.Losses, expected)
+		AssertEqual(t, storeSCP.Rating, 1000.0)
+	}
+	storeMatchups, err := store1.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), len(scps))
+	for _, matchup := range storeMatchups {
+		AssertEqual(t, matchup.FirstWins+matchup.SecondWins, expected)
+	}
+
+	// After refreshing, each instance sees the votes of the other.
+	AssertNoError(t, cache1.Refresh())
+	AssertNoError(t, cache2.Refresh())
+	for _, scp := range scps {
+		for _, cache := range []*store.SCPCache{cache1, cache2} {
+			cacheSCP, err := cache.GetSnapshotByID(scp.ID)
+			AssertNoError(t, err)
+			AssertEqual(t, cacheSCP.Wins, expected)
+			AssertEqual(t, cacheSCP.Losses, expected)
+		}
+	}
+}
+
+// warnings records the warnings of the cache.
+type warnings struct {
+	lock     sync.Mutex
+	messages []log.JSON
+}
+
+func (w *warnings) Warnj(j log.JSON) {
+	w.lock.Lock()
+	w.messages = append(w.messages, j)
+	w.lock.Unlock()
+}
+
+func TestSCPCacheDeletedSCP(t *testing.T) {
+	// An SCP deleted from the database, e.g. by another instance, while the cache still has votes for it.
+	_, _, d, _, cleanup := openSharedDB(t, "TestSCPCacheDeletedSCP.db")
+	defer cleanup()
+	scpCache := store.NewSCPCacheWithDuration(store.NewSCPStore(d), 100000*time.Second, 100000*time.Second)
+	logger := new(warnings)
+	scpCache.SetLogger(logger)
+	scps := []*model.SCP{
+		model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"),
+		model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"),
+		model.NewSCP("SCP-106", "The Old Man", "scp_106.jpg", "http://www.scp-wiki.net/scp-106"),
+	}
+	for _, scp := range scps {
+		AssertNoError(t, scpCache.Create(scp))
+	}
+	vote := func(winner *model.SCP, loser *model.SCP) {
+		winner.Wins++
+		loser.Losses++
+	}
+	AssertNoError(t, scpCache.Vote(scps[0].ID, scps[1].ID, vote))
+	AssertNoError(t, scpCache.Vote(scps[2].ID, scps[1].ID, vote))
+	AssertNoError(t, d.Delete(scps[2]).Error)
+
+	// The votes for the deleted SCP are dropped with a warning, the others are written.
+	AssertNoError(t, scpCache.Flush())
+	AssertTrue(t, !scpCache.Degraded(), "Expected the cache not to be degraded")
+	scps1, err := store.NewSCPStore(d).GetByID(scps[1].ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scps1.Losses, uint64(2))
+	matchups, err := store.NewSCPStore(d).GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(matchups), 1)
+	AssertEqual(t, len(logger.messages), 1)
+	deleted, err := scpCache.GetByID(scps[2].ID)
+	AssertNoError(t, err)
+	AssertEqual(t, deleted, (*model.SCP)(nil))
+	opponents, err := scpCache.GetOpponents(scps[1].ID)
+	AssertNoError(t, err)
+	AssertEqual(t, len(opponents), 1)
+	ranked, err := scpCache.GetRankedSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, len(ranked), 2)
+	scpCount, matchupCount := scpCache.DirtyCount()
+	AssertEqual(t, scpCount+matchupCount, 0)
+}
+
+func TestSCPCacheSynchroniseDeletedSCP(t *testing.T) {
+	// Synchronising a pending vote for an SCP deleted from the database, as on shutdown, must not deadlock.
+	_, _, d, _, cleanup := openSharedDB(t, "TestSCPCacheSynchroniseDeletedSCP.db")
+	defer cleanup()
+	scpCache := store.NewSCPCacheWithDuration(store.NewSCPStore(d), 100000*time.Second, 100000*time.Second)
+	scpCache.SetLogger(new(warnings))
+	scps := []*model.SCP{
+		model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049"),
+		model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096"),
+	}
+	for _, scp := range scps {
+		AssertNoError(t, scpCache.Create(scp))
+	}
+	AssertNoError(t, scpCache.Vote(scps[0].ID, scps[1].ID, func(winner *model.SCP, loser *model.SCP) {
+		winner.Wins++
+		loser.Losses++
+	}))
+	AssertNoError(t, d.Delete(scps[1]).Error)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- scpCache.SynchroniseThenInvalidate()
+	}()
+	select {
+	case err := <-done:
+		AssertNoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SynchroniseThenInvalidate deadlocked")
+	}
+	ranked, err := scpCache.GetRankedSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, len(ranked), 1)
+}
+
+func TestSCPCacheCatalogueChanges(t *testing.T) {
+	// Catalogue changes made through one instance reach the other, via LISTEN/NOTIFY on Postgres
+	// and by polling the catalogue version on SQLite.
+	dialect, dbURL, d1, d2, cleanup := openSharedDB(t, "TestSCPCacheCatalogueChanges.db")
+	defer cleanup()
+	cache1 := store.NewSCPCache(store.NewSCPStore(d1))
+	cache2 := store.NewSCPCache(store.NewSCPStore(d2))
+	for _, cache := range []*store.SCPCache{cache1, cache2} {
+		notifier, err := store.NewCatalogueNotifier(d1, dialect, dbURL, 5*time.Millisecond)
+		AssertNoError(t, err)
+		defer notifier.Close()
+		cache.WatchCatalogue(notifier)
+	}
+
+	scp049 := model.NewSCP("SCP-049", "The Plague Doctor", "scp_049.jpg", "http://www.scp-wiki.net/scp-049")
+	AssertNoError(t, cache1.Create(scp049))
+	// Load the cache of the second instance before the next change, so it has to be patched.
+	scp, err := cache2.GetSnapshotByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertNotEqual(t, scp, nil)
+	scp096 := model.NewSCP("SCP-096", "The Shy Guy", "scp_096.jpg", "http://www.scp-wiki.net/scp-096")
+	AssertNoError(t, cache1.Create(scp096))
+	edited := *scp049
+	edited.Description = "The Pestilence"
+	edited.Rating = 0 // ignored
+	AssertNoError(t, cache1.UpdateDetails(&edited))
+	scp, err = cache1.GetSnapshotByID(scp049.ID)
+	AssertNoError(t, err)
+	AssertEqual(t, scp.Description, "The Pestilence")
+	AssertEqual(t, scp.Rating, 1000.0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		added, err := cache2.GetSnapshotByID(scp096.ID)
+		AssertNoError(t, err)
+		scp, err = cache2.GetSnapshotByID(scp049.ID)
+		AssertNoError(t, err)
+		if added != nil && scp.Description == "The Pestilence" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Second instance did not receive catalogue changes: %+v, %+v", added, scp)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	AssertEqual(t, scp.Rating, 1000.0)
+	rankedSCPs, err := cache2.GetRankedSCPs()
+	AssertNoError(t, err)
+	AssertEqual(t, len(rankedSCPs), 2)
+
+	// Editing an SCP that does not exist fails.
+	AssertError(t, cache1.UpdateDetails(&model.SCP{Name: "SCP-000"}))
+}
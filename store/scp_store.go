@@ -1,6 +1,9 @@
 package store
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/jinzhu/gorm"
 
 	"github.com/cycraig/scpbattle/model"
@@ -41,6 +44,151 @@ func (store *SCPStore) Update(scp *model.SCP) error {
 	return store.db.Model(scp).Update(scp).Error
 }
 
+// UpdateDetails writes the catalogue details (name, description, image and link) of the SCP instance
+// back to its corresponding database entry, leaving its rating and record untouched.
+func (store *SCPStore) UpdateDetails(scp *model.SCP) error {
+	result := store.db.Model(&model.SCP{}).Where("id = ?", scp.ID).Updates(map[string]interface{}{
+		"name":        scp.Name,
+		"description": scp.Description,
+		"image":       scp.Image,
+		"link":        scp.Link,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("cannot update details of SCP id %d: %w", scp.ID, gorm.ErrRecordNotFound)
+	}
+	return nil
+}
+
+// SCPDelta is a change to the rating and record of an SCP, relative to its value in the database.
+type SCPDelta struct {
+	ID     uint
+	Rating float64
+	Wins   int64
+	Losses int64
+}
+
+// MatchupDelta is a change to a head-to-head record, relative to its value in the database.
+type MatchupDelta struct {
+	FirstID    uint
+	SecondID   uint
+	FirstWins  int64
+	SecondWins int64
+}
+
+// appliedVotesPerInsert keeps the bound parameters of a single insert below SQLite's limit of 999.
+const appliedVotesPerInsert = 400
+
+// ApplyDeltas atomically adds the deltas to the database entries in a single transaction, along with
+// the records of the votes applied and the vote logs of sessions.
+// Unlike Update, concurrent writers (e.g. multiple app instances) never overwrite each other's changes.
+// Matchups that do not exist yet are created. Deltas of SCPs that no longer exist are dropped, along
+// with the deltas of their matchups, and their IDs are returned.
+func (store *SCPStore) ApplyDeltas(scpDeltas []SCPDelta, matchupDeltas []MatchupDelta, applied []model.AppliedVote, logs []model.VoteLog) (missing []uint, err error) {
+	err = store.db.Transaction(func(tx *gorm.DB) error {
+		missing = nil
+		for _, delta := range scpDeltas {
+			result := tx.Model(&model.SCP{}).Where("id = ?", delta.ID).UpdateColumns(map[string]interface{}{
+				"rating":     gorm.Expr("rating + ?", delta.Rating),
+				"wins":       gorm.Expr("wins + ?", delta.Wins),
+				"losses":     gorm.Expr("losses + ?", delta.Losses),
+				"updated_at": gorm.NowFunc(),
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				missing = append(missing, delta.ID)
+			}
+		}
+		for _, delta := range matchupDeltas {
+			if containsID(missing, delta.FirstID) || containsID(missing, delta.SecondID) {
+				continue
+			}
+			result := tx.Model(&model.Matchup{}).Where("first_id = ? AND second_id = ?", delta.FirstID, delta.SecondID).UpdateColumns(map[string]interface{}{
+				"first_wins":  gorm.Expr("first_wins + ?", delta.FirstWins),
+				"second_wins": gorm.Expr("second_wins + ?", delta.SecondWins),
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// If another instance creates the matchup concurrently this fails on the primary key,
+				// rolling back the transaction to be retried.
+				err := tx.Create(&model.Matchup{
+					FirstID:    delta.FirstID,
+					SecondID:   delta.SecondID,
+					FirstWins:  uint64(delta.FirstWins),
+					SecondWins: uint64(delta.SecondWins),
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for start := 0; start < len(applied); start += appliedVotesPerInsert {
+			batch := applied[start:]
+			if len(batch) > appliedVotesPerInsert {
+				batch = batch[:appliedVotesPerInsert]
+			}
+			values := make([]string, len(batch))
+			args := make([]interface{}, 0, 2*len(batch))
+			for i, vote := range batch {
+				values[i] = "(?, ?)"
+				args = append(args, vote.WAL, vote.Seq)
+			}
+			sql := `INSERT INTO applied_votes (wal, seq) VALUES ` + strings.Join(values, ", ") + ` ON CONFLICT DO NOTHING`
+			if err := tx.Exec(sql, args...).Error; err != nil {
+				return err
+			}
+		}
+		for _, vote := range logs {
+			// Votes queued before their session was revoked or deleted are dropped, votes replayed from
+			// the write-ahead log are only logged once.
+			var wal interface{}
+			if vote.WAL != "" {
+				wal = vote.WAL
+			}
+			err := tx.Exec(`INSERT INTO vote_logs (session_id, winner_id, loser_id, created_at, wal, seq)
+SELECT ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NULL)
+ON CONFLICT DO NOTHING`, vote.SessionID, vote.WinnerID, vote.LoserID, vote.CreatedAt, wal, vote.Seq, vote.SessionID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAppliedVotes returns the sequence numbers of the votes of the write-ahead log recorded as applied.
+func (store *SCPStore) GetAppliedVotes(wal string) ([]uint64, error) {
+	var seqs []uint64
+	if err := store.db.Model(&model.AppliedVote{}).Where("wal = ?", wal).Order("seq").Pluck("seq", &seqs).Error; err != nil {
+		return nil, err
+	}
+	return seqs, nil
+}
+
+// ForgetAppliedVotes deletes the records of the votes of the write-ahead log up to the sequence number.
+func (store *SCPStore) ForgetAppliedVotes(wal string, seq uint64) error {
+	return store.db.Where("wal = ? AND seq <= ?", wal, seq).Delete(&model.AppliedVote{}).Error
+}
+
 // GetAllSCPs returns a slice containing all SCP instances from the database.
 func (store *SCPStore) GetAllSCPs() ([]*model.SCP, error) {
 	var allSCPs []*model.SCP
@@ -49,3 +197,22 @@ func (store *SCPStore) GetAllSCPs() ([]*model.SCP, error) {
 	}
 	return allSCPs, nil
 }
+
+// GetAllMatchups returns a slice containing all head-to-head records from the database.
+func (store *SCPStore) GetAllMatchups() ([]*model.Matchup, error) {
+	var allMatchups []*model.Matchup
+	if err := store.db.Find(&allMatchups).Error; err != nil {
+		return nil, err
+	}
+	return allMatchups, nil
+}
+
+// SaveMatchup writes the head-to-head record to the database, creating the entry if necessary.
+func (store *SCPStore) SaveMatchup(matchup *model.Matchup) error {
+	return store.db.Save(matchup).Error
+}
+
+// Ping checks whether the database connection is still alive.
+func (store *SCPStore) Ping() error {
+	return store.db.DB().Ping()
+}
@@ -1,10 +1,12 @@
 package store_test
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"runtime/debug"
 	"testing"
+	"time"
 
 	"github.com/cycraig/scpbattle/db"
 	"github.com/cycraig/scpbattle/model"
@@ -102,6 +104,103 @@ func TestSCPStore(t *testing.T) {
 	AssertEqual(t, updatedSCPs[4].Rating, 5.0)
 	AssertEqual(t, updatedSCPs[5].Rating, 6.0)
 	AssertEqual(t, updatedSCPs[6].Rating, 7.0)
+
+	// Test atomic increments of SCPs and matchups, creating matchups as needed.
+	deltas := []store.SCPDelta{
+		{ID: allSCPs[0].ID, Rating: 10.5, Wins: 10},
+		{ID: allSCPs[1].ID, Rating: -10.5, Losses: 20},
+	}
+	matchupDeltas := []store.MatchupDelta{
+		{FirstID: allSCPs[0].ID, SecondID: allSCPs[1].ID, SecondWins: 1},
+		{FirstID: allSCPs[2].ID, SecondID: allSCPs[3].ID, FirstWins: 1, SecondWins: 1},
+	}
+	missing, err := scpStore.ApplyDeltas(deltas, matchupDeltas, nil, nil)
+	AssertNoError(t, err)
+	AssertEqual(t, len(missing), 0)
+	_, err = scpStore.ApplyDeltas(deltas, matchupDeltas[:1], nil, nil)
+	AssertNoError(t, err)
+	AssertNoError(t, d.Order("ID asc").Find(&updatedSCPs).Error)
+	AssertEqual(t, updatedSCPs[0].Rating, 22.0)
+	AssertEqual(t, updatedSCPs[0].Wins, uint64(20))
+	AssertEqual(t, updatedSCPs[1].Rating, -19.0)
+	AssertEqual(t, updatedSCPs[1].Losses, uint64(40))
+	AssertEqual(t, updatedSCPs[2].Rating, 3.0)
+	storeMatchups, err := scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 2)
+	AssertEqual(t, storeMatchups[0].FirstID, allSCPs[0].ID)
+	AssertEqual(t, storeMatchups[0].FirstWins, uint64(0))
+	AssertEqual(t, storeMatchups[0].SecondWins, uint64(2))
+	AssertEqual(t, storeMatchups[1].FirstWins, uint64(1))
+	AssertEqual(t, storeMatchups[1].SecondWins, uint64(1))
+
+	// Votes applied with the deltas are recorded once per log, until they are forgotten.
+	applied := []model.AppliedVote{{WAL: "a", Seq: 3}, {WAL: "a", Seq: 1}, {WAL: "b", Seq: 1}}
+	_, err = scpStore.ApplyDeltas(nil, nil, applied, nil)
+	AssertNoError(t, err)
+	_, err = scpStore.ApplyDeltas(nil, nil, applied[:1], nil)
+	AssertNoError(t, err)
+	seqs, err := scpStore.GetAppliedVotes("a")
+	AssertNoError(t, err)
+	AssertEqual(t, fmt.Sprint(seqs), fmt.Sprint([]uint64{1, 3}))
+	AssertNoError(t, scpStore.ForgetAppliedVotes("a", 2))
+	seqs, err = scpStore.GetAppliedVotes("a")
+	AssertNoError(t, err)
+	AssertEqual(t, fmt.Sprint(seqs), fmt.Sprint([]uint64{3}))
+	seqs, err = scpStore.GetAppliedVotes("b")
+	AssertNoError(t, err)
+	AssertEqual(t, fmt.Sprint(seqs), fmt.Sprint([]uint64{1}))
+
+	// Votes are logged with the deltas for sessions that exist, once per vote of a write-ahead log.
+	sessionStore := store.NewSessionStore(d)
+	AssertNoError(t, sessionStore.CreateSession(&model.Session{ID: "voter"}))
+	AssertNoError(t, sessionStore.CreateSession(&model.Session{ID: "revoked"}))
+	AssertNoError(t, sessionStore.RevokeSession("revoked", time.Now()))
+	logs := []model.VoteLog{
+		{SessionID: "voter", WinnerID: allSCPs[0].ID, LoserID: allSCPs[1].ID, WAL: "a", Seq: 1},
+		{SessionID: "voter", WinnerID: allSCPs[1].ID, LoserID: allSCPs[0].ID}, // the queue isn't durable
+		{SessionID: "voter", WinnerID: allSCPs[1].ID, LoserID: allSCPs[0].ID},
+		{SessionID: "deleted", WinnerID: allSCPs[0].ID, LoserID: allSCPs[1].ID, WAL: "a", Seq: 2},
+		{SessionID: "revoked", WinnerID: allSCPs[0].ID, LoserID: allSCPs[1].ID, WAL: "a", Seq: 3},
+	}
+	_, err = scpStore.ApplyDeltas(nil, nil, nil, logs)
+	AssertNoError(t, err)
+	_, err = scpStore.ApplyDeltas(nil, nil, nil, logs[:1])
+	AssertNoError(t, err)
+	logged, err := sessionStore.GetVoteLog("voter")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 3)
+	AssertEqual(t, logged[0].WAL, "a")
+	AssertEqual(t, logged[1].WAL, "")
+	logged, err = sessionStore.GetVoteLog("deleted")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+	logged, err = sessionStore.GetVoteLog("revoked")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+
+	// Deltas of SCPs that do not exist are dropped, along with their matchups, instead of failing the others.
+	missing, err = scpStore.ApplyDeltas(append(deltas, store.SCPDelta{ID: 12345, Wins: 1}),
+		[]store.MatchupDelta{{FirstID: allSCPs[0].ID, SecondID: 12345, FirstWins: 1}}, nil, nil)
+	AssertNoError(t, err)
+	AssertEqual(t, len(missing), 1)
+	AssertEqual(t, missing[0], uint(12345))
+	AssertNoError(t, d.Order("ID asc").Find(&updatedSCPs).Error)
+	AssertEqual(t, updatedSCPs[0].Wins, uint64(30))
+	storeMatchups, err = scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 2)
+
+	m1 := model.NewMatchup(allSCPs[1].ID, allSCPs[0].ID)
+	m1.SecondWins = 2
+	// Saving an existing matchup updates it instead of creating a new entry.
+	m1.AddWin(allSCPs[0].ID)
+	AssertNoError(t, scpStore.SaveMatchup(m1))
+	storeMatchups, err = scpStore.GetAllMatchups()
+	AssertNoError(t, err)
+	AssertEqual(t, len(storeMatchups), 2)
+	AssertEqual(t, storeMatchups[0].FirstWins, uint64(1))
+	AssertEqual(t, storeMatchups[0].SecondWins, uint64(2))
 }
 
 func AssertEqual(t *testing.T, a interface{}, b interface{}) {
@@ -141,6 +240,16 @@ func AssertNoError(t *testing.T, err error) {
 	}
 }
 
+// CheckNoError is AssertNoError for goroutines other than the test's, where t.Fatal cannot be
+// called: it fails the test without stopping it and returns whether err is nil.
+func CheckNoError(t *testing.T, err error) bool {
+	if err != nil {
+		t.Error(string(debug.Stack()), err)
+		return false
+	}
+	return true
+}
+
 func AssertError(t *testing.T, err error) {
 	if err == nil {
 		t.Fatal(string(debug.Stack()), err)
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/cycraig/scpbattle/model"
+)
+
+// SessionStore persists sessions and their votes in the database.
+type SessionStore struct {
+	db *gorm.DB
+}
+
+// NewSessionStore returns a new SessionStore backed by the given database instance.
+func NewSessionStore(db *gorm.DB) *SessionStore {
+	return &SessionStore{
+		db: db,
+	}
+}
+
+// CreateSession persists the given session in the database.
+func (store *SessionStore) CreateSession(session *model.Session) error {
+	return store.db.Create(session).Error
+}
+
+// GetSession returns the session with the given ID if it exists in the database, otherwise nil.
+func (store *SessionStore) GetSession(id string) (*model.Session, error) {
+	var session model.Session
+	if err := store.db.Where("id = ?", id).First(&session).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RevokeSession sets the revocation time of the session, if it hasn't been revoked already, and deletes
+// its votes in a single transaction.
+func (store *SessionStore) RevokeSession(id string, revokedAt time.Time) error {
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Session{}).Where("id = ? AND revoked_at IS NULL", id).UpdateColumn("revoked_at", revokedAt).Error; err != nil {
+			return err
+		}
+		return tx.Where("session_id = ?", id).Delete(&model.VoteLog{}).Error
+	})
+}
+
+// DeleteSession deletes the session and its votes in a single transaction.
+func (store *SessionStore) DeleteSession(id string) error {
+	return store.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", id).Delete(&model.VoteLog{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&model.Session{}).Error
+	})
+}
+
+// PurgeSessions deletes the sessions created before the given time and their votes in a single transaction.
+func (store *SessionStore) PurgeSessions(createdBefore time.Time) (int64, error) {
+	var purged int64
+	err := store.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("session_id IN (SELECT id FROM sessions WHERE created_at < ?)", createdBefore).Delete(&model.VoteLog{}).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Where("created_at < ?", createdBefore).Delete(&model.Session{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+// GetVoteLog returns the votes of the session, oldest first.
+func (store *SessionStore) GetVoteLog(sessionID string) ([]*model.VoteLog, error) {
+	var votes []*model.VoteLog
+	if err := store.db.Where("session_id = ?", sessionID).Order("created_at asc, id asc").Find(&votes).Error; err != nil {
+		return nil, err
+	}
+	return votes, nil
+}
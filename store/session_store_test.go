@@ -0,0 +1,117 @@
+package store_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cycraig/scpbattle/db"
+	"github.com/cycraig/scpbattle/model"
+	"github.com/cycraig/scpbattle/store"
+)
+
+func TestSessionStore(t *testing.T) {
+	fdb := "TestSessionStore.db"
+	os.Remove(fdb)
+	d := db.NewDB("sqlite3", fdb, false)
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Log(err)
+		}
+		if err := os.Remove(fdb); err != nil {
+			t.Log(err)
+		}
+	}()
+	scpStore := store.NewSCPStore(d)
+	testSessionRepository(t, store.NewSessionStore(d), func(logs []model.VoteLog) error {
+		_, err := scpStore.ApplyDeltas(nil, nil, nil, logs)
+		return err
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	scpStore := store.NewMemorySCPStore()
+	testSessionRepository(t, scpStore.Sessions(), func(logs []model.VoteLog) error {
+		_, err := scpStore.ApplyDeltas(nil, nil, nil, logs)
+		return err
+	})
+}
+
+// testSessionRepository checks a SessionRepository whose votes are logged by logVotes, see
+// SCPRepository.ApplyDeltas.
+func testSessionRepository(t *testing.T, sessions store.SessionRepository, logVotes func([]model.VoteLog) error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	AssertNoError(t, sessions.CreateSession(&model.Session{ID: "a", CreatedAt: now.Add(-time.Minute)}))
+	AssertNoError(t, sessions.CreateSession(&model.Session{ID: "b", CreatedAt: now}))
+	AssertNoError(t, sessions.CreateSession(&model.Session{ID: "old", CreatedAt: now.Add(-2 * time.Hour)}))
+	session, err := sessions.GetSession("a")
+	AssertNoError(t, err)
+	AssertEqual(t, session.ID, "a")
+	AssertTrue(t, session.CreatedAt.Equal(now.Add(-time.Minute)), "Expected the creation time to be kept")
+	AssertTrue(t, session.RevokedAt == nil, "Expected the session not to be revoked")
+	session, err = sessions.GetSession("missing")
+	AssertNoError(t, err)
+	AssertTrue(t, session == nil, "Expected no session")
+
+	// Votes are listed in the order they were cast, in the order they were logged if cast at once,
+	// and only logged once per vote of a write-ahead log.
+	votes := []model.VoteLog{
+		{SessionID: "a", WinnerID: 1, LoserID: 2, CreatedAt: now.Add(2 * time.Second), WAL: "w", Seq: 1},
+		{SessionID: "a", WinnerID: 1, LoserID: 2, CreatedAt: now, WAL: "w", Seq: 2},
+		{SessionID: "a", WinnerID: 2, LoserID: 1, CreatedAt: now.Add(time.Second), WAL: "w", Seq: 3},
+		{SessionID: "a", WinnerID: 1, LoserID: 3, CreatedAt: now.Add(time.Second), WAL: "w", Seq: 4},
+		{SessionID: "b", WinnerID: 1, LoserID: 2, CreatedAt: now, WAL: "w", Seq: 5},
+		{SessionID: "old", WinnerID: 1, LoserID: 2, CreatedAt: now, WAL: "w", Seq: 6},
+	}
+	AssertNoError(t, logVotes(votes))
+	AssertNoError(t, logVotes(votes[:1]))
+	logged, err := sessions.GetVoteLog("a")
+	AssertNoError(t, err)
+	seqs := make([]uint64, len(logged))
+	for i, vote := range logged {
+		seqs[i] = vote.Seq
+	}
+	AssertEqual(t, fmt.Sprint(seqs), fmt.Sprint([]uint64{2, 3, 4, 1}))
+	AssertEqual(t, logged[2].LoserID, uint(3))
+	AssertTrue(t, logged[0].CreatedAt.Equal(now), "Expected the time the vote was cast")
+
+	// Revoking a session deletes its votes, keeping the time it was first revoked.
+	AssertNoError(t, sessions.RevokeSession("b", now))
+	AssertNoError(t, sessions.RevokeSession("b", now.Add(time.Minute)))
+	session, err = sessions.GetSession("b")
+	AssertNoError(t, err)
+	AssertTrue(t, session.RevokedAt != nil && session.RevokedAt.Equal(now), "Expected the session to be revoked")
+	logged, err = sessions.GetVoteLog("b")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+
+	// Deleting a session deletes its votes, and only those.
+	AssertNoError(t, sessions.DeleteSession("a"))
+	session, err = sessions.GetSession("a")
+	AssertNoError(t, err)
+	AssertTrue(t, session == nil, "Expected the session to be deleted")
+	logged, err = sessions.GetVoteLog("a")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+	logged, err = sessions.GetVoteLog("old")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 1)
+
+	// Sessions created before the given time are purged along with their votes, revoked or not.
+	purged, err := sessions.PurgeSessions(now.Add(-time.Hour))
+	AssertNoError(t, err)
+	AssertEqual(t, purged, int64(1))
+	session, err = sessions.GetSession("old")
+	AssertNoError(t, err)
+	AssertTrue(t, session == nil, "Expected the expired session to be purged")
+	logged, err = sessions.GetVoteLog("old")
+	AssertNoError(t, err)
+	AssertEqual(t, len(logged), 0)
+	session, err = sessions.GetSession("b")
+	AssertNoError(t, err)
+	AssertTrue(t, session != nil, "Expected the revoked session to be kept until it expires")
+	purged, err = sessions.PurgeSessions(now.Add(time.Second))
+	AssertNoError(t, err)
+	AssertEqual(t, purged, int64(1))
+}